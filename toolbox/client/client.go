@@ -0,0 +1,589 @@
+// Package client uploads files to a toolbox ChunkUploadHandler. It splits the file into chunks,
+// uploads them in parallel, retries failed chunks with exponential backoff, and resumes
+// interrupted uploads from the chunks the server reports it already has.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	toolbox "github.com/JackovAlltrades/go-toolbox"
+)
+
+// Default settings used when the corresponding Client field is zero
+const (
+	DefaultParallelism = 4
+	DefaultMaxRetries  = 3
+	DefaultRetryDelay  = 500 * time.Millisecond
+	maxRetryDelay      = 30 * time.Second
+)
+
+// Client uploads files to a toolbox ChunkUploadHandler
+type Client struct {
+	BaseURL           string        // URL the chunk handler is mounted at
+	HTTPClient        *http.Client  // Defaults to http.DefaultClient
+	Header            http.Header   // Extra headers sent with every request, e.g. Authorization
+	ChunkSize         int64         // Requested chunk size; the server may lower it
+	Parallelism       int           // Number of chunks uploaded at the same time
+	MaxRetries        int           // Number of times a failed request is retried
+	RetryDelay        time.Duration // Delay before the first retry, doubled on every further retry
+	ChecksumAlgorithm string        // Checksum sent with every chunk and the file, toolbox.ChecksumSHA256 by default; "none" disables checksums
+
+	// OnProgress is called after every chunk the server accepted. It may be called from several
+	// goroutines at once.
+	OnProgress func(Progress)
+
+	// ContentChunks enables content-defined chunking when set. The file is split where its content
+	// dictates rather than at fixed offsets, and only chunks the server does not already have are
+	// sent, so re-uploading an edited file transfers little more than the edit. MaxSize must not be
+	// larger than the server's ChunkSize. Options.UploadID is ignored in this mode: an interrupted
+	// upload is resumed by uploading the file again.
+	ContentChunks *toolbox.ContentChunkOptions
+}
+
+// Options describes a single upload
+type Options struct {
+	// UploadID resumes the upload with this ID if the server still has it, or starts a new upload
+	// with this ID if it does not. If empty, the server picks an ID.
+	UploadID    string
+	FileName    string
+	ContentType string
+	Metadata    map[string]string
+}
+
+// Progress reports how far an upload has come
+type Progress struct {
+	UploadID    string
+	BytesSent   int64 // Includes BytesReused
+	BytesReused int64 // Bytes the server already had from earlier uploads, with content-defined chunking
+	TotalBytes  int64
+	ChunksSent  int64
+	TotalChunks int64
+}
+
+// ServerError is an error response from the chunk handler
+type ServerError struct {
+	StatusCode int
+	Message    string
+	Code       string  // Machine readable error code, e.g. "upload_not_found", if the server sent one
+	Chunks     []int64 // Chunks the server asks to be sent again after a checksum mismatch
+}
+
+// Error implements the error interface
+func (se *ServerError) Error() string {
+	return fmt.Sprintf("server returned %d: %s", se.StatusCode, se.Message)
+}
+
+// temporary reports whether the request may succeed if it is sent again
+func (se *ServerError) temporary() bool {
+	return se.StatusCode >= 500 || se.StatusCode == http.StatusRequestTimeout ||
+		se.StatusCode == http.StatusTooManyRequests || len(se.Chunks) > 0
+}
+
+// UploadError is returned when an upload fails after the server accepted it. UploadID can be
+// passed in Options to resume the upload later.
+type UploadError struct {
+	UploadID string
+	Err      error
+}
+
+// Error implements the error interface
+func (ue *UploadError) Error() string {
+	return fmt.Sprintf("upload %s failed: %v", ue.UploadID, ue.Err)
+}
+
+// Unwrap returns the underlying error
+func (ue *UploadError) Unwrap() error {
+	return ue.Err
+}
+
+// New returns a client for the chunk handler mounted at baseURL
+func New(baseURL string) *Client {
+	return &Client{BaseURL: baseURL}
+}
+
+// UploadFile uploads the file at path. The file name defaults to the base name of path.
+func (c *Client) UploadFile(ctx context.Context, path string, opts Options) (*toolbox.UploadedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.FileName == "" {
+		opts.FileName = filepath.Base(path)
+	}
+
+	return c.UploadReaderAt(ctx, f, info.Size(), opts)
+}
+
+// Upload uploads size bytes read from r. If r is an io.ReaderAt, such as an *os.File, chunks are
+// read from it directly; otherwise r is first copied into a temporary file so that chunks can be
+// read again for retries and the whole-file checksum. Pass a negative size if it is not known.
+func (c *Client) Upload(ctx context.Context, r io.Reader, size int64, opts Options) (*toolbox.UploadedFile, error) {
+	if ra, ok := r.(io.ReaderAt); ok && size >= 0 {
+		return c.UploadReaderAt(ctx, ra, size, opts)
+	}
+
+	spool, err := os.CreateTemp("", "toolbox-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+
+	written, err := io.Copy(spool, r)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 && written != size {
+		return nil, fmt.Errorf("expected %d bytes, read %d", size, written)
+	}
+
+	return c.UploadReaderAt(ctx, spool, written, opts)
+}
+
+// UploadReaderAt uploads the first size bytes of r
+func (c *Client) UploadReaderAt(ctx context.Context, r io.ReaderAt, size int64, opts Options) (*toolbox.UploadedFile, error) {
+	if opts.FileName == "" {
+		return nil, errors.New("a file name is required")
+	}
+
+	if c.ContentChunks != nil {
+		return c.uploadContentDefined(ctx, r, size, opts)
+	}
+
+	status, err := c.startOrResume(ctx, r, size, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &upload{
+		client: c,
+		reader: r,
+		size:   size,
+		status: status,
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := u.sendMissingChunks(ctx); err != nil {
+			return nil, &UploadError{UploadID: status.UploadID, Err: err}
+		}
+
+		result, err := c.Complete(ctx, status.UploadID)
+		if err == nil {
+			return result, nil
+		}
+
+		// Chunks that were corrupted on the server are resent, everything else is final
+		var serverErr *ServerError
+		if !errors.As(err, &serverErr) || len(serverErr.Chunks) == 0 || attempt >= c.maxRetries() {
+			return nil, &UploadError{UploadID: status.UploadID, Err: err}
+		}
+		u.forget(serverErr.Chunks)
+	}
+}
+
+// startOrResume resumes the upload named in opts if the server still has it, or starts a new one
+func (c *Client) startOrResume(ctx context.Context, r io.ReaderAt, size int64, opts Options) (*toolbox.ChunkUploadStatus, error) {
+	if opts.UploadID != "" {
+		status, err := c.Status(ctx, opts.UploadID)
+		var serverErr *ServerError
+		switch {
+		case err == nil && status.State == toolbox.UploadStateCompleted:
+			return nil, fmt.Errorf("upload %s is already completed", opts.UploadID)
+		case err == nil && status.State.Terminal():
+			return nil, fmt.Errorf("upload %s is %s and cannot be resumed", opts.UploadID, status.State)
+		case err == nil:
+			if status.Size >= 0 && status.Size != size {
+				return nil, fmt.Errorf("upload %s was started for %d bytes, not %d", opts.UploadID, status.Size, size)
+			}
+			return status, nil
+		case errors.As(err, &serverErr) && serverErr.StatusCode == http.StatusNotFound:
+			// Start a new upload with the requested ID
+		default:
+			return nil, err
+		}
+	}
+
+	req := toolbox.ChunkUploadRequest{
+		UploadID:    opts.UploadID,
+		FileName:    opts.FileName,
+		Size:        size,
+		ChunkSize:   c.ChunkSize,
+		ContentType: opts.ContentType,
+		Metadata:    opts.Metadata,
+	}
+
+	if algorithm := c.checksumAlgorithm(); algorithm != "" {
+		checksum, err := fileChecksum(algorithm, r, size)
+		if err != nil {
+			return nil, err
+		}
+		req.Checksum = checksum
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var status toolbox.ChunkUploadStatus
+	err = c.retry(ctx, func() error {
+		return c.do(ctx, http.MethodPost, "/", bytes.NewReader(body), "application/json", nil, &status)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+// Status returns the state of an upload and the chunks the server has received
+func (c *Client) Status(ctx context.Context, uploadID string) (*toolbox.ChunkUploadStatus, error) {
+	var status toolbox.ChunkUploadStatus
+	err := c.retry(ctx, func() error {
+		return c.do(ctx, http.MethodGet, "/"+url.PathEscape(uploadID), nil, "", nil, &status)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+// Complete asks the server to assemble an upload whose chunks have all been sent
+func (c *Client) Complete(ctx context.Context, uploadID string) (*toolbox.UploadedFile, error) {
+	var result toolbox.UploadedFile
+	err := c.do(ctx, http.MethodPost, "/"+url.PathEscape(uploadID)+"/complete", nil, "", nil, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// Cancel cancels an upload and discards its chunks on the server
+func (c *Client) Cancel(ctx context.Context, uploadID string) error {
+	return c.retry(ctx, func() error {
+		return c.do(ctx, http.MethodDelete, "/"+url.PathEscape(uploadID), nil, "", nil, nil)
+	})
+}
+
+// upload holds the state of one upload in progress
+type upload struct {
+	client *Client
+	reader io.ReaderAt
+	size   int64
+	status *toolbox.ChunkUploadStatus
+
+	mu         sync.Mutex
+	received   map[int64]bool
+	bytesSent  atomic.Int64
+	chunksSent atomic.Int64
+}
+
+// forget marks chunks as not received so they are sent again
+func (u *upload) forget(chunks []int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, n := range chunks {
+		if u.received[n] {
+			delete(u.received, n)
+			u.chunksSent.Add(-1)
+			u.bytesSent.Add(-u.chunkLength(n))
+		}
+	}
+}
+
+// chunkLength returns the number of bytes in chunk n
+func (u *upload) chunkLength(n int64) int64 {
+	length := u.status.ChunkSize
+	if remaining := u.size - n*u.status.ChunkSize; remaining < length {
+		length = remaining
+	}
+	return length
+}
+
+// sendMissingChunks uploads every chunk the server does not have yet
+func (u *upload) sendMissingChunks(ctx context.Context) error {
+	u.mu.Lock()
+	if u.received == nil {
+		u.received = make(map[int64]bool, len(u.status.ReceivedChunks))
+		for _, n := range u.status.ReceivedChunks {
+			u.received[n] = true
+			u.chunksSent.Add(1)
+			u.bytesSent.Add(u.chunkLength(n))
+		}
+	}
+
+	var missing []int64
+	for n := int64(0); n < u.status.TotalChunks; n++ {
+		if !u.received[n] {
+			missing = append(missing, n)
+		}
+	}
+	u.mu.Unlock()
+
+	return u.client.parallel(ctx, len(missing), func(ctx context.Context, i int) error {
+		return u.sendChunk(ctx, missing[i])
+	})
+}
+
+// sendChunk reads chunk n and uploads it, retrying on failure
+func (u *upload) sendChunk(ctx context.Context, n int64) error {
+	data := make([]byte, u.chunkLength(n))
+	if _, err := u.reader.ReadAt(data, n*u.status.ChunkSize); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read chunk %d: %w", n, err)
+	}
+
+	header := make(http.Header)
+	if algorithm := u.client.checksumAlgorithm(); algorithm != "" {
+		checksum, err := toolbox.ComputeChecksum(algorithm, data)
+		if err != nil {
+			return err
+		}
+		header.Set(toolbox.ChunkChecksumHeader, checksum.Algorithm+"="+checksum.Value)
+	}
+
+	path := fmt.Sprintf("/%s/chunks/%d", url.PathEscape(u.status.UploadID), n)
+	err := u.client.retry(ctx, func() error {
+		return u.client.do(ctx, http.MethodPut, path, bytes.NewReader(data), "application/octet-stream", header, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("chunk %d: %w", n, err)
+	}
+
+	u.mu.Lock()
+	u.received[n] = true
+	u.mu.Unlock()
+
+	progress := Progress{
+		UploadID:    u.status.UploadID,
+		BytesSent:   u.bytesSent.Add(int64(len(data))),
+		TotalBytes:  u.size,
+		ChunksSent:  u.chunksSent.Add(1),
+		TotalChunks: u.status.TotalChunks,
+	}
+	if u.client.OnProgress != nil {
+		u.client.OnProgress(progress)
+	}
+
+	return nil
+}
+
+// parallel calls fn for 0 <= i < count on up to Parallelism goroutines. It stops at the first
+// error, cancelling the context passed to calls still in progress.
+func (c *Client) parallel(ctx context.Context, count int, fn func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	items := make(chan int)
+	errs := make(chan error, 1)
+	var wg sync.WaitGroup
+
+	for w := 0; w < c.parallelism(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range items {
+				if err := fn(ctx, i); err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < count; i++ {
+		select {
+		case items <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(items)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return ctx.Err()
+	}
+}
+
+// retry calls fn until it succeeds, fails with a permanent error, or MaxRetries is reached
+func (c *Client) retry(ctx context.Context, fn func() error) error {
+	delay := c.RetryDelay
+	if delay <= 0 {
+		delay = DefaultRetryDelay
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= c.maxRetries() || !retryable(ctx, err) {
+			return err
+		}
+
+		// Jitter keeps many clients from retrying in lockstep
+		wait := time.Duration(rand.Int63n(int64(delay))) + delay/2
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// retryable reports whether a failed request should be sent again
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.temporary()
+	}
+
+	// Anything else is a transport error
+	return true
+}
+
+// do sends a request to the chunk handler and decodes the data of its JSONResponse into out
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, contentType string, header http.Header, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.BaseURL, "/")+path, body)
+	if err != nil {
+		return err
+	}
+
+	for key, values := range c.Header {
+		req.Header[key] = values
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Errors come as a JSONResponse, or as problem details if the server is set up for them
+	var payload struct {
+		Error   bool            `json:"error"`
+		Message string          `json:"message"`
+		Code    string          `json:"code"`
+		Data    json.RawMessage `json:"data"`
+		Detail  string          `json:"detail"`
+		Chunks  []int64         `json:"chunks"`
+	}
+	decodeErr := json.NewDecoder(resp.Body).Decode(&payload)
+
+	if resp.StatusCode >= 300 || payload.Error {
+		serverErr := &ServerError{StatusCode: resp.StatusCode, Message: payload.Message, Code: payload.Code, Chunks: payload.Chunks}
+		if serverErr.Message == "" {
+			serverErr.Message = payload.Detail
+		}
+		if serverErr.Message == "" {
+			serverErr.Message = http.StatusText(resp.StatusCode)
+		}
+
+		var data struct {
+			Chunks []int64 `json:"chunks"`
+		}
+		if len(payload.Data) > 0 && json.Unmarshal(payload.Data, &data) == nil && data.Chunks != nil {
+			serverErr.Chunks = data.Chunks
+		}
+		return serverErr
+	}
+
+	if decodeErr != nil {
+		return fmt.Errorf("failed to decode response: %w", decodeErr)
+	}
+
+	if out != nil && len(payload.Data) > 0 {
+		return json.Unmarshal(payload.Data, out)
+	}
+
+	return nil
+}
+
+// fileChecksum computes the checksum of the first size bytes of r
+func fileChecksum(algorithm string, r io.ReaderAt, size int64) (*toolbox.Checksum, error) {
+	checksum, err := toolbox.ComputeChecksumReader(algorithm, io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+
+	return &checksum, nil
+}
+
+// checksumAlgorithm returns the algorithm to use, or "" if checksums are disabled
+func (c *Client) checksumAlgorithm() string {
+	switch c.ChecksumAlgorithm {
+	case "":
+		return toolbox.ChecksumSHA256
+	case "none":
+		return ""
+	default:
+		return c.ChecksumAlgorithm
+	}
+}
+
+// parallelism returns the number of chunks to upload at the same time
+func (c *Client) parallelism() int {
+	if c.Parallelism > 0 {
+		return c.Parallelism
+	}
+	return DefaultParallelism
+}
+
+// maxRetries returns the number of times a request is retried
+func (c *Client) maxRetries() int {
+	if c.MaxRetries > 0 {
+		return c.MaxRetries
+	}
+	return DefaultMaxRetries
+}
@@ -0,0 +1,265 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	toolbox "github.com/JackovAlltrades/go-toolbox"
+)
+
+// testServer runs the toolbox chunk handler under /uploads/. While failChunks is set, every chunk
+// upload is rejected with failStatus.
+type testServer struct {
+	*httptest.Server
+	tools      *toolbox.Tools
+	chunkPuts  atomic.Int64
+	failChunks atomic.Bool
+	failStatus int
+	failEvery  int64 // Reject every failEvery-th chunk upload, for flaky networks
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	dir := t.TempDir()
+	ts := &testServer{
+		tools: &toolbox.Tools{
+			UploadPath:        filepath.Join(dir, "uploads"),
+			ChunksDirectory:   filepath.Join(dir, "chunks"),
+			ChunkSize:         1024,
+			AllowUnknownTypes: true,
+		},
+		failStatus: http.StatusServiceUnavailable,
+	}
+	os.MkdirAll(ts.tools.UploadPath, 0755)
+
+	handler := http.StripPrefix("/uploads", ts.tools.ChunkUploadHandler())
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			n := ts.chunkPuts.Add(1)
+			if ts.failChunks.Load() || (ts.failEvery > 0 && n%ts.failEvery == 0) {
+				http.Error(w, "unavailable", ts.failStatus)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+// newTestClient returns a client for ts that retries quickly
+func newTestClient(ts *testServer) *Client {
+	c := New(ts.URL + "/uploads")
+	c.ChunkSize = 1024
+	c.RetryDelay = time.Millisecond
+	return c
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func TestClient_UploadFile(t *testing.T) {
+	ts := newTestServer(t)
+	ts.failEvery = 4 // A quarter of all chunk requests fail and have to be retried
+
+	data := randomData(10*1024 + 100)
+	path := filepath.Join(t.TempDir(), "source.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var last Progress
+	var calls int
+
+	c := newTestClient(ts)
+	c.Parallelism = 3
+	c.OnProgress = func(p Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if p.BytesSent > last.BytesSent {
+			last = p
+		}
+	}
+
+	result, err := c.UploadFile(context.Background(), path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.OriginalFileName != "source.bin" || result.FileSize != int64(len(data)) {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if result.FilePath != "" {
+		t.Error("server path should not be returned to the client")
+	}
+
+	stored, err := os.ReadFile(filepath.Join(ts.tools.UploadPath, result.NewFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, data) {
+		t.Error("uploaded file does not match the source")
+	}
+
+	if calls != 11 || last.ChunksSent != 11 || last.BytesSent != int64(len(data)) || last.TotalBytes != int64(len(data)) {
+		t.Errorf("unexpected progress after %d calls: %+v", calls, last)
+	}
+}
+
+func TestClient_Resume(t *testing.T) {
+	ts := newTestServer(t)
+	data := randomData(8 * 1024)
+
+	c := newTestClient(ts)
+	c.Parallelism = 1
+	c.MaxRetries = 1
+
+	// The server goes away after the first three chunks
+	c.OnProgress = func(p Progress) {
+		if p.ChunksSent == 3 {
+			ts.failChunks.Store(true)
+		}
+	}
+
+	_, err := c.Upload(context.Background(), bytes.NewReader(data), int64(len(data)), Options{UploadID: "resume-me", FileName: "resume.bin"})
+	var uploadErr *UploadError
+	if !errors.As(err, &uploadErr) || uploadErr.UploadID != "resume-me" {
+		t.Fatalf("expected an UploadError for resume-me, got %v", err)
+	}
+
+	status, err := c.Status(context.Background(), "resume-me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.ReceivedChunks) != 3 {
+		t.Fatalf("expected 3 chunks on the server, got %v", status.ReceivedChunks)
+	}
+
+	// A new client picks up where the first one stopped
+	ts.failChunks.Store(false)
+	before := ts.chunkPuts.Load()
+
+	resumed := newTestClient(ts)
+	result, err := resumed.Upload(context.Background(), bytes.NewReader(data), int64(len(data)), Options{UploadID: "resume-me", FileName: "resume.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent := ts.chunkPuts.Load() - before; sent != 5 {
+		t.Errorf("expected only the 5 missing chunks to be sent, got %d", sent)
+	}
+	if result.FileSize != int64(len(data)) {
+		t.Errorf("expected %d bytes, got %d", len(data), result.FileSize)
+	}
+
+	// Completed uploads cannot be resumed
+	if _, err := resumed.Upload(context.Background(), bytes.NewReader(data), int64(len(data)), Options{UploadID: "resume-me", FileName: "resume.bin"}); err == nil {
+		t.Error("expected an error when resuming a completed upload")
+	}
+}
+
+func TestClient_UploadStream(t *testing.T) {
+	ts := newTestServer(t)
+	data := randomData(3000)
+
+	// A plain io.Reader of unknown size is spooled before it is uploaded
+	c := newTestClient(ts)
+	result, err := c.Upload(context.Background(), io.MultiReader(bytes.NewReader(data)), -1, Options{FileName: "stream.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.FileSize != int64(len(data)) {
+		t.Errorf("expected %d bytes, got %d", len(data), result.FileSize)
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	ts := newTestServer(t)
+	ts.failStatus = http.StatusForbidden
+	ts.failChunks.Store(true)
+
+	c := newTestClient(ts)
+	_, err := c.Upload(context.Background(), strings.NewReader("hello"), 5, Options{FileName: "hello.txt"})
+
+	var uploadErr *UploadError
+	var serverErr *ServerError
+	if !errors.As(err, &uploadErr) || !errors.As(err, &serverErr) || serverErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a 403 UploadError, got %v", err)
+	}
+
+	// Client errors are not retried
+	if puts := ts.chunkPuts.Load(); puts != 1 {
+		t.Errorf("expected a single attempt, got %d", puts)
+	}
+
+	if err := c.Cancel(context.Background(), uploadErr.UploadID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Status(context.Background(), "missing"); !errors.As(err, &serverErr) || serverErr.StatusCode != http.StatusNotFound || serverErr.Code != "upload_not_found" {
+		t.Errorf("expected 404 upload_not_found for an unknown upload, got %v (%q)", err, serverErr.Code)
+	}
+
+	if _, err := c.Upload(context.Background(), strings.NewReader("x"), 1, Options{}); err == nil {
+		t.Error("expected an error without a file name")
+	}
+}
+
+func TestClient_ContentDefined(t *testing.T) {
+	ts := newTestServer(t)
+
+	c := newTestClient(ts)
+	c.ContentChunks = &toolbox.ContentChunkOptions{MinSize: 128, AvgSize: 256, MaxSize: 1024}
+
+	var reused int64
+	c.OnProgress = func(p Progress) {
+		atomic.StoreInt64(&reused, p.BytesReused)
+	}
+
+	data := randomData(64 * 1024)
+	if _, err := c.Upload(context.Background(), bytes.NewReader(data), int64(len(data)), Options{FileName: "v1.bin"}); err != nil {
+		t.Fatal(err)
+	}
+	firstPuts := ts.chunkPuts.Load()
+
+	// Re-upload the file with a small edit in the middle
+	edited := append(bytes.Clone(data[:30000]), append([]byte("a small edit"), data[30000:]...)...)
+	result, err := c.Upload(context.Background(), bytes.NewReader(edited), int64(len(edited)), Options{FileName: "v2.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent := ts.chunkPuts.Load() - firstPuts; sent == 0 || sent > 4 {
+		t.Errorf("expected only the edited chunks to be sent, got %d of %d", sent, firstPuts)
+	}
+	if atomic.LoadInt64(&reused) < int64(len(data))*9/10 {
+		t.Errorf("expected most of the file to be reused, got %d bytes", reused)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(ts.tools.UploadPath, result.NewFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, edited) {
+		t.Error("assembled file does not match the edited source")
+	}
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	toolbox "github.com/JackovAlltrades/go-toolbox"
+)
+
+// missingBatchSize is the number of hashes sent in one request to ask which chunks are missing
+const missingBatchSize = 4096
+
+// contentChunk is a content-defined chunk of the file being uploaded
+type contentChunk struct {
+	hash   string
+	offset int64
+	size   int64
+}
+
+// uploadContentDefined splits r into content-defined chunks, uploads only the chunks the server
+// does not have yet, and asks the server to assemble the file from its manifest
+func (c *Client) uploadContentDefined(ctx context.Context, r io.ReaderAt, size int64, opts Options) (*toolbox.UploadedFile, error) {
+	manifest := toolbox.ChunkManifest{FileName: opts.FileName}
+	var chunks []contentChunk
+
+	chunker := toolbox.NewContentChunker(io.NewSectionReader(r, 0, size), *c.ContentChunks)
+	var offset int64
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		chunk := contentChunk{hash: toolbox.ContentHash(data), offset: offset, size: int64(len(data))}
+		chunks = append(chunks, chunk)
+		manifest.Chunks = append(manifest.Chunks, toolbox.ManifestChunk{Hash: chunk.hash, Size: chunk.size})
+		offset += chunk.size
+	}
+
+	if algorithm := c.checksumAlgorithm(); algorithm != "" {
+		checksum, err := fileChecksum(algorithm, r, size)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Checksum = checksum
+	}
+
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := c.sendContentChunks(ctx, r, size, chunks); err != nil {
+			return nil, err
+		}
+
+		var result toolbox.UploadedFile
+		err := c.retry(ctx, func() error {
+			return c.do(ctx, http.MethodPost, "/cas/assemble", bytes.NewReader(body), "application/json", nil, &result)
+		})
+		if err == nil {
+			return &result, nil
+		}
+
+		// The server may have purged chunks it reported as present; ask again and send them
+		var serverErr *ServerError
+		if !errors.As(err, &serverErr) || serverErr.StatusCode != http.StatusConflict || attempt >= c.maxRetries() {
+			return nil, err
+		}
+	}
+}
+
+// sendContentChunks asks the server which chunks it is missing and uploads those
+func (c *Client) sendContentChunks(ctx context.Context, r io.ReaderAt, size int64, chunks []contentChunk) error {
+	missing := make(map[string]bool)
+	for start := 0; start < len(chunks); start += missingBatchSize {
+		end := min(start+missingBatchSize, len(chunks))
+
+		req := toolbox.ContentChunksRequest{Hashes: make([]string, 0, end-start)}
+		for _, chunk := range chunks[start:end] {
+			req.Hashes = append(req.Hashes, chunk.hash)
+		}
+
+		body, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+
+		var resp toolbox.ContentChunksRequest
+		err = c.retry(ctx, func() error {
+			return c.do(ctx, http.MethodPost, "/cas/missing", bytes.NewReader(body), "application/json", nil, &resp)
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, hash := range resp.Hashes {
+			missing[hash] = true
+		}
+	}
+
+	// Send every missing chunk once, even if it appears in the file more than once
+	var toSend []contentChunk
+	var reused int64
+	for _, chunk := range chunks {
+		if missing[chunk.hash] {
+			toSend = append(toSend, chunk)
+			delete(missing, chunk.hash)
+		} else {
+			reused += chunk.size
+		}
+	}
+
+	var bytesSent, chunksSent atomic.Int64
+	bytesSent.Store(reused)
+	chunksSent.Store(int64(len(chunks) - len(toSend)))
+
+	return c.parallel(ctx, len(toSend), func(ctx context.Context, i int) error {
+		chunk := toSend[i]
+
+		data := make([]byte, chunk.size)
+		if _, err := r.ReadAt(data, chunk.offset); err != nil && err != io.EOF {
+			return err
+		}
+
+		err := c.retry(ctx, func() error {
+			return c.do(ctx, http.MethodPut, "/cas/"+chunk.hash, bytes.NewReader(data), "application/octet-stream", nil, nil)
+		})
+		if err != nil {
+			return err
+		}
+
+		if c.OnProgress != nil {
+			c.OnProgress(Progress{
+				BytesSent:   bytesSent.Add(chunk.size),
+				BytesReused: reused,
+				TotalBytes:  size,
+				ChunksSent:  chunksSent.Add(1),
+				TotalChunks: int64(len(chunks)),
+			})
+		}
+
+		return nil
+	})
+}
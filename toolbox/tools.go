@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"log/slog"
 	"math/rand"
 	"mime/multipart"
 	"net/http"
@@ -13,12 +15,16 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const randomStringSource = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_+"
 
+const defaultMaxFileSize = 1024 * 1024 * 1024 // 1GB default
+
 // Tools is type used to instantiate the module. Variables of type allowed access
 // to all methods with reciever *Tools
 // Add MaxBatchSize to the Tools struct
@@ -37,8 +43,49 @@ type Tools struct {
 	AllowUnknownFields     bool  // Allow unknown fields in JSON
 
 	// For resumable uploads
-	ChunkSize       int64  // Size of each chunk in bytes
-	ChunksDirectory string // Directory to store chunks during upload
+	ChunkSize       int64         // Size of each chunk in bytes
+	ChunksDirectory string        // Directory to store chunks during upload
+	ChunkUploadTTL  time.Duration // How long an inactive upload is kept before it is purged (default 24h)
+	ContentChunkTTL time.Duration // How long an unused content-defined chunk is kept for reuse (default 7 days)
+
+	// SessionStore keeps the state of chunked uploads. If nil, sessions are stored as JSON files in
+	// the .sessions directory inside ChunksDirectory.
+	SessionStore UploadSessionStore
+
+	// ProgressHub receives progress events of uploads for UploadProgressHandler. If nil, no events
+	// are published.
+	ProgressHub *ProgressHub
+
+	// DownloadThrottle and UploadThrottle limit the bandwidth of downloads and uploads. If nil,
+	// only limits set on a request with WithRateLimit apply.
+	DownloadThrottle *Throttle
+	UploadThrottle   *Throttle
+
+	// DownloadCompression enables precompressed and on the fly compressed downloads. If nil,
+	// downloads are sent as they are stored.
+	DownloadCompression *CompressionOptions
+
+	// SigningKeys sign and verify download links. Links are signed with the first key and
+	// verified with any of them.
+	SigningKeys []SigningKey
+
+	// ClientIP returns the address of the client that sent a request, e.g. from a header set by a
+	// trusted proxy. If nil, the host of the request's RemoteAddr is used.
+	ClientIP func(r *http.Request) string
+
+	// ProblemDetails makes ErrorJSON send errors as application/problem+json (RFC 9457) instead of
+	// a JSONResponse. ErrorJSONFor also does so for clients that ask for it.
+	ProblemDetails bool
+
+	// ErrorCatalog maps errors to the status and code sent by ErrorJSON. If nil,
+	// DefaultErrorCatalog is used.
+	ErrorCatalog *ErrorCatalog
+
+	// Encoders are the formats WriteResponse and ReadBody support. If nil, DefaultEncoders is used.
+	Encoders *EncoderRegistry
+
+	// Logger receives diagnostic messages. If nil, slog.Default() is used.
+	Logger *slog.Logger
 
 	// For testing purposes - allows mocking the file type detection
 	detectFileType func(file multipart.File) (string, error)
@@ -56,7 +103,7 @@ type UploadedFile struct {
 // Add the InitDefaults method to the Tools struct
 func (t *Tools) InitDefaults() {
 	if t.MaxFileSize == 0 {
-		t.MaxFileSize = 1024 * 1024 * 1024 // 1GB default
+		t.MaxFileSize = defaultMaxFileSize
 	}
 
 	if t.MaxUploadCount == 0 {
@@ -88,6 +135,109 @@ func (t *Tools) GetFileSizeLimit(fileType string) int {
 	return t.MaxFileSize
 }
 
+// sniffFileType detects the content type of a file from its first 512 bytes and leaves the file
+// positioned at the start
+func (t *Tools) sniffFileType(file multipart.File) (string, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to reset file pointer: %w", err)
+	}
+
+	var fileType string
+
+	// Use custom detectFileType function if provided (for testing)
+	if t.detectFileType != nil {
+		detectedType, err := t.detectFileType(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to detect file type: %w", err)
+		}
+		fileType = detectedType
+	} else {
+		// Read file header for content type detection
+		buff := make([]byte, 512)
+		n, err := file.Read(buff)
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("failed to read file header: %w", err)
+		}
+
+		// Standard detection using http.DetectContentType
+		fileType = http.DetectContentType(buff[:n])
+	}
+
+	// Reset file pointer after detection
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to reset file pointer: %w", err)
+	}
+
+	return fileType, nil
+}
+
+// checkFileType returns an error wrapping ErrInvalidFileType if fileType is not permitted
+func (t *Tools) checkFileType(fileType string) error {
+	allowed := false // Start with false by default
+	if t.AllowUnknownTypes {
+		allowed = true // Allow if AllowUnknownTypes is true
+	} else if len(t.AllowedFileTypes) > 0 {
+		// Check if the file type is in the allowed list
+		for _, allowedType := range t.AllowedFileTypes {
+			// Use exact matching for MIME types
+			if strings.EqualFold(fileType, allowedType) {
+				allowed = true
+				break
+			}
+
+			// Also check for MIME type with parameters (e.g., "text/plain; charset=utf-8")
+			if strings.Contains(fileType, ";") {
+				baseMimeType := strings.TrimSpace(strings.Split(fileType, ";")[0])
+				if strings.EqualFold(baseMimeType, allowedType) {
+					allowed = true
+					break
+				}
+			}
+		}
+	} else {
+		// If no allowed types are specified and AllowUnknownTypes is false,
+		// we should allow all types by default
+		allowed = true
+	}
+
+	if !allowed {
+		return &ErrorResponse{
+			Err:     ErrInvalidFileType,
+			Message: fmt.Sprintf("file type %s is not permitted", fileType),
+		}
+	}
+
+	return nil
+}
+
+// checkFileSize returns an error wrapping ErrFileSizeExceeded if size is over the limit for fileType
+func (t *Tools) checkFileSize(fileName, fileType string, size int64) error {
+	// Get type-specific size limit
+	sizeLimit := t.GetFileSizeLimit(fileType)
+
+	if size > int64(sizeLimit) {
+		return &ErrorResponse{
+			Err: ErrFileSizeExceeded,
+			Message: fmt.Sprintf("file %s exceeds the maximum allowed size for type %s (%d bytes)",
+				fileName, fileType, sizeLimit),
+		}
+	}
+
+	return nil
+}
+
+// largestFileSizeLimit returns the highest size limit of any file type, for checks made before
+// the type of a file is known
+func (t *Tools) largestFileSizeLimit() int {
+	limit := t.MaxFileSize
+	for _, limits := range []map[string]int{t.TypeSpecificSizeLimits, t.DefaultSizeLimits} {
+		for _, l := range limits {
+			limit = max(limit, l)
+		}
+	}
+	return limit
+}
+
 // Add the RandomString method
 // Fix the RandomString method to use mathrand instead of rand
 func (t *Tools) RandomString(n int) string {
@@ -99,8 +249,54 @@ func (t *Tools) RandomString(n int) string {
 	return string(b)
 }
 
-// Fix the UploadFiles method to properly handle the boolean parameter
+// UploadFiles saves the files of a multipart request in uploadDir. If a ProgressHub is set and the
+// request names an upload ID from ProgressHub.NewUploadID in the X-Upload-ID header or the
+// upload_id query parameter, progress events are published for it while the request body is read,
+// followed by a completed or failed event. The body is read no faster than t.UploadThrottle allows.
 func (t *Tools) UploadFiles(r *http.Request, uploadDir string, rename bool) ([]*UploadedFile, error) {
+	t.throttleRequest(r)
+
+	if t.ProgressHub == nil {
+		return t.uploadFiles(r, uploadDir, rename)
+	}
+
+	uploadID := t.progressUploadID(r)
+	if uploadID == "" {
+		return t.uploadFiles(r, uploadDir, rename)
+	}
+
+	body := t.newProgressReader(uploadID, r.Body, r.ContentLength)
+	r.Body = body
+
+	files, err := t.uploadFiles(r, uploadDir, rename)
+	if err != nil {
+		t.publishEvent(UploadEvent{
+			UploadID:      uploadID,
+			Type:          UploadEventFailed,
+			BytesReceived: body.read,
+			TotalBytes:    r.ContentLength,
+			Files:         files,
+			Error:         err.Error(),
+			Final:         true,
+		})
+		return files, err
+	}
+
+	t.publishEvent(UploadEvent{
+		UploadID:      uploadID,
+		Type:          UploadEventCompleted,
+		State:         UploadStateCompleted,
+		BytesReceived: body.read,
+		TotalBytes:    r.ContentLength,
+		Files:         files,
+		Final:         true,
+	})
+
+	return files, nil
+}
+
+// Fix the UploadFiles method to properly handle the boolean parameter
+func (t *Tools) uploadFiles(r *http.Request, uploadDir string, rename bool) ([]*UploadedFile, error) {
 	// Initialize defaults if not set
 	t.InitDefaults()
 
@@ -166,76 +362,22 @@ func (t *Tools) UploadFiles(r *http.Request, uploadDir string, rename bool) ([]*
 				}
 				defer infile.Close()
 
-				// Read file header for content type detection
-				buff := make([]byte, 512)
-				n, err := infile.Read(buff)
-				if err != nil && err != io.EOF {
-					return nil, fmt.Errorf("failed to read file header: %w", err)
-				}
-				buff = buff[:n]
-
 				// Detect and validate file type
-				var fileType string
-
-				// Use custom detectFileType function if provided (for testing)
-				if t.detectFileType != nil {
-					detectedType, err := t.detectFileType(infile)
-					if err != nil {
-						return nil, fmt.Errorf("failed to detect file type: %w", err)
-					}
-					fileType = detectedType
-
-					// Reset file pointer after detection
-					_, err = infile.Seek(0, 0)
-					if err != nil {
-						return nil, fmt.Errorf("failed to reset file pointer: %w", err)
-					}
-				} else {
-					// Standard detection using http.DetectContentType
-					fileType = http.DetectContentType(buff)
+				fileType, err := t.sniffFileType(infile)
+				if err != nil {
+					return nil, err
 				}
 
 				uploadedFile.FileType = fileType
 
 				// Check if file type is allowed
-				allowed := false // Start with false by default
-				if t.AllowUnknownTypes {
-					allowed = true // Allow if AllowUnknownTypes is true
-				} else if len(t.AllowedFileTypes) > 0 {
-					// Check if the file type is in the allowed list
-					for _, allowedType := range t.AllowedFileTypes {
-						// Use exact matching for MIME types
-						if strings.EqualFold(fileType, allowedType) {
-							allowed = true
-							break
-						}
-
-						// Also check for MIME type with parameters (e.g., "text/plain; charset=utf-8")
-						if strings.Contains(fileType, ";") {
-							baseMimeType := strings.TrimSpace(strings.Split(fileType, ";")[0])
-							if strings.EqualFold(baseMimeType, allowedType) {
-								allowed = true
-								break
-							}
-						}
-					}
-				} else {
-					// If no allowed types are specified and AllowUnknownTypes is false,
-					// we should allow all types by default
-					allowed = true
+				if err := t.checkFileType(fileType); err != nil {
+					return nil, err
 				}
 
-				if !allowed {
-					return nil, fmt.Errorf("file type %s is not permitted", fileType)
-				}
-
-				// Get type-specific size limit
-				sizeLimit := t.GetFileSizeLimit(fileType)
-
 				// Check individual file size against type-specific limit
-				if hdr.Size > int64(sizeLimit) {
-					return nil, fmt.Errorf("file %s exceeds the maximum allowed size for type %s (%d bytes)",
-						hdr.Filename, fileType, sizeLimit)
+				if err := t.checkFileSize(hdr.Filename, fileType, hdr.Size); err != nil {
+					return nil, err
 				}
 
 				// Reset file pointer to beginning
@@ -337,7 +479,7 @@ func (t *Tools) UploadFiles(r *http.Request, uploadDir string, rename bool) ([]*
 					if err := t.ValidationCallback(&uploadedFile); err != nil {
 						// Clean up file on validation error
 						os.Remove(finalPath)
-						return nil, fmt.Errorf("file validation failed: %w", err)
+						return nil, validationCallbackError(err)
 					}
 				}
 
@@ -391,6 +533,21 @@ func (t *Tools) CreateDirIfNotExist(path string) error {
 	return nil
 }
 
+// transliterator replaces common accented Latin letters with their ASCII equivalents.
+// This is a simple replacement - consider using a proper transliteration library for production
+var transliterator = strings.NewReplacer(
+	"æ", "ae", "ø", "o", "å", "a", "ü", "u", "ö", "o", "ä", "a",
+	"ñ", "n", "é", "e", "è", "e", "ê", "e", "ë", "e", "á", "a",
+	"à", "a", "â", "a", "ã", "a", "ç", "c", "í", "i", "ì", "i",
+	"î", "i", "ï", "i", "ó", "o", "ò", "o", "ô", "o", "õ", "o",
+	"ú", "u", "ù", "u", "û", "u", "ý", "y", "ÿ", "y", "ß", "ss",
+	"Æ", "AE", "Ø", "O", "Å", "A", "Ü", "U", "Ö", "O", "Ä", "A",
+	"Ñ", "N", "É", "E", "È", "E", "Ê", "E", "Ë", "E", "Á", "A",
+	"À", "A", "Â", "A", "Ã", "A", "Ç", "C", "Í", "I", "Ì", "I",
+	"Î", "I", "Ï", "I", "Ó", "O", "Ò", "O", "Ô", "O", "Õ", "O",
+	"Ú", "U", "Ù", "U", "Û", "U", "Ý", "Y",
+)
+
 // Slugify converts a string to a URL-friendly slug
 // It handles special characters, multiple spaces, and ensures proper formatting
 func (t *Tools) Slugify(s string) (string, error) {
@@ -403,15 +560,7 @@ func (t *Tools) Slugify(s string) (string, error) {
 	s = strings.TrimSpace(strings.ToLower(s))
 
 	// Handle non-ASCII characters (optional transliteration)
-	// This is a simple replacement - consider using a proper transliteration library for production
-	replacer := strings.NewReplacer(
-		"æ", "ae", "ø", "o", "å", "a", "ü", "u", "ö", "o", "ä", "a",
-		"ñ", "n", "é", "e", "è", "e", "ê", "e", "ë", "e", "á", "a",
-		"à", "a", "â", "a", "ã", "a", "ç", "c", "í", "i", "ì", "i",
-		"î", "i", "ï", "i", "ó", "o", "ò", "o", "ô", "o", "õ", "o",
-		"ú", "u", "ù", "u", "û", "u", "ý", "y", "ÿ", "y",
-	)
-	s = replacer.Replace(s)
+	s = transliterator.Replace(s)
 
 	// Replace any non-alphanumeric characters with hyphens
 	var re = regexp.MustCompile(`[^a-z0-9]+`)
@@ -460,6 +609,19 @@ var (
 	ErrContentVerification = errors.New("content type verification failed")
 	ErrNoFileUploaded      = errors.New("no file uploaded")
 	ErrFileCreation        = errors.New("error creating file")
+	ErrChecksumMismatch    = errors.New("checksum mismatch")
+	ErrInvalidChecksum     = errors.New("invalid checksum")
+	ErrUploadNotFound      = errors.New("upload not found")
+	ErrUploadExists        = errors.New("upload already exists")
+	ErrInvalidUploadID     = errors.New("invalid upload ID")
+	ErrInvalidUploadState  = errors.New("invalid upload state")
+	ErrInvalidChunkNumber  = errors.New("invalid chunk number")
+	ErrNotAcceptable       = errors.New("not acceptable")
+	ErrUnsupportedMedia    = errors.New("unsupported media type")
+
+	// ErrInsufficientStorage is returned when an upload cannot be written because the disk is full.
+	// It wraps ErrFileCreation.
+	ErrInsufficientStorage = fmt.Errorf("insufficient storage: %w", ErrFileCreation)
 )
 
 // ErrorResponse wraps an error with additional context
@@ -478,264 +640,543 @@ func (er *ErrorResponse) Unwrap() error {
 	return er.Err
 }
 
-// Remove the duplicate import and Tools struct declaration here
+// newUploadSession builds the session of a new chunked upload
+func newUploadSession(uploadID, fileName string, totalChunks int64, options ChunkedUploadOptions) *UploadSession {
+	now := time.Now()
+
+	declaredSize := options.DeclaredSize
+	if declaredSize < 0 {
+		declaredSize = -1
+	}
+
+	return &UploadSession{
+		ID:           uploadID,
+		FileName:     fileName,
+		Owner:        options.Owner,
+		DeclaredSize: declaredSize,
+		ContentType:  options.ContentType,
+		Metadata:     options.Metadata,
+		TotalChunks:  totalChunks,
+		ChunkSize:    options.ChunkSize,
+		Checksum:     options.Checksum,
+		State:        UploadStateCreated,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+}
+
+// InitChunkedUpload registers a resumable upload before any chunk is sent and stores its session
+// in SessionStore. It is optional, but it is the only way to declare the owner, size, content type,
+// custom metadata and whole-file checksum of the upload; the checksum is verified by
+// CompleteChunkedUpload.
+func (t *Tools) InitChunkedUpload(uploadID, fileName string, totalChunks int64, opts ...ChunkedUploadOptions) error {
+	options := ChunkedUploadOptions{DeclaredSize: -1}
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+
+	if err := validateUploadID(uploadID); err != nil {
+		return err
+	}
+
+	if options.Checksum != nil {
+		if err := options.Checksum.validate(); err != nil {
+			return err
+		}
+	}
+
+	unlock := t.lockUpload(uploadID)
+	defer unlock()
 
-// UploadChunk saves a chunk of a file during a resumable upload
-func (t *Tools) UploadChunk(uploadID, fileName string, chunkNumber, totalChunks int64, data []byte) error {
-	// Create chunks directory if it doesn't exist
 	chunksDir := filepath.Join(t.ChunksDirectory, uploadID)
 	if err := t.CreateDirIfNotExist(chunksDir); err != nil {
-		return &ErrorResponse{
-			Err:     ErrFileCreation,
-			Message: fmt.Sprintf("failed to create chunks directory: %v", err),
+		return fileCreationError(err, "failed to create chunks directory")
+	}
+
+	if options.ChunkSize <= 0 {
+		options.ChunkSize = t.ChunkSize
+	}
+
+	session := newUploadSession(uploadID, fileName, totalChunks, options)
+	if err := t.sessionStore().Create(session); err != nil {
+		return err
+	}
+
+	t.publishStateChange(session)
+	return nil
+}
+
+// UploadChunk saves a chunk of a file during a resumable upload. If a checksum is given, the
+// chunk is verified before it is stored, and a *ChecksumError is returned when it does not match
+// so the client can send that chunk again.
+func (t *Tools) UploadChunk(uploadID, fileName string, chunkNumber, totalChunks int64, data []byte, checksum ...Checksum) error {
+	if err := validateUploadID(uploadID); err != nil {
+		return err
+	}
+
+	// Verify the chunk before anything is written
+	if len(checksum) > 0 {
+		if err := checksum[0].validate(); err != nil {
+			return err
+		}
+
+		h, _ := newChecksumHash(checksum[0].Algorithm)
+		h.Write(data)
+		if !checksum[0].matches(h.Sum(nil)) {
+			return &ChecksumError{
+				UploadID: uploadID,
+				Chunks:   []int64{chunkNumber},
+				Message: fmt.Sprintf("chunk %d of upload %s failed %s verification",
+					chunkNumber, uploadID, checksum[0].Algorithm),
+			}
 		}
 	}
 
-	// Save the chunk
-	chunkPath := filepath.Join(chunksDir, fmt.Sprintf("%d", chunkNumber))
-	if err := os.WriteFile(chunkPath, data, 0644); err != nil {
+	unlock := t.lockUpload(uploadID)
+	defer unlock()
+
+	// Load the session, starting one if the upload was not initialised
+	store := t.sessionStore()
+	session, err := store.Get(uploadID)
+	if errors.Is(err, ErrUploadNotFound) {
+		session = newUploadSession(uploadID, fileName, totalChunks, ChunkedUploadOptions{DeclaredSize: -1, ChunkSize: t.ChunkSize})
+		err = store.Create(session)
+	}
+	if err != nil {
+		return err
+	}
+
+	if session.State.Terminal() {
 		return &ErrorResponse{
-			Err:     ErrFileCreation,
-			Message: fmt.Sprintf("failed to save chunk: %v", err),
+			Err:     ErrInvalidUploadState,
+			Message: fmt.Sprintf("upload %s is %s and no longer accepts chunks", uploadID, session.State),
 		}
 	}
 
-	// Save metadata if this is the first chunk
-	if chunkNumber == 0 {
-		metadata := struct {
-			FileName    string `json:"file_name"`
-			TotalChunks int64  `json:"total_chunks"`
-			FileSize    int64  `json:"file_size"`
-			UploadTime  int64  `json:"upload_time"`
-		}{
-			FileName:    fileName,
-			TotalChunks: totalChunks,
-			FileSize:    -1, // Will be calculated when all chunks are received
-			UploadTime:  time.Now().Unix(),
+	if chunkNumber < 0 || chunkNumber >= session.TotalChunks {
+		return &ErrorResponse{
+			Err:     ErrInvalidChunkNumber,
+			Message: fmt.Sprintf("chunk %d is out of range for upload %s with %d chunks", chunkNumber, uploadID, session.TotalChunks),
 		}
+	}
 
-		metadataJSON, err := json.Marshal(metadata)
-		if err != nil {
-			return &ErrorResponse{
-				Err:     ErrFileCreation,
-				Message: fmt.Sprintf("failed to create metadata: %v", err),
-			}
+	// Create chunks directory if it doesn't exist
+	chunksDir := filepath.Join(t.ChunksDirectory, uploadID)
+	if err := t.CreateDirIfNotExist(chunksDir); err != nil {
+		return fileCreationError(err, "failed to create chunks directory")
+	}
+
+	// Save the chunk, writing it under a temporary name first so a crash never leaves a
+	// truncated chunk behind that looks complete
+	chunkPath := filepath.Join(chunksDir, fmt.Sprintf("%d", chunkNumber))
+	previous, statErr := os.Stat(chunkPath)
+	partPath := chunkPath + ".part"
+	if err := os.WriteFile(partPath, data, 0644); err != nil {
+		os.Remove(partPath)
+		return fileCreationError(err, "failed to save chunk")
+	}
+	if err := os.Rename(partPath, chunkPath); err != nil {
+		os.Remove(partPath)
+		return fileCreationError(err, "failed to save chunk")
+	}
+
+	// Keep the checksum so the chunk can be verified again on completion
+	if len(checksum) > 0 {
+		if err := writeChunkChecksum(chunkPath, checksum[0]); err != nil {
+			return fileCreationError(err, "failed to save chunk checksum")
 		}
+	} else {
+		os.Remove(chunkChecksumPath(chunkPath))
+	}
 
-		metadataPath := filepath.Join(chunksDir, "metadata.json")
-		if err := os.WriteFile(metadataPath, metadataJSON, 0644); err != nil {
-			return &ErrorResponse{
-				Err:     ErrFileCreation,
-				Message: fmt.Sprintf("failed to save metadata: %v", err),
-			}
+	// Count the chunk, replacing the size of an earlier copy of it
+	if statErr == nil {
+		session.ReceivedBytes -= previous.Size()
+	} else {
+		session.ReceivedChunks++
+	}
+	session.ReceivedBytes += int64(len(data))
+
+	// The first chunk moves a new upload into the uploading state
+	if session.StartedAt.IsZero() {
+		session.StartedAt = time.Now()
+	}
+	if session.State == UploadStateCreated {
+		if err := session.Transition(UploadStateUploading); err != nil {
+			return err
 		}
+	} else {
+		session.UpdatedAt = time.Now()
+	}
+
+	if err := store.Save(session); err != nil {
+		return err
 	}
 
+	t.publishChunkProgress(session)
 	return nil
 }
 
-// CompleteChunkedUpload assembles all chunks into the final file
+// CompleteChunkedUpload assembles all chunks into the final file. Chunks uploaded with a checksum
+// are verified again, and the whole file is checked against the checksum declared with
+// InitChunkedUpload. Chunks that fail verification are discarded and reported in a
+// *ChecksumError so that only those need to be sent again.
+//
+// Chunks are streamed into a temporary file in UploadPath which is renamed into place once it is
+// complete, and the chunks are only removed after that succeeded. The file is stored under a random
+// name with the extension of originalFileName, which is kept in OriginalFileName, so an upload
+// never replaces another file. The upload is locked for the
+// whole assembly, so UploadChunk and CancelChunkedUpload for the same uploadID wait for it.
+//
+// The assembled file goes through the same checks as UploadFiles: its content type is sniffed and
+// checked against AllowedFileTypes, its size against GetFileSizeLimit, and ValidationCallback is
+// run last. A rejected file is deleted, while the chunks are kept until the upload is cancelled.
+//
+// The session moves to completed, with the resulting file recorded in its Result, or back to
+// uploading if assembly failed so the client can fix the upload and try again.
 func (t *Tools) CompleteChunkedUpload(uploadID, originalFileName string) (*UploadedFile, error) {
-	chunksDir := filepath.Join(t.ChunksDirectory, uploadID)
+	if err := validateUploadID(uploadID); err != nil {
+		return nil, err
+	}
 
-	// Read metadata
-	metadataPath := filepath.Join(chunksDir, "metadata.json")
-	metadataJSON, err := os.ReadFile(metadataPath)
+	unlock := t.lockUpload(uploadID)
+	defer unlock()
+
+	store := t.sessionStore()
+	session, err := store.Get(uploadID)
 	if err != nil {
-		return nil, &ErrorResponse{
-			Err:     ErrFileCreation,
-			Message: fmt.Sprintf("failed to read metadata: %v", err),
+		return nil, err
+	}
+
+	if err := session.Transition(UploadStateCompleting); err != nil {
+		return nil, err
+	}
+	if err := store.Save(session); err != nil {
+		return nil, err
+	}
+	t.publishStateChange(session)
+
+	uploadedFile, err := t.assembleChunks(session, originalFileName)
+	if err != nil {
+		rollbackErr := session.Transition(UploadStateUploading)
+		if rollbackErr == nil {
+			rollbackErr = store.Save(session)
 		}
+		if rollbackErr != nil {
+			t.logger().Error("failed to reopen upload", "upload_id", uploadID, "error", rollbackErr)
+			err = errors.Join(err, fmt.Errorf("failed to reopen upload: %w", rollbackErr))
+		}
+
+		// The upload stays open so the client can fix it and complete it again
+		t.publishEvent(UploadEvent{
+			UploadID:    uploadID,
+			Type:        UploadEventFailed,
+			State:       session.State,
+			TotalBytes:  session.DeclaredSize,
+			TotalChunks: session.TotalChunks,
+			Error:       err.Error(),
+		})
+		return nil, err
 	}
 
-	var metadata struct {
-		FileName    string `json:"file_name"`
-		TotalChunks int64  `json:"total_chunks"`
-		FileSize    int64  `json:"file_size"`
-		UploadTime  int64  `json:"upload_time"`
+	session.Result = uploadedFile
+	if err := session.Transition(UploadStateCompleted); err != nil {
+		return nil, err
+	}
+	if err := store.Save(session); err != nil {
+		return nil, err
 	}
 
-	if err := json.Unmarshal(metadataJSON, &metadata); err != nil {
-		return nil, &ErrorResponse{
-			Err:     ErrFileCreation,
-			Message: fmt.Sprintf("failed to parse metadata: %v", err),
+	t.publishEvent(UploadEvent{
+		UploadID:       uploadID,
+		Type:           UploadEventCompleted,
+		State:          session.State,
+		BytesReceived:  uploadedFile.FileSize,
+		TotalBytes:     session.DeclaredSize,
+		ChunksReceived: session.TotalChunks,
+		TotalChunks:    session.TotalChunks,
+		Files:          []*UploadedFile{uploadedFile},
+		Final:          true,
+	})
+
+	// Clean up chunks now that the file is safely in place
+	os.RemoveAll(filepath.Join(t.ChunksDirectory, uploadID))
+
+	return uploadedFile, nil
+}
+
+// assembleChunks verifies the chunks of session, assembles them and runs the upload policy on the
+// result. It must be called with the upload locked.
+func (t *Tools) assembleChunks(session *UploadSession, originalFileName string) (*UploadedFile, error) {
+	uploadID := session.ID
+	chunksDir := filepath.Join(t.ChunksDirectory, uploadID)
+
+	// Verify the stored chunks before building anything from them
+	var corrupt []int64
+	for i := int64(0); i < session.TotalChunks; i++ {
+		chunkPath := filepath.Join(chunksDir, fmt.Sprintf("%d", i))
+		checksum, err := readChunkChecksum(chunkPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read checksum of chunk %d: %w", i, err)
+		}
+		if checksum == nil {
+			continue
+		}
+
+		ok, err := verifyFileChecksum(chunkPath, *checksum)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify chunk %d: %w", i, err)
+		}
+		if !ok {
+			corrupt = append(corrupt, i)
+			if info, err := os.Stat(chunkPath); err == nil && os.Remove(chunkPath) == nil {
+				session.ReceivedBytes -= info.Size()
+				session.ReceivedChunks--
+			}
+			os.Remove(chunkChecksumPath(chunkPath))
 		}
 	}
 
-	// Create upload directory if it doesn't exist
-	if err := t.CreateDirIfNotExist(t.UploadPath); err != nil {
-		return nil, &ErrorResponse{
-			Err:     ErrFileCreation,
-			Message: fmt.Sprintf("failed to create upload directory: %v", err),
+	if len(corrupt) > 0 {
+		return nil, &ChecksumError{
+			UploadID: uploadID,
+			Chunks:   corrupt,
+			Message:  fmt.Sprintf("chunks %v of upload %s failed checksum verification", corrupt, uploadID),
 		}
 	}
 
-	// Create a new file name if needed
-	newFileName := originalFileName
-	if strings.HasPrefix(filepath.Base(originalFileName), "resumable-") {
-		// For test files, generate a new name
-		ext := filepath.Ext(originalFileName)
-		newFileName = fmt.Sprintf("%s%s", t.RandomString(25), ext)
+	chunkPaths := make([]string, session.TotalChunks)
+	for i := range chunkPaths {
+		chunkPaths[i] = filepath.Join(chunksDir, fmt.Sprintf("%d", i))
 	}
 
-	// Create the final file
-	finalPath := filepath.Join(t.UploadPath, newFileName)
-	finalFile, err := os.Create(finalPath)
+	return t.assembleFile(uploadID, originalFileName, chunkPaths, session.Checksum)
+}
+
+// assembleFile concatenates the chunk files into a new file in UploadPath, verifies it against
+// checksum if one is given, and applies the same type, size and callback checks as UploadFiles
+func (t *Tools) assembleFile(uploadID, originalFileName string, chunkPaths []string, checksum *Checksum) (*UploadedFile, error) {
+	// Initialize defaults if not set, as UploadFiles does
+	t.InitDefaults()
+
+	// Create upload directory if it doesn't exist
+	if err := t.CreateDirIfNotExist(t.UploadPath); err != nil {
+		return nil, fileCreationError(err, "failed to create upload directory")
+	}
+
+	// Store the file under a random name, as UploadFiles does when renaming, so clients cannot
+	// replace files already in UploadPath
+	newFileName := fmt.Sprintf("%s%s", t.RandomString(25), filepath.Ext(originalFileName))
+
+	// Assemble into a temporary file next to the final one so the rename cannot cross devices
+	tempFile, err := os.CreateTemp(t.UploadPath, "temp_chunked_*")
 	if err != nil {
-		return nil, &ErrorResponse{
-			Err:     ErrFileCreation,
-			Message: fmt.Sprintf("failed to create final file: %v", err),
+		return nil, fileCreationError(err, "failed to create temporary file")
+	}
+	tempPath := tempFile.Name()
+	committed := false
+	defer func() {
+		tempFile.Close()
+		if !committed {
+			os.Remove(tempPath)
 		}
+	}()
+
+	// Hash the file as it is assembled if a whole-file checksum was declared
+	var out io.Writer = tempFile
+	var fileHash hash.Hash
+	if checksum != nil {
+		fileHash, err = newChecksumHash(checksum.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		out = io.MultiWriter(tempFile, fileHash)
 	}
-	defer finalFile.Close()
 
 	// Assemble chunks
 	var fileSize int64
-	for i := int64(0); i < metadata.TotalChunks; i++ {
-		chunkPath := filepath.Join(chunksDir, fmt.Sprintf("%d", i))
-		chunkData, err := os.ReadFile(chunkPath)
+	for i, chunkPath := range chunkPaths {
+		n, err := appendChunk(out, chunkPath)
 		if err != nil {
-			// Clean up the partial file
-			os.Remove(finalPath)
-			return nil, &ErrorResponse{
-				Err:     ErrFileCreation,
-				Message: fmt.Sprintf("failed to read chunk %d: %v", i, err),
-			}
+			return nil, fileCreationError(err, fmt.Sprintf("failed to assemble chunk %d", i))
 		}
+		fileSize += n
+	}
 
-		n, err := finalFile.Write(chunkData)
-		if err != nil {
-			// Clean up the partial file
-			os.Remove(finalPath)
-			return nil, &ErrorResponse{
-				Err:     ErrFileCreation,
-				Message: fmt.Sprintf("failed to write chunk %d to final file: %v", i, err),
-			}
+	if err := tempFile.Sync(); err != nil {
+		return nil, fileCreationError(err, "failed to flush assembled file")
+	}
+
+	// Verify the whole file
+	if fileHash != nil && !checksum.matches(fileHash.Sum(nil)) {
+		return nil, &ChecksumError{
+			UploadID: uploadID,
+			Message: fmt.Sprintf("assembled file %s failed %s verification",
+				originalFileName, checksum.Algorithm),
 		}
+	}
 
-		fileSize += int64(n)
+	// Sniff the real content type and apply the same policy as UploadFiles
+	fileType, err := t.sniffFileType(tempFile)
+	if err != nil {
+		return nil, err
 	}
 
-	// Determine file type
-	finalFile.Seek(0, 0)
-	fileType := "application/octet-stream" // Default if detection fails
+	if err := t.checkFileType(fileType); err != nil {
+		return nil, err
+	}
 
-	if t.detectFileType != nil {
-		detectedType, err := t.detectFileType(finalFile)
-		if err == nil {
-			fileType = detectedType
-		}
+	if err := t.checkFileSize(originalFileName, fileType, fileSize); err != nil {
+		return nil, err
 	}
 
-	// Clean up chunks
-	os.RemoveAll(chunksDir)
+	if err := tempFile.Close(); err != nil {
+		return nil, fileCreationError(err, "failed to close assembled file")
+	}
 
-	// Return the uploaded file info
-	return &UploadedFile{
+	// Move the assembled file into place
+	finalPath := filepath.Join(t.UploadPath, newFileName)
+	if err := os.Rename(tempPath, finalPath); err != nil {
+		return nil, fileCreationError(err, "failed to move assembled file into place")
+	}
+	committed = true
+
+	uploadedFile := &UploadedFile{
 		NewFileName:      newFileName,
 		OriginalFileName: originalFileName,
 		FileSize:         fileSize,
 		FileType:         fileType,
-	}, nil
-}
-
-// GetUploadProgress returns the progress of a chunked upload
-func (t *Tools) GetUploadProgress(uploadID string) (float64, error) {
-	chunksDir := filepath.Join(t.ChunksDirectory, uploadID)
+		FilePath:         finalPath,
+	}
 
-	// Read metadata
-	metadataPath := filepath.Join(chunksDir, "metadata.json")
-	metadataJSON, err := os.ReadFile(metadataPath)
-	if err != nil {
-		return 0, &ErrorResponse{
-			Err:     fmt.Errorf("upload not found"),
-			Message: fmt.Sprintf("upload ID %s not found", uploadID),
+	// Run custom validation if provided
+	if t.ValidationCallback != nil {
+		if err := t.ValidationCallback(uploadedFile); err != nil {
+			// Clean up file on validation error
+			os.Remove(finalPath)
+			return nil, validationCallbackError(err)
 		}
 	}
 
-	var metadata struct {
-		FileName    string `json:"file_name"`
-		TotalChunks int64  `json:"total_chunks"`
-		FileSize    int64  `json:"file_size"`
-		UploadTime  int64  `json:"upload_time"`
-	}
+	return uploadedFile, nil
+}
 
-	if err := json.Unmarshal(metadataJSON, &metadata); err != nil {
-		return 0, &ErrorResponse{
-			Err:     ErrFileCreation,
-			Message: fmt.Sprintf("failed to parse metadata: %v", err),
-		}
+// validationCallbackError reports a file rejected by ValidationCallback. It wraps both
+// ErrContentVerification, so the rejection is sent as 422, and err.
+func validationCallbackError(err error) error {
+	return &ErrorResponse{
+		Err:     fmt.Errorf("%w: %w", ErrContentVerification, err),
+		Message: fmt.Sprintf("file validation failed: %v", err),
 	}
+}
 
-	// Count the number of chunks that have been uploaded
-	files, err := os.ReadDir(chunksDir)
+// appendChunk streams the chunk stored at chunkPath into out
+func appendChunk(out io.Writer, chunkPath string) (int64, error) {
+	chunk, err := os.Open(chunkPath)
 	if err != nil {
-		return 0, &ErrorResponse{
-			Err:     fmt.Errorf("failed to read chunks directory"),
-			Message: fmt.Sprintf("failed to read chunks directory: %v", err),
-		}
+		return 0, err
 	}
+	defer chunk.Close()
 
-	// Subtract 1 for the metadata file
-	uploadedChunks := int64(len(files)) - 1
+	return io.Copy(out, chunk)
+}
 
-	// Calculate progress percentage
-	progress := float64(uploadedChunks) / float64(metadata.TotalChunks) * 100.0
+// GetUploadProgress returns the progress of a chunked upload, measured in bytes when the total
+// size was declared and in chunks otherwise
+func (t *Tools) GetUploadProgress(uploadID string) (*UploadProgress, error) {
+	session, err := t.GetUploadSession(uploadID)
+	if err != nil {
+		return nil, err
+	}
 
-	return progress, nil
+	switch session.State {
+	case UploadStateCancelled, UploadStateExpired:
+		return nil, &ErrorResponse{
+			Err:     ErrInvalidUploadState,
+			Message: fmt.Sprintf("upload %s is %s", uploadID, session.State),
+		}
+	}
+
+	return newUploadProgress(session, time.Now()), nil
 }
 
-// ListActiveUploads returns a list of all active chunked uploads
-func (t *Tools) ListActiveUploads() ([]string, error) {
-	// Create chunks directory if it doesn't exist
-	if err := t.CreateDirIfNotExist(t.ChunksDirectory); err != nil {
+// receivedChunks returns the sorted numbers of the chunks stored for an upload
+func (t *Tools) receivedChunks(uploadID string) ([]int64, error) {
+	files, err := os.ReadDir(filepath.Join(t.ChunksDirectory, uploadID))
+	if err != nil && !os.IsNotExist(err) {
 		return nil, &ErrorResponse{
-			Err:     ErrFileCreation,
-			Message: fmt.Sprintf("failed to create chunks directory: %v", err),
+			Err:     fmt.Errorf("failed to read chunks directory: %w", err),
+			Message: "failed to read chunks directory",
 		}
 	}
 
-	// Read all directories in the chunks directory
-	entries, err := os.ReadDir(t.ChunksDirectory)
-	if err != nil {
-		return nil, &ErrorResponse{
-			Err:     fmt.Errorf("failed to read chunks directory"),
-			Message: fmt.Sprintf("failed to read chunks directory: %v", err),
+	// Only count chunk files, not the checksum or partially written files
+	chunks := []int64{}
+	for _, file := range files {
+		if n, err := strconv.ParseInt(file.Name(), 10, 64); err == nil {
+			chunks = append(chunks, n)
 		}
 	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i] < chunks[j] })
+
+	return chunks, nil
+}
+
+// ListActiveUploads returns the IDs of all chunked uploads that are neither completed, cancelled
+// nor expired
+func (t *Tools) ListActiveUploads() ([]string, error) {
+	sessions, err := t.sessionStore().List(UploadSessionFilter{
+		States: []UploadState{UploadStateCreated, UploadStateUploading, UploadStateCompleting},
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	// Filter for directories only
 	var uploadIDs []string
-	for _, entry := range entries {
-		if entry.IsDir() {
-			// Check if this is a valid upload (has metadata)
-			metadataPath := filepath.Join(t.ChunksDirectory, entry.Name(), "metadata.json")
-			if _, err := os.Stat(metadataPath); err == nil {
-				uploadIDs = append(uploadIDs, entry.Name())
-			}
-		}
+	for _, session := range sessions {
+		uploadIDs = append(uploadIDs, session.ID)
 	}
 
 	return uploadIDs, nil
 }
 
-// CancelChunkedUpload cancels an in-progress chunked upload
+// CancelChunkedUpload cancels an in-progress chunked upload, removing its chunks and marking its
+// session as cancelled
 func (t *Tools) CancelChunkedUpload(uploadID string) error {
+	if err := validateUploadID(uploadID); err != nil {
+		return err
+	}
+
+	unlock := t.lockUpload(uploadID)
+	defer unlock()
+
 	chunksDir := filepath.Join(t.ChunksDirectory, uploadID)
 
-	// Check if the upload exists
-	if _, err := os.Stat(chunksDir); os.IsNotExist(err) {
-		return &ErrorResponse{
-			Err:     fmt.Errorf("upload not found"),
-			Message: fmt.Sprintf("upload ID %s not found", uploadID),
+	store := t.sessionStore()
+	session, err := store.Get(uploadID)
+	switch {
+	case errors.Is(err, ErrUploadNotFound):
+		// Chunks left by an upload without a session can still be cancelled
+		if _, statErr := os.Stat(chunksDir); os.IsNotExist(statErr) {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		if err := session.Transition(UploadStateCancelled); err != nil {
+			return err
+		}
+		if err := store.Save(session); err != nil {
+			return err
 		}
+		t.publishStateChange(session)
 	}
 
 	// Remove the chunks directory
 	if err := os.RemoveAll(chunksDir); err != nil {
 		return &ErrorResponse{
-			Err:     fmt.Errorf("failed to cancel upload"),
-			Message: fmt.Sprintf("failed to remove chunks directory: %v", err),
+			Err:     fmt.Errorf("failed to remove chunks directory: %w", err),
+			Message: "failed to remove chunks directory",
 		}
 	}
 
@@ -744,30 +1185,22 @@ func (t *Tools) CancelChunkedUpload(uploadID string) error {
 
 // DownloadStaticFile downloads a file, and tries to force the browser to avoid displaying it
 // in the browser window by setting content disposition. It also allows specification of the
-// display name
+// display name. See ServeDownloadFile for the caching and range headers it handles.
 func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, p, file, displayName string) {
-	fp := path.Join(p, file)
-	fmt.Printf("DownloadStaticFile: Full path to file: %s\n", fp)
-
-	// Check if file exists
-	if _, err := os.Stat(fp); os.IsNotExist(err) {
-		fmt.Printf("DownloadStaticFile: File not found: %s\n", fp)
-		http.Error(w, "File not found", http.StatusNotFound)
-		return
-	}
-
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", displayName))
-	http.ServeFile(w, r, fp)
+	t.ServeDownloadFile(w, r, path.Join(p, file), DownloadOptions{DisplayName: displayName})
 }
 
 // JSONResponse is the type used for sending JSON around
 type JSONResponse struct {
 	Error   bool        `json:"error"`
 	Message string      `json:"message"`
+	Code    string      `json:"code,omitempty"`
 	Data    interface{} `json:"data,omitempty"`
 }
 
-// ReadJSON tries to read the body of a request and converts from json into a go data variable
+// ReadJSON tries to read the body of a request and converts from json into a go data variable.
+// Problems with the JSON itself are returned as a *JSONError. If data is a struct with validate
+// tags, it is validated afterwards and ValidationErrors is returned if any field is invalid.
 func (t *Tools) ReadJSON(w http.ResponseWriter, r *http.Request, data interface{}) error {
 	maxBytes := 1024 * 1024 // one meg
 	if t.MaxJSONSize != 0 {
@@ -776,103 +1209,40 @@ func (t *Tools) ReadJSON(w http.ResponseWriter, r *http.Request, data interface{
 
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
 
-	dec := json.NewDecoder(r.Body)
+	// Keep what was read, to locate errors
+	var body bytes.Buffer
+	dec := json.NewDecoder(io.TeeReader(r.Body, &body))
 
 	if !t.AllowUnknownFields {
 		dec.DisallowUnknownFields()
 	}
 
-	err := dec.Decode(data)
-	if err != nil {
-		var syntaxError *json.SyntaxError
-		var unmarshalTypeError *json.UnmarshalTypeError
-		var invalidUnmarshalError *json.InvalidUnmarshalError
-
-		switch {
-		case errors.As(err, &syntaxError):
-			// Get the problematic part of the JSON
-			problemJSON := extractProblemJSON(r, syntaxError.Offset)
-			return fmt.Errorf("syntax error in JSON at position %d: %s",
-				syntaxError.Offset, problemJSON)
-
-		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("JSON is incomplete or malformed")
-
-		case errors.As(err, &unmarshalTypeError):
-			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("incorrect data type for field '%s' - expected %s but got %s",
-					unmarshalTypeError.Field, unmarshalTypeError.Type, unmarshalTypeError.Value)
-			}
-			return fmt.Errorf("incorrect data type at position %d", unmarshalTypeError.Offset)
-
-		case errors.Is(err, io.EOF):
-			return errors.New("request body is empty - JSON data required")
-
-		case strings.HasPrefix(err.Error(), "json: unknown field"):
-			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
-			return fmt.Errorf("unknown field in JSON: %s", fieldName)
-
-		case err.Error() == "http: request body too large":
-			return fmt.Errorf("JSON data exceeds maximum size of %d bytes", maxBytes)
-
-		case errors.As(err, &invalidUnmarshalError):
-			return fmt.Errorf("error unmarshalling JSON: %s", err.Error())
-
-		default:
-			return fmt.Errorf("error parsing JSON: %s", err.Error())
-		}
+	if err := dec.Decode(data); err != nil {
+		return decodeError(err, body.Bytes(), dec, maxBytes)
 	}
 
-	err = dec.Decode(&struct{}{})
+	offset := dec.InputOffset()
+	err := dec.Decode(&struct{}{})
 	if err != io.EOF {
-		return errors.New("request body must contain only one JSON object")
-	}
-
-	return nil
-}
-
-// Helper function to extract the problematic part of the JSON
-func extractProblemJSON(r *http.Request, offset int64) string {
-	// Make a copy of the request body
-	var bodyCopy bytes.Buffer
-	_, err := io.Copy(&bodyCopy, r.Body)
-	if err != nil {
-		return "could not read request body"
-	}
-
-	// Restore the request body
-	r.Body = io.NopCloser(bytes.NewReader(bodyCopy.Bytes()))
-
-	// Extract the problematic part
-	jsonStr := bodyCopy.String()
-
-	// Determine the context window (10 chars before and after the error)
-	start := int(offset) - 10
-	if start < 0 {
-		start = 0
-	}
-
-	end := int(offset) + 10
-	if end > len(jsonStr) {
-		end = len(jsonStr)
-	}
-
-	// Extract the context
-	context := jsonStr[start:end]
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return newJSONError(JSONErrorTooLarge, body.Bytes(), maxBytesError.Limit, err,
+				"JSON data exceeds maximum size of %d bytes", maxBytes)
+		}
 
-	// Mark the error position
-	position := int(offset) - start
-	if position >= 0 && position < len(context) {
-		return fmt.Sprintf("%s >>> %c <<< %s",
-			context[:position],
-			context[position],
-			context[position+1:])
+		// Skip the white space after the first value to point at what follows it
+		for offset < int64(body.Len()) && strings.ContainsRune(" \t\r\n", rune(body.Bytes()[offset])) {
+			offset++
+		}
+		return newJSONError(JSONErrorTrailingData, body.Bytes(), offset, err, "request body must contain only one JSON object")
 	}
 
-	return context
+	// Check the validate tags of the decoded struct, see Validate
+	return t.Validate(data)
 }
 
-// WriteJSON takes a response status code and arbitrary data and writes json to the client
+// WriteJSON takes a response status code and arbitrary data and writes json to the client.
+// ProblemDetails are sent with the application/problem+json content type.
 func (t *Tools) WriteJSON(w http.ResponseWriter, status int, data interface{}, headers ...http.Header) error {
 	out, err := json.Marshal(data)
 	if err != nil {
@@ -885,7 +1255,13 @@ func (t *Tools) WriteJSON(w http.ResponseWriter, status int, data interface{}, h
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	contentType := "application/json"
+	switch data.(type) {
+	case ProblemDetails, *ProblemDetails:
+		contentType = ProblemContentType
+	}
+
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(status)
 	_, err = w.Write(out)
 	if err != nil {
@@ -894,28 +1270,75 @@ func (t *Tools) WriteJSON(w http.ResponseWriter, status int, data interface{}, h
 	return nil
 }
 
-// ErrorJSON takes an error, & optionally a status code, and generates and sends a JSON error message
-// ErrorJSON takes an error, & optionally a status code, and generates and sends a JSON error message
+// ErrorJSON takes an error, & optionally a status code, and generates and sends a JSON error message.
+// Without a status, the status is looked up in the ErrorCatalog of t, e.g. 404 for ErrUploadNotFound
+// or 422 for ValidationErrors, and is 400 for unknown errors; the code of a known error is sent in
+// the code field. A JSONError is described in the data field, with its kind, location and types,
+// and ValidationErrors with the problems of each field as {"fields": {"name": ["is required"]}}.
+// If t.ProblemDetails is set, the error is sent as application/problem+json instead, see
+// ProblemDetails. A *ProblemDetails error is sent with its own Status unless status is given.
 func (t *Tools) ErrorJSON(w http.ResponseWriter, err error, status ...int) error {
-	statusCode := http.StatusBadRequest
-
-	if len(status) > 0 {
-		statusCode = status[0]
+	if !t.ProblemDetails {
+		return t.writeErrorEnvelope(w, err, status...)
 	}
 
+	statusCode, payload := t.errorPayload(err, status...)
+	problem := newProblemDetails(err, statusCode, payload)
+	return t.WriteJSON(w, problem.Status, problem)
+}
+
+// writeErrorEnvelope sends err as a JSONResponse
+func (t *Tools) writeErrorEnvelope(w http.ResponseWriter, err error, status ...int) error {
+	statusCode, payload := t.errorPayload(err, status...)
+	return t.WriteJSON(w, statusCode, payload)
+}
+
+// errorPayload returns the status and JSONResponse ErrorJSON sends for err
+func (t *Tools) errorPayload(err error, status ...int) (int, JSONResponse) {
+	statusCode := http.StatusBadRequest
+
 	var payload JSONResponse
 	payload.Error = true
 	payload.Message = err.Error()
 
-	// Add additional error context if it's a JSON parsing error
-	if strings.Contains(err.Error(), "JSON") || strings.Contains(err.Error(), "json") {
-		payload.Data = map[string]string{
-			"error_type": "json_parsing_error",
-			"help":       "Check your JSON syntax, especially quotes, commas, and brackets",
+	if code, ok := t.errorCatalog().Lookup(err); ok {
+		statusCode = code.Status
+		payload.Code = code.Code
+	}
+
+	var problem *ProblemDetails
+	if errors.As(err, &problem) && problem.Status != 0 {
+		statusCode = problem.Status
+	}
+
+	if len(status) > 0 {
+		statusCode = status[0]
+	}
+
+	// Add additional error context if it's a stream record, JSON parsing, validation or checksum error
+	var jsonErr *JSONError
+	var checksumErr *ChecksumError
+	var validationErrs ValidationErrors
+	var recordErrs RecordErrors
+	var recordErr *RecordError
+	switch {
+	case errors.As(err, &recordErrs):
+		payload.Data = recordErrorDetails(recordErrs...)
+	case errors.As(err, &recordErr):
+		payload.Data = recordErrorDetails(recordErr)
+	case errors.As(err, &validationErrs):
+		payload.Message = "validation failed"
+		payload.Data = map[string]interface{}{
+			"error_type": "validation_error",
+			"fields":     validationErrs,
 		}
+	case errors.As(err, &jsonErr):
+		payload.Data = jsonErrorDetails(jsonErr)
+	case errors.As(err, &checksumErr) && len(checksumErr.Chunks) > 0:
+		payload.Data = map[string]interface{}{"chunks": checksumErr.Chunks}
 	}
 
-	return t.WriteJSON(w, statusCode, payload)
+	return statusCode, payload
 }
 
 // PushJSONToRemote posts arbitrary data to some URL as JSON, and returns the response, status code, and error, if any.
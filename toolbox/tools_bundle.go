@@ -0,0 +1,333 @@
+package toolbox
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Archive formats supported by ServeBundle
+const (
+	BundleZip   = "zip"
+	BundleTarGz = "tar.gz"
+)
+
+// BundleEntry is a file to include in a bundle
+type BundleEntry struct {
+	Path string // Location of the file on disk
+	Name string // Name inside the archive, may contain folders; defaults to the base name of Path
+}
+
+// BundleOptions controls how ServeBundle builds an archive
+type BundleOptions struct {
+	Format        string // BundleZip (default) or BundleTarGz
+	FileName      string // Name of the download; defaults to "download.zip" or "download.tar.gz"
+	NoCompression bool   // Store ZIP entries as is, faster for files that are already compressed
+
+	// ModTime, if set, is used as the time of every entry instead of the modification time of its
+	// file, so the same files always produce the same archive
+	ModTime time.Time
+}
+
+// BundleResult describes what ServeBundle put in the archive
+type BundleResult struct {
+	Files     []string // Names of the entries written in full
+	Skipped   []string // Paths of files that could not be opened, e.g. because they were removed
+	Truncated []string // Names of entries cut short because their file failed or shrank while it was read
+	Bytes     int64    // Total size of the file data written, before compression
+}
+
+// bundleWriter adds files to an archive
+type bundleWriter interface {
+	add(name string, info os.FileInfo, modTime time.Time, r io.Reader) (int64, error)
+	Close() error
+}
+
+// ServeBundle streams the files in entries to w as a single ZIP or tar.gz archive, without storing
+// the archive anywhere. ZIP archives switch to ZIP64 by themselves when they grow beyond 4GB or
+// 65535 entries.
+//
+// Files that are missing when the request starts are left out; if none of them exist, the response
+// is a 404. Once the archive is being sent its status can no longer change, so a file that
+// disappears is skipped, and one that fails or shrinks while it is read is cut short (tar entries
+// are padded to their declared size) so the archive stays readable. Both are logged and reported
+// in the result. The error is only set if the format is not supported or writing to the client
+// failed.
+func (t *Tools) ServeBundle(w http.ResponseWriter, r *http.Request, entries []BundleEntry, opts ...BundleOptions) (*BundleResult, error) {
+	var options BundleOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+
+	if options.Format == "" {
+		options.Format = BundleZip
+	}
+	if options.Format != BundleZip && options.Format != BundleTarGz {
+		return nil, fmt.Errorf("unsupported bundle format %q", options.Format)
+	}
+	if options.FileName == "" {
+		options.FileName = "download." + options.Format
+	}
+
+	result := &BundleResult{}
+
+	// Leave out files that are already gone while the status can still be set
+	var present []BundleEntry
+	for _, entry := range entries {
+		if info, err := os.Stat(entry.Path); err != nil || !info.Mode().IsRegular() {
+			t.logger().Warn("bundle file not found", "path", entry.Path)
+			result.Skipped = append(result.Skipped, entry.Path)
+			continue
+		}
+		present = append(present, entry)
+	}
+
+	if len(present) == 0 {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return result, nil
+	}
+
+	contentType := "application/zip"
+	if options.Format == BundleTarGz {
+		contentType = "application/gzip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", ContentDisposition(DispositionAttachment, options.FileName))
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodHead {
+		return result, nil
+	}
+
+	err := t.writeBundle(t.throttleResponse(w, r), present, options, result)
+	if err != nil {
+		t.logger().Error("failed to send bundle", "file", options.FileName, "error", err)
+	}
+
+	return result, err
+}
+
+// writeBundle writes the archive of entries to w
+func (t *Tools) writeBundle(w io.Writer, entries []BundleEntry, options BundleOptions, result *BundleResult) error {
+	var archive bundleWriter
+	if options.Format == BundleTarGz {
+		archive = newTarGzBundle(w)
+	} else {
+		archive = newZipBundle(w, options.NoCompression)
+	}
+
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		name := uniqueBundleName(bundleEntryName(entry), names)
+
+		written, err := t.addBundleFile(archive, entry.Path, name, options.ModTime)
+		result.Bytes += written
+
+		var fileErr *bundleFileError
+		switch {
+		case errors.As(err, &fileErr) && fileErr.opened:
+			t.logger().Warn("bundle file truncated", "path", entry.Path, "error", fileErr.err)
+			result.Truncated = append(result.Truncated, name)
+		case errors.As(err, &fileErr):
+			t.logger().Warn("bundle file disappeared", "path", entry.Path, "error", fileErr.err)
+			result.Skipped = append(result.Skipped, entry.Path)
+		case err != nil:
+			// The client went away or the archive itself failed
+			return err
+		default:
+			result.Files = append(result.Files, name)
+		}
+	}
+
+	return archive.Close()
+}
+
+// bundleFileError is a problem with a file, as opposed to the archive or the client
+type bundleFileError struct {
+	err    error
+	opened bool // Whether part of the file may already be in the archive
+}
+
+// Error implements the error interface
+func (e *bundleFileError) Error() string {
+	return e.err.Error()
+}
+
+// addBundleFile adds the file at filePath to archive as name
+func (t *Tools) addBundleFile(archive bundleWriter, filePath, name string, modTime time.Time) (int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, &bundleFileError{err: err}
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, &bundleFileError{err: err}
+	}
+
+	if modTime.IsZero() {
+		modTime = info.ModTime()
+	}
+
+	source := &bundleSource{r: file}
+	written, err := archive.add(name, info, modTime, source)
+	if err == nil && source.err != nil {
+		err = &bundleFileError{err: source.err, opened: true}
+	}
+	if err == nil && written < info.Size() {
+		err = &bundleFileError{err: fmt.Errorf("file shrank from %d to %d bytes", info.Size(), written), opened: true}
+	}
+
+	return written, err
+}
+
+// bundleSource reads a file for an archive entry. A read error ends the entry early instead of
+// failing the whole archive; it is kept in err.
+type bundleSource struct {
+	r   io.Reader
+	err error
+}
+
+// Read implements io.Reader
+func (bs *bundleSource) Read(p []byte) (int, error) {
+	n, err := bs.r.Read(p)
+	if err != nil && err != io.EOF {
+		bs.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// bundleEntryName returns the cleaned name of entry inside the archive
+func bundleEntryName(entry BundleEntry) string {
+	name := entry.Name
+	if name == "" {
+		name = filepath.Base(entry.Path)
+	}
+
+	// Archive names use forward slashes and must not escape the folder they are extracted to
+	name = path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))
+	name = strings.TrimPrefix(name, "/")
+	if name == "" || name == "." {
+		name = filepath.Base(entry.Path)
+	}
+
+	return name
+}
+
+// uniqueBundleName returns name, or name with a counter added if it is already taken
+func uniqueBundleName(name string, taken map[string]bool) string {
+	unique := name
+	ext := path.Ext(name)
+	for i := 2; taken[unique]; i++ {
+		unique = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+
+	taken[unique] = true
+	return unique
+}
+
+// zipBundle writes a ZIP archive
+type zipBundle struct {
+	zw     *zip.Writer
+	method uint16
+}
+
+func newZipBundle(w io.Writer, noCompression bool) *zipBundle {
+	method := zip.Deflate
+	if noCompression {
+		method = zip.Store
+	}
+	return &zipBundle{zw: zip.NewWriter(w), method: method}
+}
+
+// add writes an entry. Its sizes and checksum follow the data, so nothing is buffered.
+func (zb *zipBundle) add(name string, info os.FileInfo, modTime time.Time, r io.Reader) (int64, error) {
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   zb.method,
+		Modified: modTime.UTC(),
+	}
+	header.SetMode(info.Mode().Perm())
+
+	entry, err := zb.zw.CreateHeader(header)
+	if err != nil {
+		return 0, err
+	}
+
+	return io.Copy(entry, r)
+}
+
+// Close writes the central directory
+func (zb *zipBundle) Close() error {
+	return zb.zw.Close()
+}
+
+// tarGzBundle writes a gzip compressed tar archive
+type tarGzBundle struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func newTarGzBundle(w io.Writer) *tarGzBundle {
+	gz := gzip.NewWriter(w)
+	return &tarGzBundle{gz: gz, tw: tar.NewWriter(gz)}
+}
+
+// add writes an entry. Tar headers carry the size up front, so a file that shrinks is padded with
+// zeros and one that grows is cut off at its original size.
+func (tb *tarGzBundle) add(name string, info os.FileInfo, modTime time.Time, r io.Reader) (int64, error) {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     info.Size(),
+		Mode:     int64(info.Mode().Perm()),
+		ModTime:  modTime.UTC(),
+		Format:   tar.FormatPAX,
+	}
+
+	if err := tb.tw.WriteHeader(header); err != nil {
+		return 0, err
+	}
+
+	written, err := io.CopyN(tb.tw, r, info.Size())
+	if err != nil && err != io.EOF {
+		return written, err
+	}
+
+	if missing := info.Size() - written; missing > 0 {
+		if _, err := io.CopyN(tb.tw, zeroReader{}, missing); err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// Close finishes the tar archive and the gzip stream
+func (tb *tarGzBundle) Close() error {
+	if err := tb.tw.Close(); err != nil {
+		return err
+	}
+	return tb.gz.Close()
+}
+
+// zeroReader reads an endless stream of zeros
+type zeroReader struct{}
+
+// Read implements io.Reader
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
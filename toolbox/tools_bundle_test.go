@@ -0,0 +1,198 @@
+package toolbox
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bundleTestFiles writes a few files to dir and returns them as bundle entries
+func bundleTestFiles(t *testing.T, dir string) []BundleEntry {
+	t.Helper()
+
+	files := map[string]string{"a.txt": "first file", "b.txt": "second file", "c.txt": "third file"}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return []BundleEntry{
+		{Path: filepath.Join(dir, "a.txt"), Name: "docs/Übersicht.txt"},
+		{Path: filepath.Join(dir, "b.txt"), Name: "../../escape.txt"},
+		{Path: filepath.Join(dir, "c.txt"), Name: "docs/Übersicht.txt"},
+		{Path: filepath.Join(dir, "missing.txt")},
+	}
+}
+
+// TestTools_ServeBundle_Zip tests streaming a ZIP archive
+func TestTools_ServeBundle_Zip(t *testing.T) {
+	setupTestDir(t, "./testdata/bundle/")
+	defer cleanupTestDir(t, "./testdata/bundle/")
+
+	tools := Tools{}
+	entries := bundleTestFiles(t, "./testdata/bundle/")
+	fixed := time.Date(2024, 1, 2, 3, 4, 6, 0, time.UTC)
+
+	serve := func() (*httptest.ResponseRecorder, *BundleResult) {
+		rr := httptest.NewRecorder()
+		result, err := tools.ServeBundle(rr, httptest.NewRequest(http.MethodGet, "/", nil), entries, BundleOptions{FileName: "photos.zip", ModTime: fixed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr, result
+	}
+
+	rr, result := serve()
+	if rr.Header().Get("Content-Type") != "application/zip" || rr.Header().Get("Content-Disposition") != `attachment; filename="photos.zip"` {
+		t.Errorf("unexpected headers %v", rr.Header())
+	}
+	if len(result.Files) != 3 || len(result.Skipped) != 1 || result.Bytes != 31 {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"docs/Übersicht.txt":     "first file",
+		"escape.txt":             "second file",
+		"docs/Übersicht (2).txt": "third file",
+	}
+	if len(archive.File) != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected), len(archive.File))
+	}
+	for _, f := range archive.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+
+		if expected[f.Name] != string(content) {
+			t.Errorf("entry %s has content %q", f.Name, content)
+		}
+		if !f.Modified.Equal(fixed) {
+			t.Errorf("entry %s has time %v, expected %v", f.Name, f.Modified, fixed)
+		}
+	}
+
+	// A fixed time makes the archive reproducible
+	if again, _ := serve(); !bytes.Equal(again.Body.Bytes(), rr.Body.Bytes()) {
+		t.Error("the same files with a fixed time should give the same archive")
+	}
+
+	// Nothing to send
+	rr = httptest.NewRecorder()
+	tools.ServeBundle(rr, httptest.NewRequest(http.MethodGet, "/", nil), entries[3:])
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 when no file exists, got %d", rr.Code)
+	}
+
+	if _, err := tools.ServeBundle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), entries, BundleOptions{Format: "rar"}); err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+}
+
+// TestTools_ServeBundle_TarGz tests streaming a tar.gz archive
+func TestTools_ServeBundle_TarGz(t *testing.T) {
+	setupTestDir(t, "./testdata/bundle/")
+	defer cleanupTestDir(t, "./testdata/bundle/")
+
+	tools := Tools{}
+	entries := bundleTestFiles(t, "./testdata/bundle/")
+
+	rr := httptest.NewRecorder()
+	result, err := tools.ServeBundle(rr, httptest.NewRequest(http.MethodGet, "/", nil), entries, BundleOptions{Format: BundleTarGz})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.Header().Get("Content-Disposition") != `attachment; filename="download.tar.gz"` || len(result.Files) != 3 {
+		t.Errorf("unexpected response %v %+v", rr.Header(), result)
+	}
+
+	gz, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+
+	var names []string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+	if strings.Join(names, ",") != "docs/Übersicht.txt,escape.txt,docs/Übersicht (2).txt" {
+		t.Errorf("unexpected entries %v", names)
+	}
+}
+
+// failingReader returns some data and then an error, like a file on a failing disk
+type failingReader struct {
+	data []byte
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if len(fr.data) == 0 {
+		return 0, errors.New("read failed")
+	}
+	n := copy(p, fr.data)
+	fr.data = fr.data[n:]
+	return n, nil
+}
+
+// TestBundle_ShortFiles tests that files cut short while they are read keep the archive valid
+func TestBundle_ShortFiles(t *testing.T) {
+	setupTestDir(t, "./testdata/bundle/")
+	defer cleanupTestDir(t, "./testdata/bundle/")
+
+	path := filepath.Join("./testdata/bundle/", "shrinking.bin")
+	os.WriteFile(path, bytes.Repeat([]byte("x"), 100), 0644)
+	info, _ := os.Stat(path)
+
+	var buf bytes.Buffer
+	archive := newTarGzBundle(&buf)
+
+	// The file shrank to 40 bytes after its size was taken
+	source := &bundleSource{r: &failingReader{data: bytes.Repeat([]byte("x"), 40)}}
+	written, err := archive.add("shrinking.bin", info, time.Now(), source)
+	if err != nil || written != 40 || source.err == nil {
+		t.Fatalf("expected 40 bytes and a read error, got %d %v %v", written, err, source.err)
+	}
+	archive.add("next.bin", info, time.Now(), bytes.NewReader(bytes.Repeat([]byte("y"), 100)))
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	gz, _ := gzip.NewReader(&buf)
+	tr := tar.NewReader(gz)
+	for _, expected := range []string{"shrinking.bin", "next.bin"} {
+		header, err := tr.Next()
+		if err != nil || header.Name != expected {
+			t.Fatalf("expected entry %s, got %v", expected, err)
+		}
+		content, _ := io.ReadAll(tr)
+		if len(content) != 100 {
+			t.Errorf("entry %s should be padded to 100 bytes, got %d", expected, len(content))
+		}
+	}
+}
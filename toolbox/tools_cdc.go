@@ -0,0 +1,343 @@
+package toolbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Default sizes for content-defined chunking
+const (
+	defaultContentChunkMinSize = 256 * 1024
+	defaultContentChunkAvgSize = 1024 * 1024
+	defaultContentChunkMaxSize = 4 * 1024 * 1024
+	defaultContentChunkTTL     = 7 * 24 * time.Hour
+
+	// maxManifestChunks caps the chunks of a manifest; at the default average size it allows files
+	// of 64GB
+	maxManifestChunks = 64 * 1024
+)
+
+// ErrMissingChunks is returned when a manifest refers to content chunks the server does not have
+var ErrMissingChunks = errors.New("missing content chunks")
+
+// contentHashPattern matches the hex encoded SHA-256 digest that identifies a content chunk
+var contentHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// gearTable maps every byte to a pseudo random value for the rolling hash. It is generated from a
+// fixed seed so every client and server finds the same chunk boundaries.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// ContentChunkOptions sets the chunk sizes for content-defined chunking. Chunks are cut where the
+// content matches a pattern that occurs on average every AvgSize bytes, but never before MinSize
+// or after MaxSize bytes. AvgSize is rounded down to a power of two.
+type ContentChunkOptions struct {
+	MinSize int
+	AvgSize int
+	MaxSize int
+}
+
+// ContentChunker splits a stream into chunks at boundaries chosen by a rolling hash of the content,
+// so an insertion or deletion in a file only changes the chunks around it
+type ContentChunker struct {
+	r     io.Reader
+	opts  ContentChunkOptions
+	mask  uint64
+	buf   []byte
+	start int
+	end   int
+	err   error
+}
+
+// NewContentChunker returns a chunker that reads from r
+func NewContentChunker(r io.Reader, opts ...ContentChunkOptions) *ContentChunker {
+	options := ContentChunkOptions{
+		MinSize: defaultContentChunkMinSize,
+		AvgSize: defaultContentChunkAvgSize,
+		MaxSize: defaultContentChunkMaxSize,
+	}
+	if len(opts) > 0 {
+		if opts[0].MinSize > 0 {
+			options.MinSize = opts[0].MinSize
+		}
+		if opts[0].AvgSize > 0 {
+			options.AvgSize = opts[0].AvgSize
+		}
+		if opts[0].MaxSize > 0 {
+			options.MaxSize = opts[0].MaxSize
+		}
+	}
+	if options.MaxSize < options.MinSize {
+		options.MaxSize = options.MinSize
+	}
+
+	// Test the top bits of the hash; they depend on the last 64 bytes rather than the last few
+	maskBits := bits.Len(uint(options.AvgSize)) - 1
+	if maskBits < 1 {
+		maskBits = 1
+	}
+
+	return &ContentChunker{
+		r:    r,
+		opts: options,
+		mask: ((1 << maskBits) - 1) << (64 - maskBits),
+		buf:  make([]byte, 2*options.MaxSize),
+	}
+}
+
+// Next returns the next chunk, or io.EOF when the stream is exhausted. The returned slice is only
+// valid until the next call to Next.
+func (c *ContentChunker) Next() ([]byte, error) {
+	if c.end-c.start < c.opts.MaxSize && c.err == nil {
+		c.fill()
+	}
+
+	if c.end == c.start {
+		return nil, c.err
+	}
+	if c.err != nil && c.err != io.EOF {
+		return nil, c.err
+	}
+
+	cut := c.boundary(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+cut]
+	c.start += cut
+
+	return chunk, nil
+}
+
+// fill moves the unread data to the front of the buffer and reads until it is full or the reader fails
+func (c *ContentChunker) fill() {
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+
+	for c.end < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err != nil {
+			c.err = err
+			return
+		}
+	}
+}
+
+// boundary returns the length of the first chunk in data
+func (c *ContentChunker) boundary(data []byte) int {
+	if len(data) <= c.opts.MinSize {
+		return len(data)
+	}
+
+	limit := min(len(data), c.opts.MaxSize)
+
+	var hash uint64
+	for i := c.opts.MinSize; i < limit; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&c.mask == 0 {
+			return i + 1
+		}
+	}
+
+	return limit
+}
+
+// ContentHash returns the hash that identifies data in the content chunk store
+func ContentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ChunkManifest lists the content chunks that make up a file, in order
+type ChunkManifest struct {
+	FileName string          `json:"file_name"`
+	Chunks   []ManifestChunk `json:"chunks"`
+	Checksum *Checksum       `json:"checksum,omitempty"` // Checksum of the whole file
+}
+
+// ManifestChunk is one entry in a ChunkManifest
+type ManifestChunk struct {
+	Hash string `json:"hash"` // ContentHash of the chunk
+	Size int64  `json:"size"`
+}
+
+// contentChunkTTL returns how long an unused content chunk is kept
+func (t *Tools) contentChunkTTL() time.Duration {
+	if t.ContentChunkTTL > 0 {
+		return t.ContentChunkTTL
+	}
+	return defaultContentChunkTTL
+}
+
+// contentChunkPath returns where the content chunk with the given hash is stored
+func (t *Tools) contentChunkPath(hash string) (string, error) {
+	if !contentHashPattern.MatchString(hash) {
+		return "", &ErrorResponse{
+			Err:     ErrInvalidChecksum,
+			Message: fmt.Sprintf("invalid content hash %q", hash),
+		}
+	}
+
+	return filepath.Join(t.ChunksDirectory, ".cas", hash[:2], hash), nil
+}
+
+// MissingContentChunks returns the hashes the content chunk store does not have, in the order
+// given. Chunks that are present are marked as used so they outlive the upload that needs them.
+// The store is shared by all clients, see AssembleFromManifest.
+func (t *Tools) MissingContentChunks(hashes []string) ([]string, error) {
+	missing := []string{}
+	seen := make(map[string]bool, len(hashes))
+	now := time.Now()
+
+	for _, hash := range hashes {
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+
+		path, err := t.contentChunkPath(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := os.Chtimes(path, now, now); err != nil {
+			missing = append(missing, hash)
+		}
+	}
+
+	return missing, nil
+}
+
+// StoreContentChunk adds data to the content chunk store under hash, which must be its ContentHash
+func (t *Tools) StoreContentChunk(hash string, data []byte) error {
+	path, err := t.contentChunkPath(hash)
+	if err != nil {
+		return err
+	}
+
+	if ContentHash(data) != hash {
+		return &ChecksumError{Message: fmt.Sprintf("content chunk does not match hash %s", hash)}
+	}
+
+	if err := t.CreateDirIfNotExist(filepath.Dir(path)); err != nil {
+		return fileCreationError(err, "failed to create content chunk directory")
+	}
+
+	// Write to a temporary file and rename it, so a concurrent upload of the same chunk or a reader
+	// never sees a partial chunk
+	tempFile, err := os.CreateTemp(filepath.Dir(path), "temp_chunk_*")
+	if err != nil {
+		return fileCreationError(err, "failed to create content chunk")
+	}
+
+	_, err = tempFile.Write(data)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return fileCreationError(err, "failed to write content chunk")
+	}
+
+	return nil
+}
+
+// AssembleFromManifest builds a file in UploadPath from content chunks that are already in the
+// store. It fails with ErrMissingChunks if any chunk is missing, in which case the client should
+// ask MissingContentChunks again and upload the chunks it reports. The assembled file goes through
+// the same checks as any other upload and, like CompleteChunkedUpload, is stored under a random
+// name, so a manifest cannot replace a file already in UploadPath. Manifests whose chunks add up to
+// more than the largest size limit, or that have more than 65536 chunks, are rejected before
+// anything is written.
+//
+// The content chunk store is shared by all clients and not scoped to an owner: a client that knows
+// the hash of a chunk can learn that the server has it and use it in its own manifests. Don't use
+// content-defined chunking for files whose existence must stay private between users.
+func (t *Tools) AssembleFromManifest(manifest ChunkManifest) (*UploadedFile, error) {
+	fileName := filepath.Base(manifest.FileName)
+	if manifest.FileName == "" || fileName == "." || fileName == string(filepath.Separator) {
+		return nil, &ErrorResponse{
+			Err:     ErrNoFileUploaded,
+			Message: "manifest has no file name",
+		}
+	}
+
+	if manifest.Checksum != nil {
+		if err := manifest.Checksum.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(manifest.Chunks) > maxManifestChunks {
+		return nil, &ErrorResponse{
+			Err:     ErrFileSizeExceeded,
+			Message: fmt.Sprintf("manifest has %d chunks, more than the maximum of %d", len(manifest.Chunks), maxManifestChunks),
+		}
+	}
+
+	// The type of the file is not known until it is assembled, so only the largest limit of any
+	// type applies here; checkFileSize checks the limit of the actual type afterwards
+	t.InitDefaults()
+	sizeLimit := int64(t.largestFileSizeLimit())
+	var totalSize int64
+	for _, chunk := range manifest.Chunks {
+		if chunk.Size > sizeLimit-totalSize {
+			return nil, &ErrorResponse{
+				Err:     ErrFileSizeExceeded,
+				Message: fmt.Sprintf("file %s exceeds the maximum allowed size (%d bytes)", fileName, sizeLimit),
+			}
+		}
+		if chunk.Size > 0 {
+			totalSize += chunk.Size
+		}
+	}
+
+	var missing []string
+	chunkPaths := make([]string, 0, len(manifest.Chunks))
+	now := time.Now()
+
+	for _, chunk := range manifest.Chunks {
+		path, err := t.contentChunkPath(chunk.Hash)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || info.Size() != chunk.Size {
+			missing = append(missing, chunk.Hash)
+			continue
+		}
+
+		os.Chtimes(path, now, now)
+		chunkPaths = append(chunkPaths, path)
+	}
+
+	if len(missing) > 0 {
+		return nil, &ErrorResponse{
+			Err:     ErrMissingChunks,
+			Message: fmt.Sprintf("%d content chunks are missing", len(missing)),
+		}
+	}
+
+	return t.assembleFile("", fileName, chunkPaths, manifest.Checksum)
+}
@@ -0,0 +1,217 @@
+package toolbox
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+var testChunkOptions = ContentChunkOptions{MinSize: 512, AvgSize: 2048, MaxSize: 8192}
+
+// contentChunks splits data and returns the hashes of its chunks
+func contentChunks(t *testing.T, data []byte) ([]string, [][]byte) {
+	t.Helper()
+
+	var hashes []string
+	var chunks [][]byte
+	chunker := NewContentChunker(bytes.NewReader(data), testChunkOptions)
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return hashes, chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, ContentHash(chunk))
+		chunks = append(chunks, bytes.Clone(chunk))
+	}
+}
+
+// TestContentChunker tests that chunk boundaries follow the content
+func TestContentChunker(t *testing.T) {
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	hashes, chunks := contentChunks(t, data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("chunks do not add up to the input")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > testChunkOptions.MaxSize || (len(chunk) < testChunkOptions.MinSize && i != len(chunks)-1) {
+			t.Errorf("chunk %d has %d bytes, outside the configured bounds", i, len(chunk))
+		}
+	}
+
+	// Inserting bytes in the middle only changes the chunks around the insertion
+	edited := append(bytes.Clone(data[:100000]), append([]byte("inserted text"), data[100000:]...)...)
+	editedHashes, _ := contentChunks(t, edited)
+
+	known := make(map[string]bool)
+	for _, hash := range hashes {
+		known[hash] = true
+	}
+	changed := 0
+	for _, hash := range editedHashes {
+		if !known[hash] {
+			changed++
+		}
+	}
+	if changed == 0 || changed > 3 {
+		t.Errorf("expected 1 to 3 changed chunks out of %d, got %d", len(editedHashes), changed)
+	}
+
+	if _, err := NewContentChunker(bytes.NewReader(nil)).Next(); err != io.EOF {
+		t.Errorf("expected io.EOF for empty input, got %v", err)
+	}
+}
+
+// TestTools_AssembleFromManifest tests storing content chunks and assembling a file from them
+func TestTools_AssembleFromManifest(t *testing.T) {
+	setupTestDir(t, "./testdata/chunks/")
+	defer cleanupTestDir(t, "./testdata/chunks/")
+	setupTestDir(t, "./testdata/uploads/")
+	defer cleanupTestDir(t, "./testdata/uploads/")
+
+	tools := Tools{
+		ChunksDirectory:   "./testdata/chunks/",
+		UploadPath:        "./testdata/uploads/",
+		AllowUnknownTypes: true,
+	}
+
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+	hashes, chunks := contentChunks(t, data)
+
+	manifest := ChunkManifest{FileName: "dedup.bin"}
+	for i, hash := range hashes {
+		manifest.Chunks = append(manifest.Chunks, ManifestChunk{Hash: hash, Size: int64(len(chunks[i]))})
+	}
+	sum, _ := ComputeChecksum(ChecksumSHA256, data)
+	manifest.Checksum = &sum
+
+	missing, err := tools.MissingContentChunks(append(hashes, hashes[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != len(hashes) {
+		t.Fatalf("expected all %d chunks to be missing, got %d", len(hashes), len(missing))
+	}
+
+	if err := tools.StoreContentChunk(hashes[0], chunks[1]); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch for data that does not match its hash, got %v", err)
+	}
+	if err := tools.StoreContentChunk("../../escape", chunks[0]); err == nil {
+		t.Error("expected an error for an invalid hash")
+	}
+
+	// Store all but the last chunk
+	for i := range len(hashes) - 1 {
+		if err := tools.StoreContentChunk(hashes[i], chunks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := tools.AssembleFromManifest(manifest); !errors.Is(err, ErrMissingChunks) {
+		t.Fatalf("expected ErrMissingChunks, got %v", err)
+	}
+	if missing, _ := tools.MissingContentChunks(hashes); len(missing) != 1 || missing[0] != hashes[len(hashes)-1] {
+		t.Fatalf("expected only the last chunk to be missing, got %v", missing)
+	}
+
+	last := len(hashes) - 1
+	if err := tools.StoreContentChunk(hashes[last], chunks[last]); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := tools.AssembleFromManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := os.ReadFile(file.FilePath)
+	if !bytes.Equal(stored, data) {
+		t.Error("assembled file does not match the original")
+	}
+
+	// Assembling the manifest again stores a second file instead of replacing the first
+	again, err := tools.AssembleFromManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.NewFileName == file.NewFileName || again.OriginalFileName != "dedup.bin" {
+		t.Errorf("expected a new random name for dedup.bin, got %s and %s", file.NewFileName, again.NewFileName)
+	}
+	if stored, _ := os.ReadFile(file.FilePath); !bytes.Equal(stored, data) {
+		t.Error("first assembled file was replaced")
+	}
+
+	// Chunks stay in the store for the next upload, until they have not been used for ContentChunkTTL
+	tools.ContentChunkTTL = time.Hour
+	old := time.Now().Add(-2 * time.Hour)
+	ageTree(t, filepath.Join(tools.ChunksDirectory, ".cas"), old)
+	tools.MissingContentChunks(hashes[:1])
+
+	report, err := tools.PurgeExpiredUploads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.ContentChunks) != len(hashes)-1 {
+		t.Errorf("expected %d unused chunks to be purged, got %d", len(hashes)-1, len(report.ContentChunks))
+	}
+	if missing, _ := tools.MissingContentChunks(hashes[:1]); len(missing) != 0 {
+		t.Error("recently used chunk should be kept")
+	}
+}
+
+// TestTools_AssembleFromManifestLimits tests that manifests for files that are too large are
+// rejected before anything is read or written
+func TestTools_AssembleFromManifestLimits(t *testing.T) {
+	setupTestDir(t, "./testdata/chunks/")
+	defer cleanupTestDir(t, "./testdata/chunks/")
+	setupTestDir(t, "./testdata/uploads/")
+	defer cleanupTestDir(t, "./testdata/uploads/")
+
+	tools := Tools{
+		ChunksDirectory:        "./testdata/chunks/",
+		UploadPath:             "./testdata/uploads/",
+		AllowUnknownTypes:      true,
+		MaxFileSize:            1024,
+		TypeSpecificSizeLimits: map[string]int{"video/mp4": 4096},
+	}
+
+	data := []byte("a chunk that is in the store")
+	hash := ContentHash(data)
+	if err := tools.StoreContentChunk(hash, data); err != nil {
+		t.Fatal(err)
+	}
+	chunk := ManifestChunk{Hash: hash, Size: int64(len(data))}
+
+	tests := []struct {
+		name   string
+		chunks []ManifestChunk
+	}{
+		{name: "over every limit", chunks: []ManifestChunk{chunk, {Hash: hash, Size: 5000}}},
+		{name: "sizes that overflow", chunks: []ManifestChunk{{Hash: hash, Size: math.MaxInt64}, chunk}},
+		{name: "too many chunks", chunks: make([]ManifestChunk, maxManifestChunks+1)},
+		{name: "over the limit of the actual type", chunks: slices.Repeat([]ManifestChunk{chunk}, 40)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tools.AssembleFromManifest(ChunkManifest{FileName: "big.bin", Chunks: tc.chunks})
+			if !errors.Is(err, ErrFileSizeExceeded) {
+				t.Errorf("expected ErrFileSizeExceeded, got %v", err)
+			}
+			if files := storedFiles(t, tools.UploadPath); len(files) > 0 {
+				t.Errorf("no file should be written, found %v", files)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package toolbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// Supported checksum algorithms for chunked uploads
+const (
+	ChecksumSHA256 = "sha256"
+	ChecksumCRC32C = "crc32c"
+)
+
+// Checksum is a hex encoded digest together with the algorithm used to compute it
+type Checksum struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"value"`
+}
+
+// ChecksumError is returned when chunk data does not match the checksum declared by the client.
+// Chunks lists the chunk numbers that must be uploaded again; it is empty when only the
+// whole-file checksum failed.
+type ChecksumError struct {
+	UploadID string
+	Chunks   []int64
+	Message  string
+}
+
+// Error implements the error interface
+func (ce *ChecksumError) Error() string {
+	return ce.Message
+}
+
+// Unwrap returns ErrChecksumMismatch so callers can use errors.Is
+func (ce *ChecksumError) Unwrap() error {
+	return ErrChecksumMismatch
+}
+
+// ComputeChecksum calculates the checksum of data using the given algorithm
+func ComputeChecksum(algorithm string, data []byte) (Checksum, error) {
+	h, err := newChecksumHash(algorithm)
+	if err != nil {
+		return Checksum{}, err
+	}
+	h.Write(data)
+
+	return Checksum{Algorithm: strings.ToLower(algorithm), Value: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// ComputeChecksumReader calculates the checksum of everything read from r using the given algorithm
+func ComputeChecksumReader(algorithm string, r io.Reader) (Checksum, error) {
+	h, err := newChecksumHash(algorithm)
+	if err != nil {
+		return Checksum{}, err
+	}
+
+	if _, err := io.Copy(h, r); err != nil {
+		return Checksum{}, err
+	}
+
+	return Checksum{Algorithm: strings.ToLower(algorithm), Value: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// newChecksumHash returns a hash for the named algorithm
+func newChecksumHash(algorithm string) (hash.Hash, error) {
+	switch strings.ToLower(algorithm) {
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	default:
+		return nil, &ErrorResponse{
+			Err:     ErrInvalidChecksum,
+			Message: fmt.Sprintf("unsupported checksum algorithm %q", algorithm),
+		}
+	}
+}
+
+// validate makes sure the algorithm is supported and the value is well formed hex
+func (c Checksum) validate() error {
+	if _, err := newChecksumHash(c.Algorithm); err != nil {
+		return err
+	}
+
+	if _, err := hex.DecodeString(c.Value); err != nil || c.Value == "" {
+		return &ErrorResponse{
+			Err:     ErrInvalidChecksum,
+			Message: fmt.Sprintf("invalid %s checksum value %q", c.Algorithm, c.Value),
+		}
+	}
+
+	return nil
+}
+
+// matches reports whether sum, the raw output of the checksum's hash, equals the declared value
+func (c Checksum) matches(sum []byte) bool {
+	return strings.EqualFold(c.Value, hex.EncodeToString(sum))
+}
+
+// verifyFileChecksum streams the file at path through the checksum's hash and reports whether it matches
+func verifyFileChecksum(path string, checksum Checksum) (bool, error) {
+	h, err := newChecksumHash(checksum.Algorithm)
+	if err != nil {
+		return false, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+
+	return checksum.matches(h.Sum(nil)), nil
+}
+
+// chunkChecksumPath returns the path of the file holding the declared checksum of a stored chunk
+func chunkChecksumPath(chunkPath string) string {
+	return chunkPath + ".checksum"
+}
+
+// readChunkChecksum loads the checksum recorded for a stored chunk. It returns nil if the
+// client did not send one.
+func readChunkChecksum(chunkPath string) (*Checksum, error) {
+	data, err := os.ReadFile(chunkChecksumPath(chunkPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var checksum Checksum
+	if err := json.Unmarshal(data, &checksum); err != nil {
+		return nil, err
+	}
+
+	return &checksum, nil
+}
+
+// writeChunkChecksum records the declared checksum of a stored chunk
+func writeChunkChecksum(chunkPath string, checksum Checksum) error {
+	data, err := json.Marshal(checksum)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(chunkChecksumPath(chunkPath), data, 0644)
+}
@@ -0,0 +1,170 @@
+package toolbox
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestTools_ChunkChecksums tests per-chunk and whole-file checksum verification
+func TestTools_ChunkChecksums(t *testing.T) {
+	setupTestDir(t, "./testdata/uploads/")
+	defer cleanupTestDir(t, "./testdata/uploads/")
+	setupTestDir(t, "./testdata/chunks/")
+	defer cleanupTestDir(t, "./testdata/chunks/")
+
+	chunks := [][]byte{[]byte("first chunk "), []byte("second chunk "), []byte("third chunk")}
+	var whole []byte
+	for _, c := range chunks {
+		whole = append(whole, c...)
+	}
+
+	tests := []struct {
+		name          string
+		algorithm     string
+		fileChecksum  string // overrides the computed whole-file checksum when set
+		corruptChunk  int64  // chunk to corrupt on disk after upload, -1 for none
+		errorExpected bool
+		corruptChunks []int64
+	}{
+		{name: "sha256 valid", algorithm: ChecksumSHA256, corruptChunk: -1},
+		{name: "crc32c valid", algorithm: ChecksumCRC32C, corruptChunk: -1},
+		{name: "whole file mismatch", algorithm: ChecksumSHA256, fileChecksum: "00000000", corruptChunk: -1, errorExpected: true},
+		{name: "chunk corrupted on disk", algorithm: ChecksumSHA256, corruptChunk: 1, errorExpected: true, corruptChunks: []int64{1}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tools := Tools{
+				ChunksDirectory: "./testdata/chunks/",
+				UploadPath:      "./testdata/uploads/",
+			}
+			uploadID := tools.RandomString(20)
+
+			fileChecksum, err := ComputeChecksum(tc.algorithm, whole)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.fileChecksum != "" {
+				fileChecksum.Value = tc.fileChecksum
+			}
+
+			err = tools.InitChunkedUpload(uploadID, "file.txt", int64(len(chunks)), ChunkedUploadOptions{Checksum: &fileChecksum})
+			if err != nil {
+				t.Fatalf("failed to init upload: %v", err)
+			}
+
+			for i, c := range chunks {
+				sum, _ := ComputeChecksum(tc.algorithm, c)
+				if err := tools.UploadChunk(uploadID, "file.txt", int64(i), int64(len(chunks)), c, sum); err != nil {
+					t.Fatalf("failed to upload chunk %d: %v", i, err)
+				}
+			}
+
+			if tc.corruptChunk >= 0 {
+				chunkPath := filepath.Join(tools.ChunksDirectory, uploadID, "1")
+				if err := os.WriteFile(chunkPath, []byte("tampered"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			file, err := tools.CompleteChunkedUpload(uploadID, "file.txt")
+			if err == nil && tc.errorExpected {
+				t.Fatal("expected error but got none")
+			}
+			if err != nil && !tc.errorExpected {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+
+			if err != nil {
+				if !errors.Is(err, ErrChecksumMismatch) {
+					t.Errorf("expected ErrChecksumMismatch, got %v", err)
+				}
+
+				var checksumErr *ChecksumError
+				if !errors.As(err, &checksumErr) {
+					t.Fatalf("expected *ChecksumError, got %T", err)
+				}
+				if len(checksumErr.Chunks) != len(tc.corruptChunks) {
+					t.Errorf("expected corrupt chunks %v, got %v", tc.corruptChunks, checksumErr.Chunks)
+				}
+
+				if files := storedFiles(t, tools.UploadPath); len(files) > 0 {
+					t.Errorf("assembled file should have been removed, found %v", files)
+				}
+				return
+			}
+
+			data, err := os.ReadFile(filepath.Join(tools.UploadPath, file.NewFileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != string(whole) {
+				t.Errorf("assembled file does not match: %q", data)
+			}
+			os.Remove(filepath.Join(tools.UploadPath, file.NewFileName))
+		})
+	}
+}
+
+// TestTools_UploadChunkRejectsBadChecksum tests that a corrupt chunk is not stored
+func TestTools_UploadChunkRejectsBadChecksum(t *testing.T) {
+	setupTestDir(t, "./testdata/chunks/")
+	defer cleanupTestDir(t, "./testdata/chunks/")
+
+	tools := Tools{ChunksDirectory: "./testdata/chunks/"}
+	uploadID := tools.RandomString(20)
+
+	sum, _ := ComputeChecksum(ChecksumSHA256, []byte("expected data"))
+	err := tools.UploadChunk(uploadID, "file.txt", 2, 3, []byte("corrupted data"), sum)
+
+	var checksumErr *ChecksumError
+	if !errors.As(err, &checksumErr) {
+		t.Fatalf("expected *ChecksumError, got %v", err)
+	}
+	if len(checksumErr.Chunks) != 1 || checksumErr.Chunks[0] != 2 {
+		t.Errorf("expected chunk 2 to be reported, got %v", checksumErr.Chunks)
+	}
+
+	if _, err := os.Stat(filepath.Join(tools.ChunksDirectory, uploadID, "2")); !os.IsNotExist(err) {
+		t.Error("corrupt chunk should not have been stored")
+	}
+
+	// Bad checksums are a bad request, not a corrupt chunk
+	for _, sum := range []Checksum{{Algorithm: "md4", Value: "00"}, {Algorithm: ChecksumSHA256, Value: "not hex"}} {
+		err = tools.UploadChunk(uploadID, "file.txt", 0, 3, []byte("data"), sum)
+		if !errors.Is(err, ErrInvalidChecksum) || errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("expected ErrInvalidChecksum for %+v, got %v", sum, err)
+		}
+	}
+}
+
+// TestTools_CompleteChunkedUploadUnreadableChecksum tests that a chunk whose checksum cannot be read
+// is not taken as verified
+func TestTools_CompleteChunkedUploadUnreadableChecksum(t *testing.T) {
+	setupTestDir(t, "./testdata/uploads/")
+	defer cleanupTestDir(t, "./testdata/uploads/")
+	setupTestDir(t, "./testdata/chunks/")
+	defer cleanupTestDir(t, "./testdata/chunks/")
+
+	tools := Tools{ChunksDirectory: "./testdata/chunks/", UploadPath: "./testdata/uploads/"}
+	uploadID := tools.RandomString(20)
+
+	sum, _ := ComputeChecksum(ChecksumSHA256, []byte("chunk"))
+	if err := tools.UploadChunk(uploadID, "file.txt", 0, 1, []byte("chunk"), sum); err != nil {
+		t.Fatal(err)
+	}
+
+	checksumPath := chunkChecksumPath(filepath.Join(tools.ChunksDirectory, uploadID, "0"))
+	if err := os.WriteFile(checksumPath, []byte("{broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tools.CompleteChunkedUpload(uploadID, "file.txt"); err == nil {
+		t.Fatal("expected an error for an unreadable checksum")
+	}
+	if files := storedFiles(t, tools.UploadPath); len(files) > 0 {
+		t.Errorf("no file should be created, found %v", files)
+	}
+}
@@ -0,0 +1,277 @@
+package toolbox
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// uploadTestChunks splits data into chunkSize pieces and uploads them with UploadChunk
+func uploadTestChunks(t *testing.T, tools *Tools, uploadID, fileName string, data []byte, chunkSize int) int64 {
+	t.Helper()
+
+	totalChunks := int64((len(data) + chunkSize - 1) / chunkSize)
+	for i := int64(0); i < totalChunks; i++ {
+		end := int(i+1) * chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		if err := tools.UploadChunk(uploadID, fileName, i, totalChunks, data[int(i)*chunkSize:end]); err != nil {
+			t.Fatalf("failed to upload chunk %d: %v", i, err)
+		}
+	}
+
+	return totalChunks
+}
+
+// storedFiles returns the names of the files in dir
+func storedFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+// TestTools_ConcurrentCompleteChunkedUpload tests that racing completions assemble the file once
+func TestTools_ConcurrentCompleteChunkedUpload(t *testing.T) {
+	setupTestDir(t, "./testdata/uploads/")
+	defer cleanupTestDir(t, "./testdata/uploads/")
+	setupTestDir(t, "./testdata/chunks/")
+	defer cleanupTestDir(t, "./testdata/chunks/")
+
+	tools := Tools{
+		ChunksDirectory: "./testdata/chunks/",
+		UploadPath:      "./testdata/uploads/",
+	}
+	uploadID := tools.RandomString(20)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024) // 1MB
+	uploadTestChunks(t, &tools, uploadID, "concurrent.bin", data, 100*1024)
+
+	var wg sync.WaitGroup
+	results := make([]*UploadedFile, 8)
+	errs := make([]error, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = tools.CompleteChunkedUpload(uploadID, "concurrent.bin")
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	var file *UploadedFile
+	for i := range results {
+		if errs[i] == nil {
+			succeeded++
+			file = results[i]
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("expected exactly one completion to succeed, got %d", succeeded)
+	}
+
+	assembled, err := os.ReadFile(filepath.Join(tools.UploadPath, file.NewFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(assembled, data) {
+		t.Error("assembled file does not match the uploaded data")
+	}
+
+	if _, err := os.Stat(filepath.Join(tools.ChunksDirectory, uploadID)); !os.IsNotExist(err) {
+		t.Error("chunks directory should be removed after completion")
+	}
+
+	entries, _ := os.ReadDir(tools.UploadPath)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "temp_") {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+}
+
+// TestTools_CompleteChunkedUploadMissingChunk tests that a failed assembly keeps the chunks
+func TestTools_CompleteChunkedUploadMissingChunk(t *testing.T) {
+	setupTestDir(t, "./testdata/uploads/")
+	defer cleanupTestDir(t, "./testdata/uploads/")
+	setupTestDir(t, "./testdata/chunks/")
+	defer cleanupTestDir(t, "./testdata/chunks/")
+
+	tools := Tools{
+		ChunksDirectory: "./testdata/chunks/",
+		UploadPath:      "./testdata/uploads/",
+	}
+	uploadID := tools.RandomString(20)
+
+	if err := tools.UploadChunk(uploadID, "partial.bin", 0, 3, []byte("chunk zero")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tools.UploadChunk(uploadID, "partial.bin", 2, 3, []byte("chunk two")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tools.CompleteChunkedUpload(uploadID, "partial.bin"); err == nil {
+		t.Fatal("expected error for missing chunk")
+	}
+
+	if files := storedFiles(t, tools.UploadPath); len(files) > 0 {
+		t.Errorf("no file should be created when assembly fails, found %v", files)
+	}
+
+	for _, chunk := range []string{"0", "2"} {
+		if _, err := os.Stat(filepath.Join(tools.ChunksDirectory, uploadID, chunk)); err != nil {
+			t.Errorf("chunk %s should be kept after a failed assembly: %v", chunk, err)
+		}
+	}
+}
+
+// TestTools_CompleteChunkedUploadValidation tests that completed uploads go through the upload policy
+func TestTools_CompleteChunkedUploadValidation(t *testing.T) {
+	setupTestDir(t, "./testdata/uploads/")
+	defer cleanupTestDir(t, "./testdata/uploads/")
+	setupTestDir(t, "./testdata/chunks/")
+	defer cleanupTestDir(t, "./testdata/chunks/")
+
+	text := bytes.Repeat([]byte("plain text content "), 100)
+
+	tests := []struct {
+		name          string
+		tools         Tools
+		expectedError error
+		expectedType  string
+	}{
+		{
+			name:         "allowed type",
+			tools:        Tools{AllowedFileTypes: []string{"text/plain"}},
+			expectedType: "text/plain; charset=utf-8",
+		},
+		{
+			name:          "type not allowed",
+			tools:         Tools{AllowedFileTypes: []string{"image/png"}},
+			expectedError: ErrInvalidFileType,
+		},
+		{
+			name:          "exceeds type limit",
+			tools:         Tools{MaxFileSize: 10 * 1024, TypeSpecificSizeLimits: map[string]int{"text/plain; charset=utf-8": 100}},
+			expectedError: ErrFileSizeExceeded,
+		},
+		{
+			name:          "zero type limit",
+			tools:         Tools{TypeSpecificSizeLimits: map[string]int{"text/plain; charset=utf-8": 0}},
+			expectedError: ErrFileSizeExceeded,
+		},
+		{
+			name:          "exceeds global limit",
+			tools:         Tools{MaxFileSize: 100},
+			expectedError: ErrFileSizeExceeded,
+		},
+		{
+			name: "rejected by callback",
+			tools: Tools{ValidationCallback: func(file *UploadedFile) error {
+				return ErrContentVerification
+			}},
+			expectedError: ErrContentVerification,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tools := tc.tools
+			tools.ChunksDirectory = "./testdata/chunks/"
+			tools.UploadPath = "./testdata/uploads/"
+			uploadID := tools.RandomString(20)
+
+			uploadTestChunks(t, &tools, uploadID, "notes.txt", text, 512)
+
+			file, err := tools.CompleteChunkedUpload(uploadID, "notes.txt")
+
+			if tc.expectedError != nil {
+				if !errors.Is(err, tc.expectedError) {
+					t.Fatalf("expected %v, got %v", tc.expectedError, err)
+				}
+				if files := storedFiles(t, tools.UploadPath); len(files) > 0 {
+					t.Errorf("rejected file should be deleted, found %v", files)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			if file.FileType != tc.expectedType {
+				t.Errorf("expected type %s, got %s", tc.expectedType, file.FileType)
+			}
+			os.Remove(file.FilePath)
+		})
+	}
+}
+
+// TestTools_CompleteChunkedUploadNoOverwrite tests that completed uploads never replace stored files
+func TestTools_CompleteChunkedUploadNoOverwrite(t *testing.T) {
+	setupTestDir(t, "./testdata/uploads/")
+	defer cleanupTestDir(t, "./testdata/uploads/")
+	setupTestDir(t, "./testdata/chunks/")
+	defer cleanupTestDir(t, "./testdata/chunks/")
+
+	tools := Tools{
+		ChunksDirectory: "./testdata/chunks/",
+		UploadPath:      "./testdata/uploads/",
+	}
+
+	existing := filepath.Join(tools.UploadPath, "report.txt")
+	if err := os.WriteFile(existing, []byte("someone else's report"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, content := range []string{"first upload", "second upload"} {
+		uploadID := tools.RandomString(20)
+		uploadTestChunks(t, &tools, uploadID, "report.txt", []byte(content), 4)
+
+		file, err := tools.CompleteChunkedUpload(uploadID, "report.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file.OriginalFileName != "report.txt" {
+			t.Errorf("expected original name report.txt, got %s", file.OriginalFileName)
+		}
+		if file.NewFileName == "report.txt" || filepath.Ext(file.NewFileName) != ".txt" {
+			t.Errorf("expected a random .txt name, got %s", file.NewFileName)
+		}
+
+		data, err := os.ReadFile(file.FilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("expected %q, got %q", content, data)
+		}
+		names = append(names, file.NewFileName)
+	}
+
+	if names[0] == names[1] {
+		t.Errorf("uploads with the same name were stored as %s", names[0])
+	}
+
+	data, err := os.ReadFile(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "someone else's report" {
+		t.Errorf("existing file was overwritten with %q", data)
+	}
+}
@@ -0,0 +1,354 @@
+package toolbox
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const defaultChunkSize = 5 * 1024 * 1024 // 5MB default
+
+// ChunkChecksumHeader carries the checksum of a chunk sent to ChunkUploadHandler, formatted as
+// algorithm=hex, e.g. "sha256=9f86d0...".
+const ChunkChecksumHeader = "X-Chunk-Checksum"
+
+// ChunkUploadRequest is the body sent to ChunkUploadHandler to start an upload
+type ChunkUploadRequest struct {
+	UploadID    string            `json:"upload_id,omitempty"`  // Generated by the server if empty
+	FileName    string            `json:"file_name"`            // Name of the file being uploaded
+	Size        int64             `json:"size"`                 // Total size of the file in bytes
+	ChunkSize   int64             `json:"chunk_size,omitempty"` // Requested chunk size, capped by Tools.ChunkSize
+	ContentType string            `json:"content_type,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Checksum    *Checksum         `json:"checksum,omitempty"` // Checksum of the whole file
+}
+
+// ChunkUploadStatus describes a chunked upload, including which chunks the server already has so
+// a client can resume by sending only the missing ones
+type ChunkUploadStatus struct {
+	UploadID       string        `json:"upload_id"`
+	FileName       string        `json:"file_name"`
+	State          UploadState   `json:"state"`
+	Size           int64         `json:"size"`
+	ChunkSize      int64         `json:"chunk_size"`
+	TotalChunks    int64         `json:"total_chunks"`
+	ReceivedBytes  int64         `json:"received_bytes"`
+	ReceivedChunks []int64       `json:"received_chunks"`
+	Result         *UploadedFile `json:"result,omitempty"`
+}
+
+// chunkSize returns the largest chunk accepted by ChunkUploadHandler
+func (t *Tools) chunkSize() int64 {
+	if t.ChunkSize > 0 {
+		return t.ChunkSize
+	}
+	return defaultChunkSize
+}
+
+// GetChunkUploadStatus returns the state of a chunked upload and the chunks received so far
+func (t *Tools) GetChunkUploadStatus(uploadID string) (*ChunkUploadStatus, error) {
+	session, err := t.GetUploadSession(uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	received, err := t.receivedChunks(uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &ChunkUploadStatus{
+		UploadID:       session.ID,
+		FileName:       session.FileName,
+		State:          session.State,
+		Size:           session.DeclaredSize,
+		ChunkSize:      session.ChunkSize,
+		TotalChunks:    session.TotalChunks,
+		ReceivedBytes:  session.ReceivedBytes,
+		ReceivedChunks: received,
+	}
+
+	if session.Result != nil {
+		status.Result = withoutPath(session.Result)
+	}
+
+	return status, nil
+}
+
+// ChunkUploadHandler returns an http.Handler that exposes chunked uploads over HTTP. Mount it with
+// http.StripPrefix; the routes are relative to the mount point:
+//
+//	POST   /                  start an upload (ChunkUploadRequest), responds with ChunkUploadStatus
+//	GET    /{id}              ChunkUploadStatus of an upload
+//	PUT    /{id}/chunks/{n}   store chunk n, the raw bytes are the request body
+//	POST   /{id}/complete     assemble the upload, responds with the UploadedFile
+//	DELETE /{id}              cancel the upload
+//
+// Content-defined chunks are addressed by their ContentHash instead:
+//
+//	POST   /cas/missing       {"hashes": [...]}, responds with the hashes the server does not have
+//	PUT    /cas/{hash}        store a content chunk, the raw bytes are the request body
+//	POST   /cas/assemble      assemble a file from a ChunkManifest, responds with the UploadedFile
+//
+// Responses use the JSONResponse envelope. A chunk may carry its checksum in the X-Chunk-Checksum
+// header; failed checksum verification is reported with status 422 and the chunk numbers to resend
+// in the data field as {"chunks": [...]}.
+func (t *Tools) ChunkUploadHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /{$}", t.handleChunkUploadInit)
+	mux.HandleFunc("GET /{id}", t.handleChunkUploadStatus)
+	mux.HandleFunc("PUT /{id}/chunks/{n}", t.handleChunkUploadChunk)
+	mux.HandleFunc("POST /{id}/complete", t.handleChunkUploadComplete)
+	mux.HandleFunc("DELETE /{id}", t.handleChunkUploadCancel)
+	mux.HandleFunc("POST /cas/missing", t.handleContentChunksMissing)
+	mux.HandleFunc("PUT /cas/{hash}", t.handleContentChunkUpload)
+	mux.HandleFunc("POST /cas/assemble", t.handleContentChunksAssemble)
+	return mux
+}
+
+// handleChunkUploadInit starts a new upload
+func (t *Tools) handleChunkUploadInit(w http.ResponseWriter, r *http.Request) {
+	var req ChunkUploadRequest
+	if err := t.ReadJSON(w, r, &req); err != nil {
+		t.ErrorJSON(w, err)
+		return
+	}
+
+	fileName := filepath.Base(req.FileName)
+	if req.FileName == "" || fileName == "." || fileName == string(filepath.Separator) {
+		t.ErrorJSON(w, errors.New("file_name is required"))
+		return
+	}
+
+	if req.Size < 0 {
+		t.ErrorJSON(w, errors.New("size must not be negative"))
+		return
+	}
+
+	chunkSize := t.chunkSize()
+	if req.ChunkSize > 0 && req.ChunkSize < chunkSize {
+		chunkSize = req.ChunkSize
+	}
+
+	totalChunks := (req.Size + chunkSize - 1) / chunkSize
+	if totalChunks == 0 {
+		totalChunks = 1 // An empty file is sent as one empty chunk
+	}
+
+	uploadID := req.UploadID
+	if uploadID == "" {
+		uploadID = t.RandomString(25)
+	}
+
+	err := t.InitChunkedUpload(uploadID, fileName, totalChunks, ChunkedUploadOptions{
+		DeclaredSize: req.Size,
+		ContentType:  req.ContentType,
+		Metadata:     req.Metadata,
+		ChunkSize:    chunkSize,
+		Checksum:     req.Checksum,
+	})
+	if err != nil {
+		t.chunkUploadError(w, err)
+		return
+	}
+
+	status, err := t.GetChunkUploadStatus(uploadID)
+	if err != nil {
+		t.chunkUploadError(w, err)
+		return
+	}
+
+	t.WriteJSON(w, http.StatusCreated, JSONResponse{Message: "upload started", Data: status})
+}
+
+// handleChunkUploadStatus reports which chunks of an upload have been received
+func (t *Tools) handleChunkUploadStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := t.GetChunkUploadStatus(r.PathValue("id"))
+	if err != nil {
+		t.chunkUploadError(w, err)
+		return
+	}
+
+	t.WriteJSON(w, http.StatusOK, JSONResponse{Message: string(status.State), Data: status})
+}
+
+// handleChunkUploadChunk stores one chunk
+func (t *Tools) handleChunkUploadChunk(w http.ResponseWriter, r *http.Request) {
+	uploadID := r.PathValue("id")
+
+	chunkNumber, err := strconv.ParseInt(r.PathValue("n"), 10, 64)
+	if err != nil {
+		t.chunkUploadError(w, &ErrorResponse{
+			Err:     ErrInvalidChunkNumber,
+			Message: fmt.Sprintf("invalid chunk number %q", r.PathValue("n")),
+		})
+		return
+	}
+
+	session, err := t.GetUploadSession(uploadID)
+	if err != nil {
+		t.chunkUploadError(w, err)
+		return
+	}
+
+	chunkSize := session.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = t.chunkSize()
+	}
+
+	var checksums []Checksum
+	if header := r.Header.Get(ChunkChecksumHeader); header != "" {
+		algorithm, value, ok := strings.Cut(header, "=")
+		if !ok {
+			t.ErrorJSON(w, fmt.Errorf("malformed %s header", ChunkChecksumHeader))
+			return
+		}
+		checksums = append(checksums, Checksum{Algorithm: algorithm, Value: value})
+	}
+
+	t.throttleRequest(r)
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, chunkSize))
+	if err != nil {
+		t.ErrorJSON(w, fmt.Errorf("chunk exceeds the chunk size of %d bytes", chunkSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Every chunk but the last must be exactly one chunk size long, or the file would be assembled wrong
+	if session.DeclaredSize >= 0 && session.ChunkSize > 0 && chunkNumber >= 0 && chunkNumber < session.TotalChunks {
+		expected := session.ChunkSize
+		if remaining := session.DeclaredSize - chunkNumber*session.ChunkSize; remaining < expected {
+			expected = remaining
+		}
+		if int64(len(data)) != expected {
+			t.ErrorJSON(w, fmt.Errorf("chunk %d must be %d bytes, got %d", chunkNumber, expected, len(data)))
+			return
+		}
+	}
+
+	if err := t.UploadChunk(uploadID, session.FileName, chunkNumber, session.TotalChunks, data, checksums...); err != nil {
+		t.chunkUploadError(w, err)
+		return
+	}
+
+	t.WriteJSON(w, http.StatusOK, JSONResponse{Message: fmt.Sprintf("chunk %d received", chunkNumber)})
+}
+
+// handleChunkUploadComplete assembles an upload
+func (t *Tools) handleChunkUploadComplete(w http.ResponseWriter, r *http.Request) {
+	session, err := t.GetUploadSession(r.PathValue("id"))
+	if err != nil {
+		t.chunkUploadError(w, err)
+		return
+	}
+
+	uploadedFile, err := t.CompleteChunkedUpload(session.ID, session.FileName)
+	if err != nil {
+		t.chunkUploadError(w, err)
+		return
+	}
+
+	t.WriteJSON(w, http.StatusOK, JSONResponse{Message: "upload completed", Data: withoutPath(uploadedFile)})
+}
+
+// handleChunkUploadCancel cancels an upload
+func (t *Tools) handleChunkUploadCancel(w http.ResponseWriter, r *http.Request) {
+	if err := t.CancelChunkedUpload(r.PathValue("id")); err != nil {
+		t.chunkUploadError(w, err)
+		return
+	}
+
+	t.WriteJSON(w, http.StatusOK, JSONResponse{Message: "upload cancelled"})
+}
+
+// ContentChunksRequest is the body sent to ChunkUploadHandler to find out which content chunks
+// have to be uploaded
+type ContentChunksRequest struct {
+	Hashes []string `json:"hashes"`
+}
+
+// handleContentChunksMissing reports which of the given content chunks the server does not have
+func (t *Tools) handleContentChunksMissing(w http.ResponseWriter, r *http.Request) {
+	var req ContentChunksRequest
+	if err := t.ReadJSON(w, r, &req); err != nil {
+		t.ErrorJSON(w, err)
+		return
+	}
+
+	missing, err := t.MissingContentChunks(req.Hashes)
+	if err != nil {
+		t.chunkUploadError(w, err)
+		return
+	}
+
+	t.WriteJSON(w, http.StatusOK, JSONResponse{
+		Message: fmt.Sprintf("%d of %d chunks missing", len(missing), len(req.Hashes)),
+		Data:    ContentChunksRequest{Hashes: missing},
+	})
+}
+
+// handleContentChunkUpload stores one content chunk
+func (t *Tools) handleContentChunkUpload(w http.ResponseWriter, r *http.Request) {
+	t.throttleRequest(r)
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, t.chunkSize()))
+	if err != nil {
+		t.ErrorJSON(w, fmt.Errorf("chunk exceeds the chunk size of %d bytes", t.chunkSize()), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err := t.StoreContentChunk(r.PathValue("hash"), data); err != nil {
+		t.chunkUploadError(w, err)
+		return
+	}
+
+	t.WriteJSON(w, http.StatusOK, JSONResponse{Message: "chunk stored"})
+}
+
+// handleContentChunksAssemble assembles a file from stored content chunks
+func (t *Tools) handleContentChunksAssemble(w http.ResponseWriter, r *http.Request) {
+	var manifest ChunkManifest
+	if err := t.ReadJSON(w, r, &manifest); err != nil {
+		t.ErrorJSON(w, err)
+		return
+	}
+
+	uploadedFile, err := t.AssembleFromManifest(manifest)
+	if err != nil {
+		t.chunkUploadError(w, err)
+		return
+	}
+
+	t.WriteJSON(w, http.StatusOK, JSONResponse{Message: "upload completed", Data: withoutPath(uploadedFile)})
+}
+
+// withoutPath returns a copy of file that does not reveal where it is stored on the server
+func withoutPath(file *UploadedFile) *UploadedFile {
+	result := *file
+	result.FilePath = ""
+	return &result
+}
+
+// chunkUploadError sends err with the status of its cause in the ErrorCatalog of t. Errors the
+// catalog does not know, e.g. of the session store, are logged and reported as server errors
+// without their message, which may name paths on the server. The cause of server errors is logged.
+func (t *Tools) chunkUploadError(w http.ResponseWriter, err error) {
+	code, ok := t.errorCatalog().Lookup(err)
+	if !ok {
+		t.logger().Error("chunked upload failed", "error", err)
+		t.ErrorJSON(w, errors.New(http.StatusText(http.StatusInternalServerError)), http.StatusInternalServerError)
+		return
+	}
+
+	if code.Status >= http.StatusInternalServerError {
+		cause := err
+		if wrapped := errors.Unwrap(err); wrapped != nil {
+			cause = wrapped
+		}
+		t.logger().Error("chunked upload failed", "error", cause)
+	}
+
+	t.ErrorJSON(w, err, code.Status)
+}
@@ -0,0 +1,110 @@
+package toolbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestTools_ChunkUploadHandler tests the status codes of the chunk upload handler
+func TestTools_ChunkUploadHandler(t *testing.T) {
+	setupTestDir(t, "./testdata/uploads/")
+	defer cleanupTestDir(t, "./testdata/uploads/")
+
+	tools := Tools{
+		ChunksDirectory:   "./testdata/chunks/",
+		UploadPath:        "./testdata/uploads/",
+		ChunkSize:         4,
+		AllowUnknownTypes: true,
+		SessionStore:      NewMemorySessionStore(),
+	}
+	defer cleanupTestDir(t, tools.ChunksDirectory)
+
+	handler := tools.ChunkUploadHandler()
+	send := func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if len(header) == 2 {
+			req.Header.Set(header[0], header[1])
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send(http.MethodPost, "/", `{"upload_id": "handler", "file_name": "hello.txt", "size": 10, "chunk_size": 100}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body)
+	}
+
+	var created struct {
+		Data ChunkUploadStatus `json:"data"`
+	}
+	json.NewDecoder(rr.Body).Decode(&created)
+	if created.Data.ChunkSize != 4 || created.Data.TotalChunks != 3 {
+		t.Errorf("expected the chunk size to be capped at 4 bytes in 3 chunks, got %+v", created.Data)
+	}
+
+	if rr := send(http.MethodPost, "/", `{"upload_id": "handler", "file_name": "hello.txt", "size": 10}`); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a duplicate upload, got %d", rr.Code)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		header []string
+		status int
+	}{
+		{name: "valid chunk", path: "/handler/chunks/0", body: "hell", status: http.StatusOK},
+		{name: "short chunk", path: "/handler/chunks/1", body: "o", status: http.StatusBadRequest},
+		{name: "oversized chunk", path: "/handler/chunks/1", body: "o world", status: http.StatusRequestEntityTooLarge},
+		{name: "chunk out of range", path: "/handler/chunks/7", body: "o wo", status: http.StatusBadRequest},
+		{name: "bad chunk number", path: "/handler/chunks/one", body: "o wo", status: http.StatusBadRequest},
+		{name: "unknown upload", path: "/missing/chunks/0", body: "o wo", status: http.StatusNotFound},
+		{name: "bad checksum", path: "/handler/chunks/1", body: "o wo", header: []string{ChunkChecksumHeader, "crc32c=00000000"}, status: http.StatusUnprocessableEntity},
+		{name: "last chunk", path: "/handler/chunks/2", body: "ld", status: http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		if rr := send(http.MethodPut, tc.path, tc.body, tc.header...); rr.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d: %s", tc.name, tc.status, rr.Code, rr.Body)
+		}
+	}
+
+	// Chunk 1 is still missing
+	if rr := send(http.MethodPost, "/handler/complete", ""); rr.Code == http.StatusOK {
+		t.Error("expected completion to fail with a missing chunk")
+	}
+
+	if rr := send(http.MethodPut, "/handler/chunks/1", "o wo"); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+
+	// A file rejected by ValidationCallback is the client's fault
+	tools.ValidationCallback = func(file *UploadedFile) error { return errors.New("virus found") }
+	rr = send(http.MethodPost, "/handler/complete", "")
+	if rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), `"code":"content_verification_failed"`) {
+		t.Errorf("expected 422 for a rejected file, got %d: %s", rr.Code, rr.Body)
+	}
+	tools.ValidationCallback = nil
+
+	rr = send(http.MethodPost, "/handler/complete", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body)
+	}
+	if bytes.Contains(rr.Body.Bytes(), []byte("testdata")) {
+		t.Error("response reveals the server path of the file")
+	}
+
+	if rr := send(http.MethodGet, "/handler", ""); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"state":"completed"`) {
+		t.Errorf("expected a completed status, got %d: %s", rr.Code, rr.Body)
+	}
+
+	if rr := send(http.MethodDelete, "/handler", ""); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 when cancelling a completed upload, got %d", rr.Code)
+	}
+}
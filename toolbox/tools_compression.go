@@ -0,0 +1,261 @@
+package toolbox
+
+import (
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// defaultCompressionMinSize is the smallest download compressed on the fly if no MinSize is set
+const defaultCompressionMinSize = 1024
+
+// defaultCompressibleTypes are the content types compressed on the fly if no ContentTypes are set
+var defaultCompressibleTypes = []string{
+	"text/*",
+	"application/json",
+	"application/x-ndjson",
+	"application/javascript",
+	"application/xml",
+	"application/wasm",
+	"image/svg+xml",
+	"image/bmp",
+}
+
+// precompressedEncodings lists the encodings of precompressed files and their extensions, in order
+// of preference when the client accepts several equally
+var precompressedEncodings = []struct {
+	encoding string
+	ext      string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// CompressionOptions controls the compression of downloads sent by ServeDownload,
+// ServeDownloadFile and ServeDownloadFS
+type CompressionOptions struct {
+	// Precompressed serves name.br or name.gz, if present and not older than name, to clients that
+	// accept that encoding. Range requests are answered from the compressed file.
+	Precompressed bool
+
+	// Gzip compresses other downloads on the fly if the client accepts gzip, the file is at least
+	// MinSize bytes (default 1KB) and its type is in ContentTypes. Range requests are never
+	// compressed on the fly, as the ranges would not match the ETag.
+	Gzip    bool
+	MinSize int64
+
+	// ContentTypes lists the types compressed on the fly, e.g. "application/json" or "text/*".
+	// Defaults to text and common structured formats; types ending in +json or +xml are always
+	// included.
+	ContentTypes []string
+}
+
+// compressible reports whether content of contentType is worth compressing
+func (co *CompressionOptions) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	if strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+
+	types := co.ContentTypes
+	if len(types) == 0 {
+		types = defaultCompressibleTypes
+	}
+
+	for _, t := range types {
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if strings.EqualFold(mediaType, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// encodingQuality returns the q-value the Accept-Encoding header gives encoding, or 0 if the
+// encoding is not acceptable
+func encodingQuality(header, encoding string) float64 {
+	wildcard := 0.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(param, "=")
+			if ok && strings.TrimSpace(key) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		switch name {
+		case encoding:
+			return q
+		case "*":
+			wildcard = q
+		}
+	}
+
+	return wildcard
+}
+
+// openPrecompressed opens the best precompressed sibling of the file name, described by info, that
+// r accepts. It returns a nil file if there is none.
+func (t *Tools) openPrecompressed(r *http.Request, name string, info fs.FileInfo, open func(string) (fs.File, error)) (fs.File, fs.FileInfo, string, string) {
+	if t.DownloadCompression == nil || !t.DownloadCompression.Precompressed {
+		return nil, nil, "", ""
+	}
+
+	type candidate struct {
+		encoding, name string
+		q              float64
+	}
+
+	header := r.Header.Get("Accept-Encoding")
+	var candidates []candidate
+	for _, pe := range precompressedEncodings {
+		if q := encodingQuality(header, pe.encoding); q > 0 {
+			candidates = append(candidates, candidate{pe.encoding, name + pe.ext, q})
+		}
+	}
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		switch {
+		case a.q > b.q:
+			return -1
+		case a.q < b.q:
+			return 1
+		}
+		return 0
+	})
+
+	for _, c := range candidates {
+		file, err := open(c.name)
+		if err != nil {
+			continue
+		}
+
+		variantInfo, err := file.Stat()
+		if err != nil || !variantInfo.Mode().IsRegular() || variantInfo.ModTime().Before(info.ModTime()) {
+			t.logger().Debug("ignoring precompressed file", "name", c.name)
+			file.Close()
+			continue
+		}
+
+		return file, variantInfo, c.encoding, c.name
+	}
+
+	return nil, nil, "", ""
+}
+
+// compressOnTheFly decides whether content, of type options.ContentType, is gzipped on the way to
+// the client. If so, it sets a weak ETag for the compressed representation in options.
+func (t *Tools) compressOnTheFly(r *http.Request, content io.ReadSeeker, options *DownloadOptions) bool {
+	compression := t.DownloadCompression
+	if compression == nil || !compression.Gzip || r.Header.Get("Range") != "" {
+		return false
+	}
+	if encodingQuality(r.Header.Get("Accept-Encoding"), "gzip") <= 0 {
+		return false
+	}
+
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return false
+	}
+
+	minSize := compression.MinSize
+	if minSize <= 0 {
+		minSize = defaultCompressionMinSize
+	}
+	if size < minSize {
+		return false
+	}
+
+	if !compression.compressible(options.ContentType) {
+		return false
+	}
+
+	// Gzip output is not guaranteed to be identical every time, so the ETag is weak
+	options.ETag = `W/"` + strings.Trim(strings.TrimPrefix(options.ETag, "W/"), `"`) + `-gzip"`
+	return true
+}
+
+// gzipResponseWriter gzips the body of a 200 response; other responses are passed on as they are
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	compress    bool
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter
+func (gw *gzipResponseWriter) WriteHeader(status int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+
+	if status == http.StatusOK {
+		gw.compress = true
+		gw.Header().Del("Content-Length")
+		gw.Header().Set("Content-Encoding", "gzip")
+	}
+
+	gw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements io.Writer
+func (gw *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if !gw.compress {
+		return gw.ResponseWriter.Write(p)
+	}
+
+	if gw.gz == nil {
+		gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	}
+	return gw.gz.Write(p)
+}
+
+// Flush implements http.Flusher
+func (gw *gzipResponseWriter) Flush() {
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+// Unwrap returns the original ResponseWriter, for http.ResponseController
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+// Close writes the end of the gzip stream
+func (gw *gzipResponseWriter) Close() error {
+	if gw.gz == nil {
+		return nil
+	}
+	return gw.gz.Close()
+}
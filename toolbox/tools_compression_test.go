@@ -0,0 +1,153 @@
+package toolbox
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestEncodingQuality tests parsing Accept-Encoding headers
+func TestEncodingQuality(t *testing.T) {
+	tests := []struct {
+		header   string
+		encoding string
+		expected float64
+	}{
+		{"gzip, deflate, br", "br", 1},
+		{"gzip;q=0.5, br;q=0.8", "gzip", 0.5},
+		{"x-gzip", "gzip", 1},
+		{"*;q=0.3", "br", 0.3},
+		{"br;q=0, *", "br", 0},
+		{"identity", "gzip", 0},
+		{"", "gzip", 0},
+	}
+
+	for _, tt := range tests {
+		if q := encodingQuality(tt.header, tt.encoding); q != tt.expected {
+			t.Errorf("%s in %q: expected %v, got %v", tt.encoding, tt.header, tt.expected, q)
+		}
+	}
+}
+
+// TestTools_PrecompressedDownload tests serving .br and .gz siblings of a file
+func TestTools_PrecompressedDownload(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "export.csv")
+	os.WriteFile(original, []byte(strings.Repeat("id,name\n", 100)), 0644)
+	os.WriteFile(original+".gz", []byte("gzip bytes"), 0644)
+	os.WriteFile(original+".br", []byte("brotli bytes"), 0644)
+
+	tools := Tools{DownloadCompression: &CompressionOptions{Precompressed: true}}
+
+	serve := func(acceptEncoding, rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rr := httptest.NewRecorder()
+		tools.ServeDownloadFile(rr, req, original)
+		return rr
+	}
+
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+		body           string
+	}{
+		{"gzip, br", "br", "brotli bytes"},
+		{"gzip, br;q=0.5", "gzip", "gzip bytes"},
+		{"gzip", "gzip", "gzip bytes"},
+		{"", "", strings.Repeat("id,name\n", 100)},
+	}
+
+	etags := map[string]bool{}
+	for _, tt := range tests {
+		rr := serve(tt.acceptEncoding, "")
+		if rr.Header().Get("Content-Encoding") != tt.encoding || rr.Body.String() != tt.body {
+			t.Errorf("%q: expected %q encoding, got %q with %q", tt.acceptEncoding, tt.encoding, rr.Header().Get("Content-Encoding"), rr.Body.String())
+		}
+		if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/csv") || rr.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%q: unexpected headers %v", tt.acceptEncoding, rr.Header())
+		}
+		if rr.Header().Get("Content-Disposition") != `attachment; filename="export.csv"` {
+			t.Errorf("%q: the original name should be kept, got %q", tt.acceptEncoding, rr.Header().Get("Content-Disposition"))
+		}
+		etags[rr.Header().Get("ETag")] = true
+	}
+	if len(etags) != 3 {
+		t.Errorf("expected an ETag per representation, got %v", etags)
+	}
+
+	// Ranges are served from the compressed file
+	if rr := serve("gzip", "bytes=0-3"); rr.Code != http.StatusPartialContent || rr.Body.String() != "gzip" {
+		t.Errorf("expected a range of the gzip file, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	// Siblings older than the file are stale
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(original+".br", old, old)
+	if rr := serve("br, gzip", ""); rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("expected the stale .br file to be ignored, got %q", rr.Header().Get("Content-Encoding"))
+	}
+}
+
+// TestTools_GzipDownload tests compressing downloads on the fly
+func TestTools_GzipDownload(t *testing.T) {
+	tools := Tools{DownloadCompression: &CompressionOptions{Gzip: true, MinSize: 100}}
+	data := []byte(strings.Repeat(`{"id": 1, "name": "example"}`+"\n", 200))
+
+	serve := func(name string, content []byte, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rr := httptest.NewRecorder()
+		tools.ServeDownload(rr, req, name, bytes.NewReader(content))
+		return rr
+	}
+
+	rr := serve("dump.json", data)
+	if rr.Header().Get("Content-Encoding") != "gzip" || rr.Header().Get("Content-Length") != "" || rr.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("expected a gzipped response, got %v", rr.Header())
+	}
+
+	gz, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _ := io.ReadAll(gz)
+	if !bytes.Equal(decoded, data) {
+		t.Error("decompressed body does not match the content")
+	}
+
+	etag := rr.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) || !strings.HasSuffix(etag, `-gzip"`) {
+		t.Errorf("expected a weak ETag for the gzipped representation, got %q", etag)
+	}
+	if rr := serve("dump.json", data, "If-None-Match", etag); rr.Code != http.StatusNotModified || rr.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected 304 for the gzip ETag, got %d %v", rr.Code, rr.Header())
+	}
+
+	// Range requests, small files and compressed types are sent as they are
+	if rr := serve("dump.json", data, "Range", "bytes=0-9"); rr.Code != http.StatusPartialContent || rr.Body.String() != string(data[:10]) {
+		t.Errorf("expected an uncompressed range, got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := serve("small.json", data[:50]); rr.Header().Get("Content-Encoding") != "" {
+		t.Error("files below MinSize should not be compressed")
+	}
+	if rr := serve("photo.jpg", data); rr.Header().Get("Content-Encoding") != "" {
+		t.Error("images should not be compressed")
+	}
+	if rr := serve("dump.json", data, "Accept-Encoding", "br"); rr.Header().Get("Content-Encoding") != "" {
+		t.Error("clients that do not accept gzip should get the raw file")
+	}
+}
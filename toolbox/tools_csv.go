@@ -0,0 +1,307 @@
+package toolbox
+
+import (
+	"encoding"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// textMarshalerType and textUnmarshalerType are used to find values with a text form, e.g. time.Time
+var (
+	textMarshalerType   = reflect.TypeFor[encoding.TextMarshaler]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// CSVEncoder encodes slices of structs as text/csv, with a header row and a row per element.
+// Columns are named after the csv tag of each field, or its JSON name; fields tagged "-" are left
+// out and embedded structs are flattened. Values with a text form, such as time.Time, use it;
+// nested structs, slices and maps are written as JSON. Columns without a matching field are
+// ignored when decoding.
+type CSVEncoder struct{}
+
+// ContentType implements Encoder
+func (CSVEncoder) ContentType() string {
+	return "text/csv; charset=utf-8"
+}
+
+// csvField is a column of a CSV file and the field it is read from and written to
+type csvField struct {
+	name  string
+	index []int
+}
+
+// Encode implements Encoder
+func (CSVEncoder) Encode(w io.Writer, data interface{}) error {
+	rows := reflect.ValueOf(data)
+	for rows.Kind() == reflect.Pointer {
+		rows = rows.Elem()
+	}
+	if rows.Kind() != reflect.Slice && rows.Kind() != reflect.Array {
+		return fmt.Errorf("csv: %T is not a slice of structs", data)
+	}
+
+	elemType := rows.Type().Elem()
+	for elemType.Kind() == reflect.Pointer {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != reflect.Struct {
+		return fmt.Errorf("csv: %T is not a slice of structs", data)
+	}
+
+	fields := csvFields(elemType, nil)
+	record := make([]string, len(fields))
+	for i, field := range fields {
+		record[i] = field.name
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(record); err != nil {
+		return err
+	}
+
+	for i := 0; i < rows.Len(); i++ {
+		row := rows.Index(i)
+		for row.Kind() == reflect.Pointer && !row.IsNil() {
+			row = row.Elem()
+		}
+
+		for j, field := range fields {
+			record[j] = ""
+			if row.Kind() != reflect.Struct {
+				continue
+			}
+
+			value, err := row.FieldByIndexErr(field.index)
+			if err != nil {
+				continue // Field of a nil embedded struct
+			}
+			if record[j], err = csvValue(value); err != nil {
+				return fmt.Errorf("csv: row %d, column %s: %w", i+1, field.name, err)
+			}
+		}
+
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// Decode implements Encoder. data must be a pointer to a slice of structs.
+func (CSVEncoder) Decode(r io.Reader, data interface{}) error {
+	target := reflect.ValueOf(data)
+	if target.Kind() != reflect.Pointer || target.IsNil() || target.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("csv: %T is not a pointer to a slice of structs", data)
+	}
+	rows := target.Elem()
+
+	elemType := rows.Type().Elem()
+	structType := elemType
+	for structType.Kind() == reflect.Pointer {
+		structType = structType.Elem()
+	}
+	if structType.Kind() != reflect.Struct {
+		return fmt.Errorf("csv: %T is not a pointer to a slice of structs", data)
+	}
+
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	byName := make(map[string]csvField)
+	for _, field := range csvFields(structType, nil) {
+		byName[field.name] = field
+	}
+	columns := make([]*csvField, len(header))
+	for i, name := range header {
+		if field, ok := byName[name]; ok {
+			columns[i] = &field
+		}
+	}
+
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		row := reflect.New(structType).Elem()
+		for i, value := range record {
+			if i >= len(columns) || columns[i] == nil {
+				continue
+			}
+
+			if err := setCSVValue(fieldByIndexAlloc(row, columns[i].index), value); err != nil {
+				line, _ := cr.FieldPos(i)
+				return fmt.Errorf("csv: line %d, column %s: %w", line, columns[i].name, err)
+			}
+		}
+
+		// Wrap the struct in as many pointers as the element type has
+		elem := row
+		for t := elemType; t.Kind() == reflect.Pointer; t = t.Elem() {
+			ptr := reflect.New(elem.Type())
+			ptr.Elem().Set(elem)
+			elem = ptr
+		}
+		rows.Set(reflect.Append(rows, elem))
+	}
+}
+
+// csvFields returns the columns of a struct type, flattening embedded structs
+func csvFields(typ reflect.Type, index []int) []csvField {
+	var fields []csvField
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() && (!field.Anonymous || field.Type.Kind() == reflect.Pointer) {
+			continue // Unexported embedded pointers cannot be allocated when decoding
+		}
+
+		tag := field.Tag.Get("csv")
+		if tag == "-" {
+			continue
+		}
+		name, skip := jsonFieldName(field)
+		if skip && tag == "" {
+			continue
+		}
+		if tag != "" {
+			name = tag
+		}
+
+		fieldIndex := append(append([]int(nil), index...), i)
+
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && tag == "" && field.Tag.Get("json") == "" && fieldType.Kind() == reflect.Struct {
+			fields = append(fields, csvFields(fieldType, fieldIndex)...)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		fields = append(fields, csvField{name: name, index: fieldIndex})
+	}
+
+	return fields
+}
+
+// fieldByIndexAlloc returns the field of v at index, allocating nil embedded pointers on the way
+func fieldByIndexAlloc(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// csvValue returns the text of a value in a CSV file
+func csvValue(v reflect.Value) (string, error) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return "", nil
+		}
+		v = v.Elem()
+	}
+
+	if v.Type().Implements(textMarshalerType) {
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits()), nil
+	}
+
+	out, err := json.Marshal(v.Interface())
+	return string(out), err
+}
+
+// setCSVValue stores the text of a CSV field in v. Empty fields leave pointers nil.
+func setCSVValue(v reflect.Value, text string) error {
+	if v.Kind() == reflect.Pointer {
+		if text == "" {
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setCSVValue(v.Elem(), text)
+	}
+
+	if v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text))
+	}
+
+	if v.Kind() == reflect.String {
+		v.SetString(text)
+		return nil
+	}
+
+	if text == "" {
+		v.SetZero()
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(text, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(text, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(text, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return json.Unmarshal([]byte(text), v.Addr().Interface())
+	}
+
+	return nil
+}
@@ -0,0 +1,540 @@
+package toolbox
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxETagCacheEntries bounds the number of file hashes remembered between requests
+const maxETagCacheEntries = 1024
+
+// maxFSBufferSize is the largest file from an fs.FS that ServeDownloadFS keeps in memory when
+// the file cannot seek; larger files are copied to a temporary file
+const maxFSBufferSize = 8 * 1024 * 1024
+
+// maxDispositionFileName is the longest file name, in bytes, sent in a Content-Disposition header
+const maxDispositionFileName = 255
+
+// Dispositions accepted by ContentDisposition
+const (
+	DispositionAttachment = "attachment" // Ask the browser to save the file
+	DispositionInline     = "inline"     // Let the browser display the file
+)
+
+// DownloadContentSecurityPolicy is sent with untrusted downloads. It blocks scripts, plugins and
+// requests to other resources, and sandboxes the document in a unique origin should a browser
+// still render it.
+const DownloadContentSecurityPolicy = "default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'; sandbox"
+
+// DownloadOptions controls how ServeDownload and ServeDownloadFile send a file
+type DownloadOptions struct {
+	DisplayName string    // File name offered to the browser; defaults to the name of the file
+	ContentType string    // Detected from the name or the content if empty
+	ETag        string    // Strong entity tag, quoted; computed from a hash of the content if empty
+	ModTime     time.Time // Sent as Last-Modified; the modification time of the file by default
+	Inline      bool      // Let the browser display the file instead of saving it
+
+	// Trusted marks content that comes from the application rather than from users. Untrusted
+	// content is sent with DownloadContentSecurityPolicy, and HTML, SVG and XML are always sent as
+	// attachments, even if Inline is set.
+	Trusted bool
+
+	// CacheControl is sent as is, e.g. "public, max-age=86400, immutable". If empty, "no-cache"
+	// is sent so clients revalidate with the ETag before reusing a copy.
+	CacheControl string
+}
+
+// etagCacheEntry is the content hash of a file at a given size and modification time
+type etagCacheEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// fileETags remembers the ETags of files served by ServeDownloadFile and ServeDownloadFS, so a
+// file is only hashed again once it changed. Files on disk are keyed by their absolute path, files
+// in an fs.FS by an fsETagKey. It is shared by all Tools values.
+var fileETags = struct {
+	sync.Mutex
+	entries map[any]etagCacheEntry
+}{entries: make(map[any]etagCacheEntry)}
+
+// fsETagKey identifies a file in an fs.FS in fileETags
+type fsETagKey struct {
+	fsys fs.FS
+	name string
+}
+
+// logger returns the logger for diagnostic messages
+func (t *Tools) logger() *slog.Logger {
+	if t.Logger != nil {
+		return t.Logger
+	}
+	return slog.Default()
+}
+
+// ServeDownload sends content as a download. It sets a strong ETag, Last-Modified, Cache-Control and
+// Content-Disposition, and handles HEAD, conditional requests (If-None-Match, If-Modified-Since,
+// If-Match, If-Unmodified-Since) and single, multiple and If-Range requests for byte ranges.
+//
+// If opts has no ETag, the content is read once to hash it; pass one if it is already known to
+// avoid reading the content twice. The response is sent no faster than t.DownloadThrottle allows.
+func (t *Tools) ServeDownload(w http.ResponseWriter, r *http.Request, name string, content io.ReadSeeker, opts ...DownloadOptions) {
+	var options DownloadOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+
+	if options.ETag == "" {
+		etag, err := contentETag(content)
+		if err != nil {
+			t.logger().Error("failed to hash download", "name", name, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		options.ETag = etag
+	}
+
+	t.serveContent(w, r, name, content, options, nil)
+}
+
+// ServeDownloadFile sends the file at path as a download, see ServeDownload. The ETag is a hash of
+// the file, which is remembered until the size or modification time of the file changes.
+func (t *Tools) ServeDownloadFile(w http.ResponseWriter, r *http.Request, path string, opts ...DownloadOptions) {
+	var options DownloadOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.logger().Debug("download not found", "path", path, "error", err)
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		t.logger().Debug("download is not a file", "path", path)
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	if options.ModTime.IsZero() {
+		options.ModTime = info.ModTime()
+	}
+
+	// A precompressed copy is sent in place of the file, under its name and modification time
+	var variant *encodedContent
+	etagPath, etagContent, etagInfo := path, io.ReadSeeker(file), info
+	if variantFile, variantInfo, encoding, variantPath := t.openPrecompressed(r, path, info, openFile); variantFile != nil {
+		defer variantFile.Close()
+		variant = &encodedContent{content: variantFile.(*os.File), encoding: encoding}
+		etagPath, etagContent, etagInfo = variantPath, variant.content, variantInfo
+	}
+
+	if options.ETag == "" {
+		options.ETag, err = fileETag(etagPath, etagContent, etagInfo)
+		if err != nil {
+			t.logger().Error("failed to hash download", "path", path, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	t.logger().Debug("serving download", "path", etagPath, "size", etagInfo.Size())
+	t.serveContent(w, r, filepath.Base(path), file, options, variant)
+}
+
+// openFile opens the file at path on disk
+func openFile(path string) (fs.File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// ServeDownloadFS sends the file name from fsys as a download, see ServeDownload. It works with any
+// fs.FS, such as an embed.FS, os.DirFS or a zip.Reader. Files that cannot seek, like the entries
+// of a ZIP archive, are buffered first: in memory up to 8MB, in a temporary file in TempFilePath
+// beyond that. ETags are remembered like those of ServeDownloadFile.
+func (t *Tools) ServeDownloadFS(w http.ResponseWriter, r *http.Request, fsys fs.FS, name string, opts ...DownloadOptions) {
+	var options DownloadOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+
+	file, err := fsys.Open(name)
+	if err != nil {
+		t.logger().Debug("download not found", "name", name, "error", err)
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		t.logger().Debug("download is not a file", "name", name)
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	content, cleanup, err := t.seekableFile(file, info)
+	if err != nil {
+		t.logger().Error("failed to read download", "name", name, "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer cleanup()
+
+	if options.ModTime.IsZero() {
+		options.ModTime = info.ModTime() // Zero for an embed.FS, so Last-Modified is left out
+	}
+
+	// A precompressed copy is sent in place of the file, under its name and modification time
+	var variant *encodedContent
+	etagName, etagContent, etagInfo := name, content, info
+	if variantFile, variantInfo, encoding, variantName := t.openPrecompressed(r, name, info, fsys.Open); variantFile != nil {
+		defer variantFile.Close()
+
+		variantContent, variantCleanup, err := t.seekableFile(variantFile, variantInfo)
+		if err != nil {
+			t.logger().Error("failed to read download", "name", variantName, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		defer variantCleanup()
+
+		variant = &encodedContent{content: variantContent, encoding: encoding}
+		etagName, etagContent, etagInfo = variantName, variantContent, variantInfo
+	}
+
+	if options.ETag == "" {
+		// Only file systems that can be hashed can be part of a map key; a struct wrapping a MapFS
+		// has a comparable type but is not
+		var key any
+		if reflect.ValueOf(fsys).Comparable() {
+			key = fsETagKey{fsys: fsys, name: etagName}
+		}
+
+		options.ETag, err = cachedETag(key, etagContent, etagInfo)
+		if err != nil {
+			t.logger().Error("failed to hash download", "name", name, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	t.logger().Debug("serving download", "name", etagName, "size", etagInfo.Size())
+	t.serveContent(w, r, path.Base(name), content, options, variant)
+}
+
+// seekableFile returns file as an io.ReadSeeker, buffering it if it cannot seek, and the function
+// that releases the buffer
+func (t *Tools) seekableFile(file fs.File, info fs.FileInfo) (io.ReadSeeker, func(), error) {
+	if seeker, ok := file.(io.ReadSeeker); ok {
+		return seeker, func() {}, nil
+	}
+
+	var source io.Reader = file
+	if info.Size() <= maxFSBufferSize {
+		data, err := io.ReadAll(io.LimitReader(file, maxFSBufferSize+1))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(data) <= maxFSBufferSize {
+			return bytes.NewReader(data), func() {}, nil
+		}
+
+		// The file is larger than it claimed, keep what was read and spool the rest
+		source = io.MultiReader(bytes.NewReader(data), file)
+	}
+
+	dir := t.TempFilePath
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	temp, err := os.CreateTemp(dir, "temp_download_*")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		temp.Close()
+		os.Remove(temp.Name())
+	}
+
+	if _, err := io.Copy(temp, source); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	return temp, cleanup, nil
+}
+
+// encodedContent is a compressed copy of a download, sent in its place
+type encodedContent struct {
+	content  io.ReadSeeker
+	encoding string // Content-Encoding of content
+}
+
+// serveContent sets the download headers and leaves the rest to http.ServeContent. If variant is
+// set, it is sent instead of content.
+func (t *Tools) serveContent(w http.ResponseWriter, r *http.Request, name string, content io.ReadSeeker, options DownloadOptions, variant *encodedContent) {
+	displayName := options.DisplayName
+	if displayName == "" {
+		displayName = name
+	}
+
+	// What the content really is decides how it may be shown, whatever its name claims
+	sniffed := sniffContentType(content)
+	if options.ContentType == "" {
+		options.ContentType = mime.TypeByExtension(filepath.Ext(name))
+		if options.ContentType == "" {
+			options.ContentType = sniffed
+		}
+	}
+
+	disposition := DispositionAttachment
+	if options.Inline {
+		disposition = DispositionInline
+		if !options.Trusted && (activeContentType(options.ContentType) || activeContentType(sniffed)) {
+			t.logger().Debug("download sent as attachment", "name", name, "type", options.ContentType, "sniffed", sniffed)
+			disposition = DispositionAttachment
+		}
+	}
+
+	cacheControl := options.CacheControl
+	if cacheControl == "" {
+		cacheControl = "no-cache"
+	}
+
+	out := t.throttleResponse(w, r)
+	if t.DownloadCompression != nil {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if variant != nil {
+		w.Header().Set("Content-Encoding", variant.encoding)
+		content = variant.content
+	} else if t.compressOnTheFly(r, content, &options) {
+		gw := &gzipResponseWriter{ResponseWriter: out}
+		defer gw.Close()
+		out = gw
+	}
+
+	w.Header().Set("ETag", options.ETag)
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("Content-Disposition", ContentDisposition(disposition, displayName))
+	w.Header().Set("Content-Type", options.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if !options.Trusted {
+		w.Header().Set("Content-Security-Policy", DownloadContentSecurityPolicy)
+	}
+
+	http.ServeContent(out, r, name, options.ModTime, content)
+}
+
+// sniffContentType returns the type of content judged by its first bytes, and rewinds it
+func sniffContentType(content io.ReadSeeker) string {
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(content, buf)
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "application/octet-stream"
+	}
+
+	contentType := http.DetectContentType(buf[:n])
+
+	// SVG is not recognised by DetectContentType, but runs scripts like HTML
+	if strings.HasPrefix(contentType, "text/") && bytes.Contains(bytes.ToLower(buf[:n]), []byte("<svg")) {
+		return "image/svg+xml"
+	}
+
+	return contentType
+}
+
+// activeContentType reports whether a browser may run scripts in content of contentType when it
+// is displayed
+func activeContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "image/svg+xml", "text/xml", "application/xml", "text/xsl", "application/xslt+xml":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+xml")
+}
+
+// ContentDisposition builds a Content-Disposition header value as described in RFC 6266. Control
+// characters, path separators and bidirectional overrides are removed from filename. The filename
+// parameter carries an ASCII version of the name for old clients, and if that differs from the
+// real name, the filename* parameter carries the name in UTF-8 as described in RFC 5987.
+// Dispositions other than DispositionInline are sent as DispositionAttachment.
+func ContentDisposition(disposition, filename string) string {
+	if disposition != DispositionInline {
+		disposition = DispositionAttachment
+	}
+
+	name := sanitizeDispositionName(filename)
+	if name == "" {
+		return disposition
+	}
+
+	fallback := asciiFileName(name)
+	value := fmt.Sprintf("%s; filename=\"%s\"", disposition, fallback)
+	if fallback != name {
+		value += "; filename*=UTF-8''" + encodeRFC5987(name)
+	}
+
+	return value
+}
+
+// sanitizeDispositionName removes the characters from a file name that could break the header or
+// mislead the user, and limits its length
+func sanitizeDispositionName(filename string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\':
+			return '_'
+		case unicode.IsControl(r), r == utf8.RuneError:
+			return -1
+		case unicode.Is(unicode.Bidi_Control, r):
+			// Right-to-left overrides can disguise the extension, e.g. "harmless\u202Etxt.exe"
+			return -1
+		}
+		return r
+	}, filename)
+
+	name = strings.Trim(name, " .")
+	if len(name) <= maxDispositionFileName {
+		return name
+	}
+
+	// Shorten the name but keep a reasonable extension
+	ext := filepath.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	base := name[:maxDispositionFileName-len(ext)]
+	for !utf8.ValidString(base) {
+		base = base[:len(base)-1]
+	}
+
+	return base + ext
+}
+
+// asciiFileName returns a version of name that only uses printable ASCII characters that are safe
+// inside a quoted string
+func asciiFileName(name string) string {
+	name = transliterator.Replace(name)
+
+	var b strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' || r == '%' {
+			b.WriteByte('_')
+			continue
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// encodeRFC5987 percent-encodes every byte of s that is not an attr-char
+func encodeRFC5987(s string) string {
+	const attrChars = "!#$&+-.^_`|~"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || strings.IndexByte(attrChars, c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+
+	return b.String()
+}
+
+// contentETag hashes content into a strong ETag and rewinds it
+func contentETag(content io.ReadSeeker) (string, error) {
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, content); err != nil {
+		return "", err
+	}
+
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`, nil
+}
+
+// fileETag returns the ETag of the file at path, hashing it only if it changed since the last call
+func fileETag(path string, file io.ReadSeeker, info os.FileInfo) (string, error) {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		key = path
+	}
+
+	return cachedETag(key, file, info)
+}
+
+// cachedETag returns the ETag of content, which is the file described by info. It is remembered
+// under key until the size or modification time of the file changes; a nil key is not remembered.
+func cachedETag(key any, content io.ReadSeeker, info fs.FileInfo) (string, error) {
+	if key == nil {
+		return contentETag(content)
+	}
+
+	fileETags.Lock()
+	entry, ok := fileETags.entries[key]
+	fileETags.Unlock()
+
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.etag, nil
+	}
+
+	etag, err := contentETag(content)
+	if err != nil {
+		return "", err
+	}
+
+	fileETags.Lock()
+	if len(fileETags.entries) >= maxETagCacheEntries {
+		clear(fileETags.entries)
+	}
+	fileETags.entries[key] = etagCacheEntry{size: info.Size(), modTime: info.ModTime(), etag: etag}
+	fileETags.Unlock()
+
+	return etag, nil
+}
@@ -1,12 +1,23 @@
 package toolbox
 
 import (
+	"archive/zip"
+	"bytes"
+	"embed"
 	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
+	"unicode/utf8"
 )
 
 func TestTools_DownloadStaticFile(t *testing.T) {
@@ -51,3 +62,335 @@ func TestTools_DownloadStaticFile(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// TestTools_ServeDownloadFile tests the caching, conditional and range headers of downloads
+func TestTools_ServeDownloadFile(t *testing.T) {
+	setupTestDir(t, "./testdata/downloads/")
+	defer cleanupTestDir(t, "./testdata/downloads/")
+
+	path := filepath.Join("./testdata/downloads/", "report.txt")
+	content := "0123456789abcdefghijklmnopqrstuvwxyz"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	tools := Tools{Logger: slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))}
+
+	serve := func(header ...string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/download", nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rr := httptest.NewRecorder()
+		tools.ServeDownloadFile(rr, req, path, DownloadOptions{CacheControl: "private, max-age=60"})
+		return rr.Result()
+	}
+
+	res := serve()
+	etag := res.Header.Get("ETag")
+	lastModified := res.Header.Get("Last-Modified")
+	if res.StatusCode != http.StatusOK || len(etag) < 3 || etag[0] != '"' || lastModified == "" {
+		t.Fatalf("expected 200 with a strong ETag and Last-Modified, got %d %q %q", res.StatusCode, etag, lastModified)
+	}
+	if cc := res.Header.Get("Cache-Control"); cc != "private, max-age=60" {
+		t.Errorf("expected the Cache-Control option, got %q", cc)
+	}
+	if cd := res.Header.Get("Content-Disposition"); cd != `attachment; filename="report.txt"` {
+		t.Errorf("unexpected content disposition %q", cd)
+	}
+
+	tests := []struct {
+		name   string
+		header []string
+		status int
+		body   string
+	}{
+		{name: "matching etag", header: []string{"If-None-Match", etag}, status: http.StatusNotModified},
+		{name: "other etag", header: []string{"If-None-Match", `"other"`}, status: http.StatusOK, body: content},
+		{name: "not modified since", header: []string{"If-Modified-Since", lastModified}, status: http.StatusNotModified},
+		{name: "single range", header: []string{"Range", "bytes=10-15"}, status: http.StatusPartialContent, body: "abcdef"},
+		{name: "suffix range", header: []string{"Range", "bytes=-3"}, status: http.StatusPartialContent, body: "xyz"},
+		{name: "range if unchanged", header: []string{"Range", "bytes=0-3", "If-Range", etag}, status: http.StatusPartialContent, body: "0123"},
+		{name: "range if changed", header: []string{"Range", "bytes=0-3", "If-Range", `"stale"`}, status: http.StatusOK, body: content},
+		{name: "unsatisfiable range", header: []string{"Range", "bytes=100-200"}, status: http.StatusRequestedRangeNotSatisfiable},
+	}
+
+	for _, tc := range tests {
+		res := serve(tc.header...)
+		body, _ := io.ReadAll(res.Body)
+		if res.StatusCode != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.status, res.StatusCode)
+		}
+		if tc.body != "" && string(body) != tc.body {
+			t.Errorf("%s: expected body %q, got %q", tc.name, tc.body, body)
+		}
+	}
+
+	// Several ranges are sent as multipart/byteranges
+	res = serve("Range", "bytes=0-1,10-11")
+	mediaType, params, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if res.StatusCode != http.StatusPartialContent || mediaType != "multipart/byteranges" {
+		t.Fatalf("expected a multipart range response, got %d %s", res.StatusCode, mediaType)
+	}
+	reader := multipart.NewReader(res.Body, params["boundary"])
+	var parts []string
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		data, _ := io.ReadAll(part)
+		parts = append(parts, string(data))
+	}
+	if len(parts) != 2 || parts[0] != "01" || parts[1] != "ab" {
+		t.Errorf("expected the parts 01 and ab, got %v", parts)
+	}
+
+	// A changed file gets a new ETag
+	os.WriteFile(path, []byte(content+"!"), 0644)
+	os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if res := serve("If-None-Match", etag); res.StatusCode != http.StatusOK || res.Header.Get("ETag") == etag {
+		t.Errorf("expected a new ETag after the file changed, got %d %s", res.StatusCode, res.Header.Get("ETag"))
+	}
+
+	// Missing files and directories are not found, and logged rather than printed
+	rr := httptest.NewRecorder()
+	tools.ServeDownloadFile(rr, httptest.NewRequest(http.MethodGet, "/", nil), "./testdata/downloads/")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a directory, got %d", rr.Code)
+	}
+	if !strings.Contains(logs.String(), "download is not a file") {
+		t.Errorf("expected the logger to be used, got %q", logs.String())
+	}
+}
+
+// TestTools_ServeDownload tests downloads from an io.ReadSeeker
+func TestTools_ServeDownload(t *testing.T) {
+	var tools Tools
+	content := strings.NewReader("generated report")
+
+	rr := httptest.NewRecorder()
+	tools.ServeDownload(rr, httptest.NewRequest(http.MethodGet, "/", nil), "report.csv", content, DownloadOptions{
+		DisplayName: "Q3 report.csv",
+		Inline:      true,
+	})
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "generated report" {
+		t.Fatalf("expected the whole content, got %d %q", rr.Code, rr.Body)
+	}
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Errorf("expected the type from the name, got %q", ct)
+	}
+	if cd := rr.Header().Get("Content-Disposition"); cd != `inline; filename="Q3 report.csv"` {
+		t.Errorf("unexpected content disposition %q", cd)
+	}
+	if cc := rr.Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("expected no-cache by default, got %q", cc)
+	}
+
+	etag := rr.Header().Get("ETag")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	tools.ServeDownload(rr, req, "report.csv", content)
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for the same content, got %d", rr.Code)
+	}
+
+	// A known ETag is used as is
+	rr = httptest.NewRecorder()
+	tools.ServeDownload(rr, httptest.NewRequest(http.MethodHead, "/", nil), "report.csv", content, DownloadOptions{ETag: `"v42"`})
+	if rr.Header().Get("ETag") != `"v42"` || rr.Body.Len() != 0 {
+		t.Errorf("expected the given ETag and no body for HEAD, got %q", rr.Header().Get("ETag"))
+	}
+}
+
+// TestTools_DownloadSecurity tests the headers that keep user content from running scripts
+func TestTools_DownloadSecurity(t *testing.T) {
+	tools := Tools{}
+
+	tests := []struct {
+		name        string
+		fileName    string
+		content     string
+		options     DownloadOptions
+		contentType string
+		disposition string
+		csp         bool
+	}{
+		{"svg disguised as png", "avatar.png", `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`,
+			DownloadOptions{Inline: true}, "image/png", DispositionAttachment, true},
+		{"html", "page.html", "<!DOCTYPE html><html><script>alert(1)</script></html>",
+			DownloadOptions{Inline: true}, "text/html; charset=utf-8", DispositionAttachment, true},
+		{"xml without extension", "feed", `<?xml version="1.0"?><rss></rss>`,
+			DownloadOptions{Inline: true}, "text/xml; charset=utf-8", DispositionAttachment, true},
+		{"html declared as text", "notes.txt", "<html><body>hello</body></html>",
+			DownloadOptions{Inline: true, ContentType: "text/plain"}, "text/plain", DispositionAttachment, true},
+		{"plain text", "notes.txt", "just some notes",
+			DownloadOptions{Inline: true}, "text/plain; charset=utf-8", DispositionInline, true},
+		{"trusted html", "help.html", "<html><body>help</body></html>",
+			DownloadOptions{Inline: true, Trusted: true}, "text/html; charset=utf-8", DispositionInline, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			tools.ServeDownload(rr, httptest.NewRequest(http.MethodGet, "/", nil), tt.fileName, strings.NewReader(tt.content), tt.options)
+
+			if rr.Header().Get("Content-Type") != tt.contentType {
+				t.Errorf("expected type %q, got %q", tt.contentType, rr.Header().Get("Content-Type"))
+			}
+			if !strings.HasPrefix(rr.Header().Get("Content-Disposition"), tt.disposition+";") {
+				t.Errorf("expected %s, got %q", tt.disposition, rr.Header().Get("Content-Disposition"))
+			}
+			if rr.Header().Get("X-Content-Type-Options") != "nosniff" {
+				t.Error("expected X-Content-Type-Options: nosniff")
+			}
+			if csp := rr.Header().Get("Content-Security-Policy"); (csp == DownloadContentSecurityPolicy) != tt.csp {
+				t.Errorf("unexpected Content-Security-Policy %q", csp)
+			}
+			if rr.Body.String() != tt.content {
+				t.Errorf("expected the content to be sent unchanged, got %q", rr.Body.String())
+			}
+		})
+	}
+}
+
+//go:embed testdata/img.png
+var testAssets embed.FS
+
+// TestTools_ServeDownloadFS tests serving files from an embed.FS and from a ZIP archive
+func TestTools_ServeDownloadFS(t *testing.T) {
+	tools := Tools{TempFilePath: t.TempDir()}
+
+	serve := func(fsys fs.FS, name string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rr := httptest.NewRecorder()
+		tools.ServeDownloadFS(rr, req, fsys, name, DownloadOptions{DisplayName: "logo.png"})
+		return rr
+	}
+
+	// Embedded files have no modification time
+	expected, _ := os.ReadFile("testdata/img.png")
+	rr := serve(testAssets, "testdata/img.png")
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), expected) {
+		t.Fatalf("expected the embedded file, got %d", rr.Code)
+	}
+	if rr.Header().Get("Content-Type") != "image/png" || rr.Header().Get("Last-Modified") != "" {
+		t.Errorf("unexpected headers %v", rr.Header())
+	}
+	if rr.Header().Get("Content-Disposition") != `attachment; filename="logo.png"` {
+		t.Errorf("unexpected Content-Disposition %q", rr.Header().Get("Content-Disposition"))
+	}
+
+	etag := rr.Header().Get("ETag")
+	if rr := serve(testAssets, "testdata/img.png", "If-None-Match", etag); rr.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for a matching ETag, got %d", rr.Code)
+	}
+
+	for _, name := range []string{"testdata", "testdata/missing.png", "../tools.go"} {
+		if rr := serve(testAssets, name); rr.Code != http.StatusNotFound {
+			t.Errorf("expected 404 for %s, got %d", name, rr.Code)
+		}
+	}
+
+	// Entries of a ZIP archive cannot seek, so they are buffered to answer range requests
+	small := []byte("name,amount\nalice,10\n")
+	large := bytes.Repeat([]byte("0123456789abcdef"), maxFSBufferSize/16+1024)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range map[string][]byte{"templates/small.csv": small, "templates/large.bin": large} {
+		f, _ := zw.Create(name)
+		f.Write(data)
+	}
+	zw.Close()
+
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr := serve(archive, "templates/small.csv", "Range", "bytes=5-10"); rr.Code != http.StatusPartialContent || rr.Body.String() != string(small[5:11]) {
+		t.Errorf("expected a range of the buffered entry, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	rr = serve(archive, "templates/large.bin", "Range", "bytes=-16")
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "0123456789abcdef" {
+		t.Errorf("expected the end of the spooled entry, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	// The temporary file is removed once the response is sent
+	if entries, _ := os.ReadDir(tools.TempFilePath); len(entries) != 0 {
+		t.Errorf("expected no temporary files, found %d", len(entries))
+	}
+}
+
+// wrapFS hides the type of the file system it wraps
+type wrapFS struct {
+	fs.FS
+}
+
+// TestTools_ServeDownloadFS_Unhashable tests file systems whose type is comparable but whose value
+// cannot be used as a map key
+func TestTools_ServeDownloadFS_Unhashable(t *testing.T) {
+	tools := Tools{}
+	fsys := wrapFS{fstest.MapFS{"notes.txt": &fstest.MapFile{Data: []byte("hello"), ModTime: time.Now()}}}
+
+	for range 2 {
+		rr := httptest.NewRecorder()
+		tools.ServeDownloadFS(rr, httptest.NewRequest(http.MethodGet, "/", nil), fsys, "notes.txt")
+		if rr.Code != http.StatusOK || rr.Body.String() != "hello" {
+			t.Fatalf("expected the file, got %d %q", rr.Code, rr.Body.String())
+		}
+		if rr.Header().Get("ETag") == "" {
+			t.Error("expected an ETag")
+		}
+	}
+}
+
+// TestContentDisposition tests the header values built for awkward file names
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name        string
+		disposition string
+		filename    string
+		expected    string
+	}{
+		{name: "plain", disposition: DispositionAttachment, filename: "report.pdf", expected: `attachment; filename="report.pdf"`},
+		{name: "inline", disposition: DispositionInline, filename: "photo.jpg", expected: `inline; filename="photo.jpg"`},
+		{name: "unknown disposition", disposition: "form-data", filename: "a.txt", expected: `attachment; filename="a.txt"`},
+		{name: "quotes", disposition: DispositionAttachment, filename: `my "best" file.txt`,
+			expected: `attachment; filename="my _best_ file.txt"; filename*=UTF-8''my%20%22best%22%20file.txt`},
+		{name: "header injection", disposition: DispositionAttachment, filename: "evil.txt\r\nSet-Cookie: a=b",
+			expected: `attachment; filename="evil.txtSet-Cookie: a=b"`},
+		{name: "accents", disposition: DispositionAttachment, filename: "Café Übersicht.pdf",
+			expected: `attachment; filename="Cafe Ubersicht.pdf"; filename*=UTF-8''Caf%C3%A9%20%C3%9Cbersicht.pdf`},
+		{name: "non-latin", disposition: DispositionAttachment, filename: "報告.pdf",
+			expected: `attachment; filename="__.pdf"; filename*=UTF-8''%E5%A0%B1%E5%91%8A.pdf`},
+		{name: "path", disposition: DispositionAttachment, filename: `../etc\passwd`, expected: `attachment; filename="_etc_passwd"`},
+		{name: "bidi override", disposition: DispositionAttachment, filename: "invoice‮fdp.exe", expected: `attachment; filename="invoicefdp.exe"`},
+		{name: "percent", disposition: DispositionAttachment, filename: "100%.txt", expected: `attachment; filename="100_.txt"; filename*=UTF-8''100%25.txt`},
+		{name: "empty", disposition: DispositionAttachment, filename: "\r\n", expected: "attachment"},
+	}
+
+	for _, tc := range tests {
+		if got := ContentDisposition(tc.disposition, tc.filename); got != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.expected, got)
+		}
+	}
+
+	// Long names are shortened without losing the extension or splitting a character
+	long := ContentDisposition(DispositionAttachment, strings.Repeat("é", 300)+".pdf")
+	_, params, err := mime.ParseMediaType(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := params["filename"]; len(name) > 255 || !strings.HasSuffix(name, ".pdf") || !utf8.ValidString(name) {
+		t.Errorf("long name not shortened correctly: %d bytes", len(name))
+	}
+}
@@ -0,0 +1,235 @@
+package toolbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Encoder reads and writes bodies of one media type for WriteResponse and ReadBody
+type Encoder interface {
+	ContentType() string // e.g. "application/xml"; may carry parameters such as a charset
+	Encode(w io.Writer, data interface{}) error
+	Decode(r io.Reader, data interface{}) error
+}
+
+// EncoderRegistry holds the encoders WriteResponse and ReadBody choose from, by media type. If a
+// client accepts several equally, the one registered first is used.
+type EncoderRegistry struct {
+	mu       sync.RWMutex
+	encoders []Encoder
+}
+
+// DefaultEncoders is used by Tools without Encoders. It holds JSON, XML, CSV and MessagePack.
+var DefaultEncoders = NewEncoderRegistry()
+
+// NewEncoderRegistry returns a registry of the encoders of this package: JSON, which is preferred,
+// XML, CSV and MessagePack
+func NewEncoderRegistry() *EncoderRegistry {
+	er := &EncoderRegistry{}
+	er.Register(JSONEncoder{})
+	er.Register(XMLEncoder{})
+	er.Register(CSVEncoder{})
+	er.Register(MessagePackEncoder{})
+	return er
+}
+
+// Register adds enc to the registry, replacing the encoder of the same media type if there is one
+func (er *EncoderRegistry) Register(enc Encoder) {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+
+	mediaType := encoderMediaType(enc)
+	for i, existing := range er.encoders {
+		if encoderMediaType(existing) == mediaType {
+			er.encoders[i] = enc
+			return
+		}
+	}
+	er.encoders = append(er.encoders, enc)
+}
+
+// Lookup returns the encoder of a media type, such as the Content-Type of a request. Types ending
+// in +json or +xml fall back to the JSON and XML encoders.
+func (er *EncoderRegistry) Lookup(contentType string) (Encoder, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+
+	er.mu.RLock()
+	defer er.mu.RUnlock()
+
+	for _, enc := range er.encoders {
+		if encoderMediaType(enc) == mediaType {
+			return enc, true
+		}
+	}
+
+	switch {
+	case strings.HasSuffix(mediaType, "+json"):
+		return er.lookupLocked("application/json")
+	case strings.HasSuffix(mediaType, "+xml"):
+		return er.lookupLocked("application/xml")
+	}
+	return nil, false
+}
+
+// lookupLocked returns the encoder of mediaType. The caller holds er.mu.
+func (er *EncoderRegistry) lookupLocked(mediaType string) (Encoder, bool) {
+	for _, enc := range er.encoders {
+		if encoderMediaType(enc) == mediaType {
+			return enc, true
+		}
+	}
+	return nil, false
+}
+
+// Negotiate returns the encoder an Accept header prefers, or false if it accepts none of them.
+// Without an Accept header, the first encoder is used.
+func (er *EncoderRegistry) Negotiate(accept string) (Encoder, bool) {
+	er.mu.RLock()
+	defer er.mu.RUnlock()
+
+	var best Encoder
+	bestQ := 0.0
+	for _, enc := range er.encoders {
+		if q, _ := acceptQuality(accept, encoderMediaType(enc)); q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+
+	return best, best != nil
+}
+
+// encoderMediaType returns the content type of enc without parameters
+func encoderMediaType(enc Encoder) string {
+	mediaType, _, _ := strings.Cut(enc.ContentType(), ";")
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+// encoders returns t.Encoders, or DefaultEncoders if it is not set
+func (t *Tools) encoders() *EncoderRegistry {
+	if t.Encoders != nil {
+		return t.Encoders
+	}
+	return DefaultEncoders
+}
+
+// WriteResponse is WriteJSON in the format the Accept header of r prefers among t.Encoders, e.g.
+// XML or CSV. JSON is sent as by WriteJSON. If the client accepts none of the formats, a 406 error
+// is sent as JSON and ErrNotAcceptable returned. If data cannot be encoded in the chosen format,
+// e.g. a map as CSV, nothing is sent and the error is returned.
+func (t *Tools) WriteResponse(w http.ResponseWriter, r *http.Request, status int, data interface{}, headers ...http.Header) error {
+	w.Header().Add("Vary", "Accept")
+
+	enc, ok := t.encoders().Negotiate(r.Header.Get("Accept"))
+	if !ok {
+		err := &ErrorResponse{
+			Err:     ErrNotAcceptable,
+			Message: fmt.Sprintf("none of the accepted types is available: %s", r.Header.Get("Accept")),
+		}
+		t.ErrorJSON(w, err, http.StatusNotAcceptable)
+		return err
+	}
+
+	if _, isJSON := enc.(JSONEncoder); isJSON {
+		return t.WriteJSON(w, status, data, headers...)
+	}
+
+	var out bytes.Buffer
+	if err := enc.Encode(&out, data); err != nil {
+		return err
+	}
+
+	if len(headers) > 0 {
+		for key, value := range headers[0] {
+			w.Header()[key] = value
+		}
+	}
+
+	w.Header().Set("Content-Type", enc.ContentType())
+	w.WriteHeader(status)
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// ReadBody is ReadJSON for any format of t.Encoders, chosen by the Content-Type of r. Bodies without
+// a Content-Type are read as JSON, and JSON is read by ReadJSON. Other formats are limited to
+// MaxJSONSize as well and validated the same way. An unknown Content-Type is reported as
+// ErrUnsupportedMedia.
+func (t *Tools) ReadBody(w http.ResponseWriter, r *http.Request, data interface{}) error {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return t.ReadJSON(w, r, data)
+	}
+
+	enc, ok := t.encoders().Lookup(contentType)
+	if !ok {
+		return &ErrorResponse{
+			Err:     ErrUnsupportedMedia,
+			Message: fmt.Sprintf("unsupported content type %q", contentType),
+		}
+	}
+	if _, isJSON := enc.(JSONEncoder); isJSON {
+		return t.ReadJSON(w, r, data)
+	}
+
+	maxBytes := 1024 * 1024 // one meg
+	if t.MaxJSONSize != 0 {
+		maxBytes = t.MaxJSONSize
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	if err := enc.Decode(r.Body, data); err != nil {
+		return fmt.Errorf("error parsing %s: %w", encoderMediaType(enc), err)
+	}
+
+	return t.Validate(data)
+}
+
+// JSONEncoder encodes application/json with encoding/json
+type JSONEncoder struct{}
+
+// ContentType implements Encoder
+func (JSONEncoder) ContentType() string {
+	return "application/json"
+}
+
+// Encode implements Encoder
+func (JSONEncoder) Encode(w io.Writer, data interface{}) error {
+	return json.NewEncoder(w).Encode(data)
+}
+
+// Decode implements Encoder
+func (JSONEncoder) Decode(r io.Reader, data interface{}) error {
+	return json.NewDecoder(r).Decode(data)
+}
+
+// XMLEncoder encodes application/xml with encoding/xml, so xml struct tags apply. Maps cannot be
+// encoded.
+type XMLEncoder struct{}
+
+// ContentType implements Encoder
+func (XMLEncoder) ContentType() string {
+	return "application/xml; charset=utf-8"
+}
+
+// Encode implements Encoder
+func (XMLEncoder) Encode(w io.Writer, data interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(data)
+}
+
+// Decode implements Encoder
+func (XMLEncoder) Decode(r io.Reader, data interface{}) error {
+	return xml.NewDecoder(r).Decode(data)
+}
@@ -0,0 +1,272 @@
+package toolbox
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testProduct struct {
+	SKU     string     `json:"sku" xml:"sku" validate:"required"`
+	Price   float64    `json:"price" xml:"price"`
+	Stock   *int       `json:"stock,omitempty" xml:"stock,omitempty"`
+	Tags    []string   `json:"tags" xml:"tag"`
+	Added   time.Time  `json:"added" xml:"added"`
+	Secret  string     `json:"-" xml:"-"`
+	Details *testExtra `json:"details,omitempty" xml:"details,omitempty" csv:"-"`
+}
+
+type testExtra struct {
+	Color string `json:"color" xml:"color"`
+}
+
+// testProducts returns products to encode
+func testProducts() []testProduct {
+	stock := 3
+	added := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	return []testProduct{
+		{SKU: "A-1", Price: 9.5, Stock: &stock, Tags: []string{"new", "red"}, Added: added, Secret: "x"},
+		{SKU: "B, 2", Price: 12, Tags: []string{}, Added: added},
+	}
+}
+
+// TestTools_WriteResponse tests choosing the response format from the Accept header
+func TestTools_WriteResponse(t *testing.T) {
+	var tools Tools
+
+	tests := []struct {
+		accept      string
+		status      int
+		contentType string
+		prefix      string
+	}{
+		{"", http.StatusOK, "application/json", `[{"sku":"A-1"`},
+		{"*/*", http.StatusOK, "application/json", `[{"sku":"A-1"`},
+		{"application/xml", http.StatusOK, "application/xml; charset=utf-8", `<?xml version="1.0"`},
+		{"text/csv, application/json;q=0.5", http.StatusOK, "text/csv; charset=utf-8", "sku,price,stock,tags,added\n"},
+		{"application/msgpack", http.StatusOK, "application/msgpack", "\x92"},
+		{"text/*;q=0.8, application/*;q=0.2", http.StatusOK, "text/csv; charset=utf-8", "sku"},
+		{"image/png", http.StatusNotAcceptable, "application/json", `{"error":true`},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/products", nil)
+		req.Header.Set("Accept", tt.accept)
+		rr := httptest.NewRecorder()
+
+		err := tools.WriteResponse(rr, req, http.StatusOK, testProducts(), http.Header{"X-Count": {"2"}})
+		if (tt.status == http.StatusNotAcceptable) != errors.Is(err, ErrNotAcceptable) {
+			t.Errorf("Accept %q: unexpected error %v", tt.accept, err)
+		}
+
+		if rr.Code != tt.status || rr.Header().Get("Content-Type") != tt.contentType || !strings.HasPrefix(rr.Body.String(), tt.prefix) {
+			t.Errorf("Accept %q: unexpected response %d %q %q", tt.accept, rr.Code, rr.Header().Get("Content-Type"), rr.Body.String())
+		}
+		if rr.Header().Get("Vary") != "Accept" {
+			t.Errorf("Accept %q: expected Vary: Accept, got %q", tt.accept, rr.Header().Get("Vary"))
+		}
+		if tt.status == http.StatusOK && rr.Header().Get("X-Count") != "2" {
+			t.Errorf("Accept %q: expected the extra header", tt.accept)
+		}
+	}
+
+	// Data the format cannot hold is not sent
+	req := httptest.NewRequest(http.MethodGet, "/products", nil)
+	req.Header.Set("Accept", "text/csv")
+	rr := httptest.NewRecorder()
+	if err := tools.WriteResponse(rr, req, http.StatusOK, map[string]int{"a": 1}); err == nil || rr.Body.Len() != 0 {
+		t.Errorf("expected an error and no body, got %v, %q", err, rr.Body.String())
+	}
+}
+
+// TestTools_ReadBody tests reading bodies in each format back
+func TestTools_ReadBody(t *testing.T) {
+	var tools Tools
+	expected := testProducts()
+	expected[0].Secret = ""
+
+	for _, contentType := range []string{"application/json", "application/xml", "text/csv", "application/msgpack"} {
+		t.Run(contentType, func(t *testing.T) {
+			enc, ok := DefaultEncoders.Lookup(contentType)
+			if !ok {
+				t.Fatalf("no encoder for %s", contentType)
+			}
+
+			// XML needs a root element around the list
+			var data interface{} = testProducts()
+			var decoded interface{} = &[]testProduct{}
+			type productList struct {
+				Products []testProduct `xml:"product"`
+			}
+			if contentType == "application/xml" {
+				data = productList{Products: testProducts()}
+				decoded = &productList{}
+			}
+
+			var body bytes.Buffer
+			if err := enc.Encode(&body, data); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/products", &body)
+			req.Header.Set("Content-Type", contentType)
+			if err := tools.ReadBody(httptest.NewRecorder(), req, decoded); err != nil {
+				t.Fatal(err)
+			}
+
+			var products []testProduct
+			switch d := decoded.(type) {
+			case *productList:
+				products = d.Products
+			case *[]testProduct:
+				products = *d
+			}
+
+			// Empty slices do not survive every format
+			products[1].Tags = []string{}
+			if !reflect.DeepEqual(products, expected) {
+				t.Errorf("expected %+v, got %+v", expected, products)
+			}
+		})
+	}
+
+	// Records are validated in every format
+	req := httptest.NewRequest(http.MethodPost, "/products", strings.NewReader("sku,price\n,3\n"))
+	req.Header.Set("Content-Type", "text/csv")
+	var products []testProduct
+	var validationErrs ValidationErrors
+	if err := tools.ReadBody(httptest.NewRecorder(), req, &products); !errors.As(err, &validationErrs) || validationErrs["[0].sku"] == nil {
+		t.Errorf("expected a validation error for the SKU, got %v", err)
+	}
+
+	// +json types are read as JSON
+	req = httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(`[{"sku": "C"}]`))
+	req.Header.Set("Content-Type", "application/vnd.shop+json")
+	if err := tools.ReadBody(httptest.NewRecorder(), req, &products); err != nil || products[0].SKU != "C" {
+		t.Errorf("unexpected result %v, %v", products, err)
+	}
+
+	// Unknown types are rejected with 415
+	req = httptest.NewRequest(http.MethodPost, "/products", strings.NewReader("sku: C"))
+	req.Header.Set("Content-Type", "application/yaml")
+	err := tools.ReadBody(httptest.NewRecorder(), req, &products)
+	rr := httptest.NewRecorder()
+	tools.ErrorJSON(rr, err)
+	if !errors.Is(err, ErrUnsupportedMedia) || rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415, got %d, %v", rr.Code, err)
+	}
+
+	// Malformed bodies are reported with their format
+	req = httptest.NewRequest(http.MethodPost, "/products", strings.NewReader("sku,price\nA,cheap\n"))
+	req.Header.Set("Content-Type", "text/csv")
+	if err := tools.ReadBody(httptest.NewRecorder(), req, &products); err == nil || !strings.Contains(err.Error(), "line 2, column price") {
+		t.Errorf("expected the position of the bad price, got %v", err)
+	}
+}
+
+// TestEncoderRegistry tests registering encoders
+func TestEncoderRegistry(t *testing.T) {
+	registry := NewEncoderRegistry()
+	registry.Register(CSVEncoder{})
+	registry.Register(plainEncoder{})
+
+	if enc, ok := registry.Negotiate("text/plain"); !ok || enc.ContentType() != "text/plain" {
+		t.Errorf("expected the new encoder, got %v", enc)
+	}
+	if enc, _ := registry.Negotiate("text/*"); enc.ContentType() != (CSVEncoder{}).ContentType() {
+		t.Errorf("expected CSV, which was registered first, got %v", enc.ContentType())
+	}
+	if _, ok := registry.Negotiate("application/json;q=0, */*;q=0"); ok {
+		t.Error("expected no encoder when everything is refused")
+	}
+	if _, ok := DefaultEncoders.Lookup("text/plain"); ok {
+		t.Error("expected the default encoders to be unchanged")
+	}
+
+	tools := Tools{Encoders: registry}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "text/plain")
+	rr := httptest.NewRecorder()
+	if err := tools.WriteResponse(rr, req, http.StatusCreated, "hello"); err != nil || rr.Code != http.StatusCreated || rr.Body.String() != "hello" {
+		t.Errorf("unexpected response %d %q, %v", rr.Code, rr.Body.String(), err)
+	}
+}
+
+// plainEncoder sends strings as text/plain
+type plainEncoder struct{}
+
+func (plainEncoder) ContentType() string { return "text/plain" }
+
+func (plainEncoder) Encode(w io.Writer, data interface{}) error {
+	_, err := fmt.Fprint(w, data)
+	return err
+}
+
+func (plainEncoder) Decode(r io.Reader, data interface{}) error {
+	text, err := io.ReadAll(r)
+	*data.(*string) = string(text)
+	return err
+}
+
+// TestMessagePackEncoder tests the wire format of MessagePack
+func TestMessagePackEncoder(t *testing.T) {
+	tests := []struct {
+		value   interface{}
+		encoded string
+	}{
+		{nil, "c0"},
+		{true, "c3"},
+		{5, "05"},
+		{-5, "fb"},
+		{200, "ccc8"},
+		{-200, "d1ff38"},
+		{70000, "ce00011170"},
+		{int64(math.MaxInt64), "cf7fffffffffffffff"},
+		{1.5, "cb3ff8000000000000"},
+		{"hi", "a26869"},
+		{strings.Repeat("x", 40), "d928" + strings.Repeat("78", 40)},
+		{[]int{1, 2}, "920102"},
+		{map[string]bool{"b": false, "a": true}, "82a161c3a162c2"},
+		{testExtra{Color: "red"}, "81a5636f6c6f72a3726564"},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := (MessagePackEncoder{}).Encode(&out, tt.value); err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(out.Bytes()); got != tt.encoded {
+			t.Errorf("%v: expected %s, got %s", tt.value, tt.encoded, got)
+		}
+	}
+
+	// Formats the encoder does not produce are read as well
+	decode := func(encoded string, data interface{}) error {
+		raw, _ := hex.DecodeString(encoded)
+		return MessagePackEncoder{}.Decode(bytes.NewReader(raw), data)
+	}
+
+	var value map[string]interface{}
+	if err := decode("83a1610ca162ca3fc00000a163c403010203", &value); err != nil {
+		t.Fatal(err)
+	}
+	if value["a"] != float64(12) || value["b"] != float64(1.5) || value["c"] != "AQID" {
+		t.Errorf("unexpected value %v", value)
+	}
+
+	for _, bad := range []string{"", "92 01", "c1", "d4 01 02", "a3 61", "01 02"} {
+		var v interface{}
+		if err := decode(strings.ReplaceAll(bad, " ", ""), &v); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package toolbox
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"syscall"
+)
+
+// ErrorCode is the HTTP status and the stable, machine readable code ErrorJSON reports for an error
+type ErrorCode struct {
+	Status int    // HTTP status code
+	Code   string // e.g. "upload_not_found"; sent as the code member of the response
+}
+
+// errorCatalogEntry maps the errors match accepts to code
+type errorCatalogEntry struct {
+	match func(error) bool
+	code  ErrorCode
+}
+
+// ErrorCatalog maps errors to HTTP status codes and error codes. ErrorJSON uses the catalog of Tools
+// to pick the status of an error when none is given, and sends the code with the error. Errors are
+// matched with errors.Is or errors.As, so ErrorResponse and other wrapped errors are found by the
+// error they wrap. Entries registered later take precedence, so registering an error again
+// overrides its earlier entry.
+type ErrorCatalog struct {
+	mu      sync.RWMutex
+	entries []errorCatalogEntry
+}
+
+// DefaultErrorCatalog is used by Tools without an ErrorCatalog. It knows the errors of this package;
+// register your own errors with it, or give Tools a catalog of its own.
+var DefaultErrorCatalog = NewErrorCatalog()
+
+// NewErrorCatalog returns a catalog of the errors of this package
+func NewErrorCatalog() *ErrorCatalog {
+	ec := &ErrorCatalog{}
+
+	ec.Register(ErrFileCreation, http.StatusInternalServerError, "file_creation_failed")
+	ec.Register(ErrFileSizeExceeded, http.StatusRequestEntityTooLarge, "file_too_large")
+	ec.Register(ErrBatchSizeExceeded, http.StatusRequestEntityTooLarge, "batch_too_large")
+	ec.Register(ErrInvalidFileType, http.StatusUnsupportedMediaType, "unsupported_file_type")
+	ec.Register(ErrMaxUploadExceeded, http.StatusBadRequest, "too_many_files")
+	ec.Register(ErrContentVerification, http.StatusUnprocessableEntity, "content_verification_failed")
+	ec.Register(ErrNoFileUploaded, http.StatusBadRequest, "no_file_uploaded")
+	ec.Register(ErrChecksumMismatch, http.StatusBadRequest, "checksum_mismatch")
+	ec.Register(ErrInvalidChecksum, http.StatusBadRequest, "invalid_checksum")
+	ec.Register(ErrUploadNotFound, http.StatusNotFound, "upload_not_found")
+	ec.Register(ErrUploadExists, http.StatusConflict, "upload_exists")
+	ec.Register(ErrInvalidUploadID, http.StatusBadRequest, "invalid_upload_id")
+	ec.Register(ErrInvalidUploadState, http.StatusConflict, "invalid_upload_state")
+	ec.Register(ErrInvalidChunkNumber, http.StatusBadRequest, "invalid_chunk_number")
+	ec.Register(ErrMissingChunks, http.StatusConflict, "missing_chunks")
+	ec.Register(ErrInvalidSignature, http.StatusForbidden, "invalid_signature")
+	ec.Register(ErrLinkExpired, http.StatusGone, "link_expired")
+	ec.Register(ErrDownloadLimitReached, http.StatusGone, "download_limit_reached")
+	ec.Register(ErrNotAcceptable, http.StatusNotAcceptable, "not_acceptable")
+	ec.Register(ErrUnsupportedMedia, http.StatusUnsupportedMediaType, "unsupported_media_type")
+	ec.Register(ErrInsufficientStorage, http.StatusInsufficientStorage, "insufficient_storage")
+	ec.Register(syscall.ENOSPC, http.StatusInsufficientStorage, "insufficient_storage")
+
+	ec.RegisterFunc(func(err error) bool {
+		var checksumErr *ChecksumError
+		return errors.As(err, &checksumErr)
+	}, http.StatusUnprocessableEntity, "checksum_mismatch")
+
+	ec.RegisterFunc(func(err error) bool {
+		var maxBytesErr *http.MaxBytesError
+		return errors.As(err, &maxBytesErr)
+	}, http.StatusRequestEntityTooLarge, "request_too_large")
+
+	ec.RegisterFunc(func(err error) bool {
+		var jsonErr *JSONError
+		return errors.As(err, &jsonErr)
+	}, http.StatusBadRequest, "invalid_json")
+
+	ec.RegisterFunc(func(err error) bool {
+		var jsonErr *JSONError
+		return errors.As(err, &jsonErr) && jsonErr.Kind == JSONErrorTooLarge
+	}, http.StatusRequestEntityTooLarge, "request_too_large")
+
+	ec.RegisterFunc(func(err error) bool {
+		var validationErrs ValidationErrors
+		return errors.As(err, &validationErrs)
+	}, http.StatusUnprocessableEntity, "validation_failed")
+
+	return ec
+}
+
+// Register maps errors that match target, as reported by errors.Is, to status and code
+func (ec *ErrorCatalog) Register(target error, status int, code string) {
+	ec.RegisterFunc(func(err error) bool {
+		return errors.Is(err, target)
+	}, status, code)
+}
+
+// RegisterFunc maps errors for which match returns true to status and code, e.g. errors of a type
+// found with errors.As
+func (ec *ErrorCatalog) RegisterFunc(match func(error) bool, status int, code string) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	ec.entries = append(ec.entries, errorCatalogEntry{
+		match: match,
+		code:  ErrorCode{Status: status, Code: code},
+	})
+}
+
+// Lookup returns the status and code of err, and whether the catalog knows err
+func (ec *ErrorCatalog) Lookup(err error) (ErrorCode, bool) {
+	if err == nil {
+		return ErrorCode{}, false
+	}
+
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+
+	for i := len(ec.entries) - 1; i >= 0; i-- {
+		if ec.entries[i].match(err) {
+			return ec.entries[i].code, true
+		}
+	}
+
+	return ErrorCode{}, false
+}
+
+// errorCatalog returns t.ErrorCatalog, or DefaultErrorCatalog if it is not set
+func (t *Tools) errorCatalog() *ErrorCatalog {
+	if t.ErrorCatalog != nil {
+		return t.ErrorCatalog
+	}
+	return DefaultErrorCatalog
+}
+
+// fileCreationError reports a failure to write an upload to disk, as ErrInsufficientStorage if the
+// disk is full. Clients are only sent message, as err may name paths on the server; err is kept in
+// Err for logging.
+func fileCreationError(err error, message string) error {
+	sentinel := ErrFileCreation
+	if errors.Is(err, syscall.ENOSPC) {
+		sentinel = ErrInsufficientStorage
+	}
+
+	return &ErrorResponse{
+		Err:     fmt.Errorf("%w: %s: %w", sentinel, message, err),
+		Message: message,
+	}
+}
@@ -0,0 +1,102 @@
+package toolbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestTools_ErrorJSON_Catalog tests the status and code ErrorJSON picks for known errors
+func TestTools_ErrorJSON_Catalog(t *testing.T) {
+	var tools Tools
+
+	tests := []struct {
+		name   string
+		err    error
+		status []int
+		want   int
+		code   string
+	}{
+		{name: "batch size", err: &ErrorResponse{Err: ErrBatchSizeExceeded, Message: "too much"}, want: http.StatusRequestEntityTooLarge, code: "batch_too_large"},
+		{name: "wrapped file type", err: fmt.Errorf("upload: %w", ErrInvalidFileType), want: http.StatusUnsupportedMediaType, code: "unsupported_file_type"},
+		{name: "unknown upload", err: ErrUploadNotFound, want: http.StatusNotFound, code: "upload_not_found"},
+		{name: "disk full", err: &os.PathError{Op: "write", Path: "/uploads/a", Err: syscall.ENOSPC}, want: http.StatusInsufficientStorage, code: "insufficient_storage"},
+		{name: "disk full on chunk", err: fileCreationError(syscall.ENOSPC, "failed to save chunk"), want: http.StatusInsufficientStorage, code: "insufficient_storage"},
+		{name: "file creation", err: fileCreationError(os.ErrPermission, "failed to save chunk"), want: http.StatusInternalServerError, code: "file_creation_failed"},
+		{name: "validation", err: ValidationErrors{"name": {"is required"}}, want: http.StatusUnprocessableEntity, code: "validation_failed"},
+		{name: "json too large", err: &JSONError{Kind: JSONErrorTooLarge}, want: http.StatusRequestEntityTooLarge, code: "request_too_large"},
+		{name: "json syntax", err: &JSONError{Kind: JSONErrorSyntax}, want: http.StatusBadRequest, code: "invalid_json"},
+		{name: "invalid checksum", err: &ErrorResponse{Err: ErrInvalidChecksum, Message: "bad"}, want: http.StatusBadRequest, code: "invalid_checksum"},
+		{name: "chunk checksum", err: &ChecksumError{Chunks: []int64{2}}, want: http.StatusUnprocessableEntity, code: "checksum_mismatch"},
+		{name: "unknown error", err: errors.New("something else"), want: http.StatusBadRequest},
+		{name: "explicit status", err: ErrUploadNotFound, status: []int{http.StatusGone}, want: http.StatusGone, code: "upload_not_found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			tools.ErrorJSON(rr, tt.err, tt.status...)
+
+			var payload JSONResponse
+			if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+				t.Fatal(err)
+			}
+			if rr.Code != tt.want || payload.Code != tt.code {
+				t.Errorf("expected %d %q, got %d %q", tt.want, tt.code, rr.Code, payload.Code)
+			}
+		})
+	}
+
+	// Running out of space still counts as failing to create the file
+	if !errors.Is(fileCreationError(syscall.ENOSPC, "failed"), ErrFileCreation) {
+		t.Error("expected ErrInsufficientStorage to wrap ErrFileCreation")
+	}
+
+	// Paths on the server are kept for logs, not sent to the client
+	cause := &os.PathError{Op: "open", Path: "/srv/uploads/temp_chunked_1", Err: os.ErrPermission}
+	err := fileCreationError(cause, "failed to create temporary file")
+	if !errors.Is(err, os.ErrPermission) || !strings.Contains(errors.Unwrap(err).Error(), cause.Path) {
+		t.Errorf("expected the cause to be wrapped, got %v", errors.Unwrap(err))
+	}
+
+	rr := httptest.NewRecorder()
+	tools.ErrorJSON(rr, err)
+	if strings.Contains(rr.Body.String(), "/srv/uploads") || !strings.Contains(rr.Body.String(), "failed to create temporary file") {
+		t.Errorf("unexpected response %s", rr.Body.String())
+	}
+}
+
+// TestErrorCatalog_Register tests adding errors to a catalog and overriding the defaults
+func TestErrorCatalog_Register(t *testing.T) {
+	errPaymentRequired := errors.New("payment required")
+
+	catalog := NewErrorCatalog()
+	catalog.Register(errPaymentRequired, http.StatusPaymentRequired, "payment_required")
+	catalog.Register(ErrUploadNotFound, http.StatusGone, "upload_gone")
+
+	tools := Tools{ErrorCatalog: catalog, ProblemDetails: true}
+
+	rr := httptest.NewRecorder()
+	tools.ErrorJSON(rr, fmt.Errorf("checkout: %w", errPaymentRequired))
+	if members := decodeProblem(t, rr); rr.Code != http.StatusPaymentRequired || members["code"] != "payment_required" {
+		t.Errorf("unexpected response %d %v", rr.Code, members)
+	}
+
+	if code, ok := catalog.Lookup(ErrUploadNotFound); !ok || code != (ErrorCode{http.StatusGone, "upload_gone"}) {
+		t.Errorf("expected the later entry to win, got %+v", code)
+	}
+
+	// Other catalogs are not affected
+	if code, _ := DefaultErrorCatalog.Lookup(ErrUploadNotFound); code.Status != http.StatusNotFound {
+		t.Errorf("expected the default catalog to be unchanged, got %+v", code)
+	}
+	if _, ok := DefaultErrorCatalog.Lookup(errPaymentRequired); ok {
+		t.Error("expected the default catalog not to know the new error")
+	}
+}
@@ -0,0 +1,288 @@
+package toolbox
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultChunkUploadTTL = 24 * time.Hour
+
+// JanitorReport describes what PurgeExpiredUploads removed
+type JanitorReport struct {
+	ExpiredUploads    []string // IDs of the chunked uploads that were expired and had their chunks removed
+	PurgedSessions    []string // IDs of finished sessions that were deleted from the session store
+	OrphanedTempFiles []string // Paths of the temporary files that were removed
+	ContentChunks     []string // Hashes of the content chunks that were not used for ContentChunkTTL
+	BytesFreed        int64    // Total size of everything that was removed
+}
+
+// chunkUploadTTL returns how long an inactive upload is kept
+func (t *Tools) chunkUploadTTL() time.Duration {
+	if t.ChunkUploadTTL > 0 {
+		return t.ChunkUploadTTL
+	}
+	return defaultChunkUploadTTL
+}
+
+// PurgeExpiredUploads expires chunked uploads that have seen no activity for ChunkUploadTTL and
+// removes their chunks, as well as stale chunk directories that have no session at all. Sessions
+// that finished more than ChunkUploadTTL ago are deleted from the session store.
+//
+// Temporary files left behind by interrupted uploads that are older than the same TTL are removed
+// too: the temp_ files in TempFilePath written by UploadFiles, and the temp_chunked_ files in
+// UploadPath written by CompleteChunkedUpload.
+//
+// Content-defined chunks that have not been uploaded or reused for ContentChunkTTL are removed.
+func (t *Tools) PurgeExpiredUploads() (*JanitorReport, error) {
+	report := &JanitorReport{}
+	cutoff := time.Now().Add(-t.chunkUploadTTL())
+	store := t.sessionStore()
+
+	sessions, err := store.List(UploadSessionFilter{})
+	if err != nil {
+		return report, err
+	}
+
+	known := make(map[string]bool, len(sessions))
+	for _, session := range sessions {
+		known[session.ID] = true
+
+		if session.State.Terminal() {
+			if session.UpdatedAt.Before(cutoff) && store.Delete(session.ID) == nil {
+				report.PurgedSessions = append(report.PurgedSessions, session.ID)
+			}
+			continue
+		}
+
+		if size, ok := t.expireUploadIfStale(session.ID, cutoff); ok {
+			report.ExpiredUploads = append(report.ExpiredUploads, session.ID)
+			report.BytesFreed += size
+		}
+	}
+
+	if t.ChunksDirectory != "" {
+		entries, err := os.ReadDir(t.ChunksDirectory)
+		if err != nil && !os.IsNotExist(err) {
+			return report, &ErrorResponse{
+				Err:     fmt.Errorf("failed to read chunks directory: %w", err),
+				Message: "failed to read chunks directory",
+			}
+		}
+
+		// Chunk directories without a session, e.g. from a store that was reset
+		for _, entry := range entries {
+			if !entry.IsDir() || known[entry.Name()] || validateUploadID(entry.Name()) != nil {
+				continue
+			}
+
+			if size, ok := t.expireUploadIfStale(entry.Name(), cutoff); ok {
+				report.ExpiredUploads = append(report.ExpiredUploads, entry.Name())
+				report.BytesFreed += size
+			}
+		}
+	}
+
+	if t.TempFilePath != "" {
+		t.purgeTempFiles(report, t.TempFilePath, "temp_", cutoff)
+	}
+
+	if t.UploadPath != "" {
+		t.purgeTempFiles(report, t.UploadPath, "temp_chunked_", cutoff)
+	}
+
+	if t.SessionStore == nil && t.ChunksDirectory != "" {
+		t.purgeTempFiles(report, filepath.Join(t.ChunksDirectory, ".sessions"), "temp_session_", cutoff)
+	}
+
+	if t.ChunksDirectory != "" {
+		t.purgeContentChunks(report, cutoff)
+	}
+
+	return report, nil
+}
+
+// expireUploadIfStale removes the chunks of uploadID and marks its session as expired if its last
+// activity is before cutoff. It returns the number of bytes freed and whether the upload expired.
+func (t *Tools) expireUploadIfStale(uploadID string, cutoff time.Time) (int64, bool) {
+	unlock := t.lockUpload(uploadID)
+	defer unlock()
+
+	store := t.sessionStore()
+	session, err := store.Get(uploadID)
+	if err != nil && !errors.Is(err, ErrUploadNotFound) {
+		return 0, false
+	}
+
+	var lastActivity time.Time
+	if session != nil {
+		// The session may have finished since it was listed
+		if session.State.Terminal() {
+			return 0, false
+		}
+		lastActivity = session.UpdatedAt
+	}
+
+	chunksDir := filepath.Join(t.ChunksDirectory, uploadID)
+	lastActivity, size := lastUploadActivity(chunksDir, lastActivity)
+	if !lastActivity.Before(cutoff) {
+		return 0, false
+	}
+
+	if session != nil {
+		if err := session.Transition(UploadStateExpired); err != nil {
+			return 0, false
+		}
+		if err := store.Save(session); err != nil {
+			return 0, false
+		}
+		t.publishStateChange(session)
+	}
+
+	if err := os.RemoveAll(chunksDir); err != nil {
+		return 0, false
+	}
+
+	return size, true
+}
+
+// lastUploadActivity returns the most recent of since and the modification times of the chunks,
+// along with the total size of the upload directory
+func lastUploadActivity(chunksDir string, since time.Time) (time.Time, int64) {
+	last := since
+
+	var size int64
+	filepath.WalkDir(chunksDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+		if !d.IsDir() {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return last, size
+}
+
+// purgeTempFiles removes the files in dir whose name starts with prefix and that were last
+// modified before cutoff
+func (t *Tools) purgeTempFiles(report *JanitorReport, dir, prefix string, cutoff time.Time) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		if err := os.Remove(path); err == nil {
+			report.OrphanedTempFiles = append(report.OrphanedTempFiles, path)
+			report.BytesFreed += info.Size()
+		}
+	}
+}
+
+// purgeContentChunks removes content chunks that were neither uploaded nor used since
+// ContentChunkTTL, along with temporary files of chunk uploads older than cutoff
+func (t *Tools) purgeContentChunks(report *JanitorReport, cutoff time.Time) {
+	casDir := filepath.Join(t.ChunksDirectory, ".cas")
+	chunkCutoff := time.Now().Add(-t.contentChunkTTL())
+
+	dirs, err := os.ReadDir(casDir)
+	if err != nil {
+		return
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		prefixDir := filepath.Join(casDir, dir.Name())
+		t.purgeTempFiles(report, prefixDir, "temp_chunk_", cutoff)
+
+		entries, err := os.ReadDir(prefixDir)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			if !contentHashPattern.MatchString(entry.Name()) {
+				continue
+			}
+
+			info, err := entry.Info()
+			if err != nil || !info.ModTime().Before(chunkCutoff) {
+				continue
+			}
+
+			if err := os.Remove(filepath.Join(prefixDir, entry.Name())); err == nil {
+				report.ContentChunks = append(report.ContentChunks, entry.Name())
+				report.BytesFreed += info.Size()
+			}
+		}
+	}
+}
+
+// StartUploadJanitor runs PurgeExpiredUploads every interval in a background goroutine until the
+// returned stop function is called. The optional onReport callback receives the result of each run.
+// Stop waits for a run in progress to finish and may be called more than once.
+func (t *Tools) StartUploadJanitor(interval time.Duration, onReport ...func(*JanitorReport, error)) (stop func()) {
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				report, err := t.PurgeExpiredUploads()
+				if len(onReport) > 0 && onReport[0] != nil {
+					onReport[0](report, err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-finished
+		})
+	}
+}
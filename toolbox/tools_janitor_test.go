@@ -0,0 +1,193 @@
+package toolbox
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ageTree sets the modification time of path and everything under it
+func ageTree(t *testing.T, path string, mtime time.Time) {
+	t.Helper()
+
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(p, mtime, mtime)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ageSession moves the last update of a session back to mtime
+func ageSession(t *testing.T, tools *Tools, uploadID string, mtime time.Time) {
+	t.Helper()
+
+	session, err := tools.GetUploadSession(uploadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.UpdatedAt = mtime
+	if err := tools.sessionStore().Save(session); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTools_PurgeExpiredUploads tests that stale uploads and orphaned temp files are removed
+func TestTools_PurgeExpiredUploads(t *testing.T) {
+	setupTestDir(t, "./testdata/chunks/")
+	defer cleanupTestDir(t, "./testdata/chunks/")
+	setupTestDir(t, "./testdata/uploads/")
+	defer cleanupTestDir(t, "./testdata/uploads/")
+	setupTestDir(t, "./testdata/temp/")
+	defer cleanupTestDir(t, "./testdata/temp/")
+
+	tools := Tools{
+		ChunksDirectory: "./testdata/chunks/",
+		UploadPath:      "./testdata/uploads/",
+		TempFilePath:    "./testdata/temp/",
+		ChunkUploadTTL:  time.Hour,
+	}
+	old := time.Now().Add(-2 * time.Hour)
+
+	// A stale upload
+	if err := tools.UploadChunk("stale", "stale.bin", 1, 2, []byte("stale data")); err != nil {
+		t.Fatal(err)
+	}
+	ageSession(t, &tools, "stale", old)
+	ageTree(t, filepath.Join(tools.ChunksDirectory, "stale"), old)
+
+	// An upload whose assembly was interrupted, e.g. by a crash
+	if err := tools.UploadChunk("stuck", "stuck.bin", 0, 2, []byte("stuck data")); err != nil {
+		t.Fatal(err)
+	}
+	stuck, _ := tools.GetUploadSession("stuck")
+	stuck.State = UploadStateCompleting
+	stuck.UpdatedAt = old
+	tools.sessionStore().Save(stuck)
+	ageTree(t, filepath.Join(tools.ChunksDirectory, "stuck"), old)
+
+	// Chunks left without any session
+	if err := os.MkdirAll(filepath.Join(tools.ChunksDirectory, "orphan"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(tools.ChunksDirectory, "orphan", "0"), []byte("orphan"), 0644)
+	ageTree(t, filepath.Join(tools.ChunksDirectory, "orphan"), old)
+
+	// A session that was completed long ago
+	if err := tools.InitChunkedUpload("finished", "finished.bin", 1); err != nil {
+		t.Fatal(err)
+	}
+	session, _ := tools.GetUploadSession("finished")
+	session.State = UploadStateCompleted
+	session.UpdatedAt = old
+	tools.sessionStore().Save(session)
+
+	// An upload that is still active
+	if err := tools.UploadChunk("active", "active.bin", 0, 2, []byte("active data")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Temporary files, old and new, plus a user file that happens to look like one
+	files := map[string]bool{
+		filepath.Join(tools.TempFilePath, "temp_old.png"):       true,
+		filepath.Join(tools.TempFilePath, "temp_new.png"):       false,
+		filepath.Join(tools.UploadPath, "temp_chunked_1234"):    true,
+		filepath.Join(tools.UploadPath, "temp_user_upload.txt"): false,
+	}
+	for path, orphaned := range files {
+		if err := os.WriteFile(path, []byte("temp"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if orphaned || filepath.Base(path) == "temp_user_upload.txt" {
+			os.Chtimes(path, old, old)
+		}
+	}
+
+	report, err := tools.PurgeExpiredUploads()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.ExpiredUploads) != 3 {
+		t.Errorf("expected the stale, stuck and orphaned uploads to expire, got %v", report.ExpiredUploads)
+	}
+	if len(report.PurgedSessions) != 1 || report.PurgedSessions[0] != "finished" {
+		t.Errorf("expected the finished session to be purged, got %v", report.PurgedSessions)
+	}
+	if len(report.OrphanedTempFiles) != 2 {
+		t.Errorf("expected 2 orphaned temp files, got %v", report.OrphanedTempFiles)
+	}
+	if report.BytesFreed == 0 {
+		t.Error("expected freed bytes to be reported")
+	}
+
+	if _, err := os.Stat(filepath.Join(tools.ChunksDirectory, "stale")); !os.IsNotExist(err) {
+		t.Error("stale upload should be removed")
+	}
+	if _, err := os.Stat(filepath.Join(tools.ChunksDirectory, "active")); err != nil {
+		t.Error("active upload should be kept")
+	}
+	if session, err := tools.GetUploadSession("stale"); err != nil || session.State != UploadStateExpired {
+		t.Errorf("stale session should be expired, got %v", err)
+	}
+	if session, err := tools.GetUploadSession("stuck"); err != nil || session.State != UploadStateExpired {
+		t.Errorf("stuck session should be expired, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tools.ChunksDirectory, "stuck")); !os.IsNotExist(err) {
+		t.Error("stuck upload should be removed")
+	}
+	if _, err := tools.GetUploadSession("finished"); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("finished session should be deleted, got %v", err)
+	}
+	for path, orphaned := range files {
+		_, err := os.Stat(path)
+		if orphaned && !os.IsNotExist(err) {
+			t.Errorf("%s should be removed", path)
+		}
+		if !orphaned && err != nil {
+			t.Errorf("%s should be kept", path)
+		}
+	}
+}
+
+// TestTools_StartUploadJanitor tests the background janitor and its stop function
+func TestTools_StartUploadJanitor(t *testing.T) {
+	setupTestDir(t, "./testdata/chunks/")
+	defer cleanupTestDir(t, "./testdata/chunks/")
+
+	tools := Tools{
+		ChunksDirectory: "./testdata/chunks/",
+		ChunkUploadTTL:  time.Minute,
+	}
+
+	if err := tools.UploadChunk("abandoned", "file.bin", 0, 2, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	ageSession(t, &tools, "abandoned", old)
+	ageTree(t, filepath.Join(tools.ChunksDirectory, "abandoned"), old)
+
+	reports := make(chan *JanitorReport, 10)
+	stop := tools.StartUploadJanitor(10*time.Millisecond, func(report *JanitorReport, err error) {
+		if err == nil {
+			reports <- report
+		}
+	})
+
+	select {
+	case report := <-reports:
+		if len(report.ExpiredUploads) != 1 {
+			t.Errorf("expected the abandoned upload to be purged, got %v", report.ExpiredUploads)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("janitor did not run")
+	}
+
+	stop()
+	stop()
+}
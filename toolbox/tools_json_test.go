@@ -6,6 +6,7 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -110,3 +111,87 @@ func TestTools_ErrorJSON(t *testing.T) {
 		t.Errorf("wrong status code returned; expected 503, but got %d", rr.Code)
 	}
 }
+
+func TestTools_ReadJSON_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		json     string
+		kind     JSONErrorKind
+		path     string
+		line     int
+		column   int
+		expected string
+		actual   string
+	}{
+		{name: "syntax", json: "{\n  \"foo\": \"bar\",\n  \"age\": 3x\n}", kind: JSONErrorSyntax, line: 3, column: 12},
+		{name: "incomplete", json: `{"foo": "bar"`, kind: JSONErrorSyntax, line: 1, column: 14},
+		{name: "type mismatch", json: "{\"foo\": \"bar\",\n\"address\": {\"zip\": \"12345\"}}", kind: JSONErrorTypeMismatch, path: "address.zip", line: 2, column: 27, expected: "int", actual: "string"},
+		{name: "unknown field", json: `{"foo": "bar", "colour": "red"}`, kind: JSONErrorUnknownField, path: "colour", line: 1, column: 16},
+		{name: "nested unknown field", json: "{\"foo\": \"plus4\",\n\"address\": {\"zip\": 1, \"plus4\": 2}}", kind: JSONErrorUnknownField, path: "address.plus4", line: 2, column: 23},
+		{name: "too large", json: `{"foo": "` + strings.Repeat("x", 100) + `"}`, kind: JSONErrorTooLarge, line: 1, column: 65},
+		{name: "empty", json: ``, kind: JSONErrorEmpty, line: 1, column: 1},
+		{name: "trailing data", json: `{"foo": "bar"}  {"foo": "baz"}`, kind: JSONErrorTrailingData, line: 1, column: 17},
+	}
+
+	testTools := Tools{MaxJSONSize: 64}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var payload struct {
+				Foo     string `json:"foo"`
+				Address struct {
+					Zip int `json:"zip"`
+				} `json:"address"`
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.json))
+			err := testTools.ReadJSON(httptest.NewRecorder(), req, &payload)
+
+			var jsonErr *JSONError
+			if !errors.As(err, &jsonErr) {
+				t.Fatalf("expected a JSONError, got %v", err)
+			}
+			if jsonErr.Kind != tt.kind || jsonErr.Path != tt.path || jsonErr.Expected != tt.expected || jsonErr.Actual != tt.actual {
+				t.Errorf("unexpected error %+v", jsonErr)
+			}
+			if jsonErr.Line != tt.line || jsonErr.Column != tt.column {
+				t.Errorf("expected line %d column %d, got %d:%d", tt.line, tt.column, jsonErr.Line, jsonErr.Column)
+			}
+		})
+	}
+}
+
+func TestTools_ErrorJSON_JSONError(t *testing.T) {
+	var testTools Tools
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"foo": 1}`))
+	var payload struct {
+		Foo string `json:"foo"`
+	}
+	err := testTools.ReadJSON(httptest.NewRecorder(), req, &payload)
+
+	rr := httptest.NewRecorder()
+	testTools.ErrorJSON(rr, err)
+
+	var response struct {
+		Message string                 `json:"message"`
+		Data    map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Data["kind"] != string(JSONErrorTypeMismatch) || response.Data["path"] != "foo" || response.Data["expected"] != "string" || response.Data["actual"] != "number" {
+		t.Errorf("unexpected details %v", response.Data)
+	}
+	if response.Data["error_type"] != "json_parsing_error" || response.Data["line"] != float64(1) {
+		t.Errorf("unexpected details %v", response.Data)
+	}
+
+	// Other errors mentioning JSON are not mistaken for parsing errors
+	rr = httptest.NewRecorder()
+	testTools.ErrorJSON(rr, errors.New("could not store JSON document"))
+	if strings.Contains(rr.Body.String(), "json_parsing_error") {
+		t.Errorf("unexpected details %s", rr.Body.String())
+	}
+}
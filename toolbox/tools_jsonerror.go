@@ -0,0 +1,267 @@
+package toolbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// JSONErrorKind tells what went wrong while reading a JSON body
+type JSONErrorKind string
+
+// Kinds of JSONError
+const (
+	JSONErrorSyntax       JSONErrorKind = "syntax"        // Malformed or incomplete JSON
+	JSONErrorTypeMismatch JSONErrorKind = "type_mismatch" // A value does not fit the field it is decoded into
+	JSONErrorUnknownField JSONErrorKind = "unknown_field" // A field the target does not have, see AllowUnknownFields
+	JSONErrorTooLarge     JSONErrorKind = "too_large"     // The body exceeds MaxJSONSize
+	JSONErrorEmpty        JSONErrorKind = "empty"         // The body is empty
+	JSONErrorTrailingData JSONErrorKind = "trailing_data" // Something follows the JSON value
+)
+
+// JSONError describes why ReadJSON could not decode a request body
+type JSONError struct {
+	Kind     JSONErrorKind `json:"kind"`
+	Path     string        `json:"path,omitempty"`     // Dotted path of the field, e.g. "address.zip", if known
+	Offset   int64         `json:"offset"`             // Byte offset in the body at which the problem was detected
+	Line     int           `json:"line"`               // Line of Offset, starting at 1
+	Column   int           `json:"column"`             // Column of Offset in characters, starting at 1
+	Expected string        `json:"expected,omitempty"` // Go type the value should have had, for type mismatches
+	Actual   string        `json:"actual,omitempty"`   // JSON type the value had, for type mismatches
+	Message  string        `json:"message"`
+	Err      error         `json:"-"` // The error returned by the decoder, if any
+}
+
+// Error implements the error interface
+func (je *JSONError) Error() string {
+	return je.Message
+}
+
+// Unwrap returns the decoder error
+func (je *JSONError) Unwrap() error {
+	return je.Err
+}
+
+// newJSONError builds a JSONError at offset in body
+func newJSONError(kind JSONErrorKind, body []byte, offset int64, err error, format string, args ...interface{}) *JSONError {
+	line, column := lineColumn(body, offset)
+	return &JSONError{
+		Kind:    kind,
+		Offset:  offset,
+		Line:    line,
+		Column:  column,
+		Message: fmt.Sprintf(format, args...),
+		Err:     err,
+	}
+}
+
+// decodeError describes an error of dec, which reads body, as a *JSONError where possible.
+// maxBytes is the size limit of body.
+func decodeError(err error, body []byte, dec *json.Decoder, maxBytes int) error {
+	var syntaxError *json.SyntaxError
+	var unmarshalTypeError *json.UnmarshalTypeError
+	var invalidUnmarshalError *json.InvalidUnmarshalError
+	var maxBytesError *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &syntaxError):
+		// Get the problematic part of the JSON
+		return newJSONError(JSONErrorSyntax, body, syntaxError.Offset, err,
+			"syntax error in JSON at position %d: %s", syntaxError.Offset, problemJSON(body, syntaxError.Offset))
+
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return newJSONError(JSONErrorSyntax, body, int64(len(body)), err, "JSON is incomplete or malformed")
+
+	case errors.As(err, &unmarshalTypeError):
+		jsonErr := newJSONError(JSONErrorTypeMismatch, body, unmarshalTypeError.Offset, err,
+			"incorrect data type at position %d", unmarshalTypeError.Offset)
+		jsonErr.Path = unmarshalTypeError.Field
+		jsonErr.Expected = unmarshalTypeError.Type.String()
+		jsonErr.Actual = unmarshalTypeError.Value
+		if unmarshalTypeError.Field != "" {
+			jsonErr.Message = fmt.Sprintf("incorrect data type for field '%s' - expected %s but got %s",
+				unmarshalTypeError.Field, unmarshalTypeError.Type, unmarshalTypeError.Value)
+		}
+		return jsonErr
+
+	case errors.Is(err, io.EOF):
+		return newJSONError(JSONErrorEmpty, body, 0, err, "request body is empty - JSON data required")
+
+	case strings.HasPrefix(err.Error(), "json: unknown field"):
+		fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		key, unquoteErr := strconv.Unquote(fieldName)
+		if unquoteErr != nil {
+			key = strings.Trim(fieldName, `"`)
+		}
+
+		// The decoder reports the field after reading on, point at the field itself
+		offset := dec.InputOffset()
+		path := key
+		if keyPath, keyOffset, ok := jsonKeyPath(body[:offset], key); ok {
+			path, offset = keyPath, keyOffset
+		}
+
+		jsonErr := newJSONError(JSONErrorUnknownField, body, offset, err, "unknown field in JSON: %s", fieldName)
+		jsonErr.Path = path
+		return jsonErr
+
+	case errors.As(err, &maxBytesError):
+		return newJSONError(JSONErrorTooLarge, body, maxBytesError.Limit, err,
+			"JSON data exceeds maximum size of %d bytes", maxBytes)
+
+	case errors.As(err, &invalidUnmarshalError):
+		return fmt.Errorf("error unmarshalling JSON: %w", err)
+
+	default:
+		return fmt.Errorf("error parsing JSON: %w", err)
+	}
+}
+
+// jsonKeyPath finds the last object key named key in body and returns its dotted path, e.g.
+// "address.zip", and its offset. Array indexes are left out of the path, as they are in the Field
+// of a json.UnmarshalTypeError.
+func jsonKeyPath(body []byte, key string) (string, int64, bool) {
+	type frame struct {
+		object  bool
+		wantKey bool
+		key     string
+	}
+
+	var stack []frame
+	var path string
+	var offset int64
+	found := false
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	for {
+		start := dec.InputOffset()
+		tok, err := dec.Token()
+		if err != nil {
+			return path, offset, found
+		}
+
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			stack = append(stack, frame{object: tok == json.Delim('{'), wantKey: true})
+			continue
+		case json.Delim('}'), json.Delim(']'):
+			stack = stack[:len(stack)-1]
+			if n := len(stack); n > 0 {
+				stack[n-1].wantKey = true
+			}
+			continue
+		}
+
+		n := len(stack)
+		if n == 0 || !stack[n-1].object {
+			continue
+		}
+		if !stack[n-1].wantKey {
+			stack[n-1].wantKey = true
+			continue
+		}
+
+		stack[n-1].key, stack[n-1].wantKey = tok.(string), false
+		if tok != key {
+			continue
+		}
+
+		var keys []string
+		for _, f := range stack {
+			if f.object {
+				keys = append(keys, f.key)
+			}
+		}
+		path, found = strings.Join(keys, "."), true
+
+		// Token skips the separator before the key
+		offset = start
+		if i := bytes.IndexByte(body[start:], '"'); i >= 0 {
+			offset += int64(i)
+		}
+	}
+}
+
+// jsonErrorHelp suggests a fix for each kind of JSONError
+var jsonErrorHelp = map[JSONErrorKind]string{
+	JSONErrorSyntax:       "Check your JSON syntax, especially quotes, commas, and brackets",
+	JSONErrorTypeMismatch: "Check the type of the value, e.g. numbers must not be quoted",
+	JSONErrorUnknownField: "Remove the field or check its spelling",
+	JSONErrorTooLarge:     "Send less data in a single request",
+	JSONErrorEmpty:        "Send a JSON value in the request body",
+	JSONErrorTrailingData: "Send a single JSON value, e.g. wrap several objects in an array",
+}
+
+// jsonErrorDetails returns the data field sent by ErrorJSON for je
+func jsonErrorDetails(je *JSONError) map[string]interface{} {
+	details := map[string]interface{}{
+		"error_type": "json_parsing_error",
+		"help":       jsonErrorHelp[je.Kind],
+		"kind":       je.Kind,
+		"offset":     je.Offset,
+		"line":       je.Line,
+		"column":     je.Column,
+	}
+
+	if je.Path != "" {
+		details["path"] = je.Path
+	}
+	if je.Expected != "" {
+		details["expected"] = je.Expected
+		details["actual"] = je.Actual
+	}
+
+	return details
+}
+
+// lineColumn returns the line and column of offset in body
+func lineColumn(body []byte, offset int64) (int, int) {
+	if offset > int64(len(body)) {
+		offset = int64(len(body))
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	before := body[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	lineStart := bytes.LastIndexByte(before, '\n') + 1
+
+	return line, utf8.RuneCount(before[lineStart:]) + 1
+}
+
+// problemJSON returns the part of body around offset, with the character at offset marked
+func problemJSON(body []byte, offset int64) string {
+	// Determine the context window (10 chars before and after the error)
+	start := int(offset) - 10
+	if start < 0 {
+		start = 0
+	}
+
+	end := int(offset) + 10
+	if end > len(body) {
+		end = len(body)
+	}
+	if start > end {
+		start = end
+	}
+
+	context := string(body[start:end])
+
+	// Mark the error position
+	position := int(offset) - start
+	if position >= 0 && position < len(context) {
+		return fmt.Sprintf("%s >>> %c <<< %s",
+			context[:position],
+			context[position],
+			context[position+1:])
+	}
+
+	return context
+}
@@ -0,0 +1,135 @@
+package toolbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"iter"
+	"net/http"
+)
+
+// defaultJSONSeqFlushEvery is how many items WriteJSONSeq sends between flushes if no FlushEvery is set
+const defaultJSONSeqFlushEvery = 100
+
+// jsonSeqBufferSize is the size of the buffer WriteJSONSeq collects items in between flushes
+const jsonSeqBufferSize = 32 * 1024
+
+// JSONSeqOptions controls the responses of WriteJSONSeq and WriteJSONSeq2
+type JSONSeqOptions struct {
+	Message    string      // Message of the response
+	FlushEvery int         // Items sent between flushes to the client; defaults to 100
+	Headers    http.Header // Headers added to the response
+}
+
+// WriteJSONSeq sends the items of a sequence as the data of a JSONResponse, encoding them one at a
+// time, so the whole result set is never held in memory. See WriteJSONSeq2 for how errors are sent.
+func WriteJSONSeq[T any](t *Tools, w http.ResponseWriter, status int, items iter.Seq[T], opts ...JSONSeqOptions) error {
+	return WriteJSONSeq2(t, w, status, func(yield func(T, error) bool) {
+		for item := range items {
+			if !yield(item, nil) {
+				return
+			}
+		}
+	}, opts...)
+}
+
+// WriteJSONSeq2 sends the items of a sequence as the data of a JSONResponse, encoding them one at a
+// time and flushing them to the client every options.FlushEvery items. The data array is sent
+// before the other fields, as in {"data": [...], "error": false, "message": "..."}.
+//
+// The sequence ends early if it yields an error or an item cannot be encoded. If nothing was sent
+// yet, the error is sent with ErrorJSON as usual. Otherwise status has already been sent, so the
+// array is closed after the last item that was sent, and the response ends with "error": true and
+// the message and code of the error; clients must check the error field, not only the status. In
+// both cases the error is returned. Errors writing to the client are returned as they are.
+func WriteJSONSeq2[T any](t *Tools, w http.ResponseWriter, status int, items iter.Seq2[T, error], opts ...JSONSeqOptions) error {
+	var options JSONSeqOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+
+	flushEvery := options.FlushEvery
+	if flushEvery <= 0 {
+		flushEvery = defaultJSONSeqFlushEvery
+	}
+
+	bw := bufio.NewWriterSize(w, jsonSeqBufferSize)
+	started := false
+	start := func() {
+		started = true
+		for key, value := range options.Headers {
+			w.Header()[key] = value
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		bw.WriteString(`{"data":[`)
+	}
+
+	count := 0
+	var seqErr error
+	for item, err := range items {
+		if err != nil {
+			seqErr = err
+			break
+		}
+
+		out, err := json.Marshal(item)
+		if err != nil {
+			seqErr = err
+			break
+		}
+
+		if !started {
+			start()
+		}
+		if count > 0 {
+			bw.WriteByte(',')
+		}
+		bw.Write(out)
+
+		count++
+		if count%flushEvery == 0 {
+			if err := flushJSONSeq(w, bw); err != nil {
+				return err
+			}
+		}
+	}
+
+	if seqErr != nil && !started {
+		t.ErrorJSON(w, seqErr)
+		return seqErr
+	}
+	if !started {
+		start()
+	}
+
+	// Close the array and send the other fields of the envelope
+	tail := JSONResponse{Message: options.Message}
+	if seqErr != nil {
+		_, tail = t.errorPayload(seqErr)
+		tail.Data = nil
+	}
+	out, err := json.Marshal(tail)
+	if err != nil {
+		return err
+	}
+	bw.WriteString("],")
+	bw.Write(out[1:])
+
+	if err := flushJSONSeq(w, bw); err != nil {
+		return err
+	}
+	return seqErr
+}
+
+// flushJSONSeq sends what bw holds and flushes w
+func flushJSONSeq(w http.ResponseWriter, bw *bufio.Writer) error {
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	if err := http.NewResponseController(w).Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
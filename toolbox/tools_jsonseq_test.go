@@ -0,0 +1,119 @@
+package toolbox
+
+import (
+	"encoding/json"
+	"errors"
+	"iter"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// countTo yields the numbers from 1 to n
+func countTo(n int) iter.Seq[int] {
+	return func(yield func(int) bool) {
+		for i := 1; i <= n; i++ {
+			if !yield(i) {
+				return
+			}
+		}
+	}
+}
+
+// TestWriteJSONSeq tests streaming a sequence inside a JSONResponse
+func TestWriteJSONSeq(t *testing.T) {
+	var tools Tools
+	rr := httptest.NewRecorder()
+
+	// Items are flushed before the sequence ends
+	flushedEarly := false
+	items := func(yield func(int) bool) {
+		for i := range countTo(250) {
+			if i == 200 {
+				flushedEarly = rr.Flushed && rr.Body.Len() > 0
+			}
+			if !yield(i) {
+				return
+			}
+		}
+	}
+
+	err := WriteJSONSeq(&tools, rr, http.StatusOK, items, JSONSeqOptions{
+		Message: "all numbers",
+		Headers: http.Header{"X-Total": {"250"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !flushedEarly {
+		t.Error("expected items to be flushed while the sequence runs")
+	}
+	if rr.Header().Get("Content-Type") != "application/json" || rr.Header().Get("X-Total") != "250" {
+		t.Errorf("unexpected headers %v", rr.Header())
+	}
+
+	var resp Response[[]int]
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rr.Body.String(), err)
+	}
+	if resp.Error || resp.Message != "all numbers" || len(resp.Data) != 250 || resp.Data[249] != 250 {
+		t.Errorf("unexpected response %v %q %d items", resp.Error, resp.Message, len(resp.Data))
+	}
+
+	// An empty sequence is an empty array
+	rr = httptest.NewRecorder()
+	if err := WriteJSONSeq(&tools, rr, http.StatusOK, countTo(0)); err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"data":[],"error":false,"message":""}`; rr.Body.String() != expected {
+		t.Errorf("expected %s, got %s", expected, rr.Body.String())
+	}
+}
+
+// TestWriteJSONSeq2_Errors tests errors before and during a stream
+func TestWriteJSONSeq2_Errors(t *testing.T) {
+	var tools Tools
+
+	// Nothing sent yet: a regular error response
+	rr := httptest.NewRecorder()
+	err := WriteJSONSeq2(&tools, rr, http.StatusOK, func(yield func(int, error) bool) {
+		yield(0, ErrUploadNotFound)
+	})
+	if !errors.Is(err, ErrUploadNotFound) || rr.Code != http.StatusNotFound {
+		t.Errorf("expected a 404 error response, got %d, %v", rr.Code, err)
+	}
+
+	// Mid-stream: the items sent so far, followed by the error
+	rr = httptest.NewRecorder()
+	err = WriteJSONSeq2(&tools, rr, http.StatusOK, func(yield func(int, error) bool) {
+		for i := range countTo(3) {
+			if !yield(i, nil) {
+				return
+			}
+		}
+		if yield(0, ErrUploadNotFound) {
+			t.Error("expected the sequence to stop after an error")
+		}
+	})
+	if !errors.Is(err, ErrUploadNotFound) || rr.Code != http.StatusOK {
+		t.Errorf("expected the error to be returned after a 200, got %d, %v", rr.Code, err)
+	}
+
+	var resp Response[[]int]
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rr.Body.String(), err)
+	}
+	if !resp.Error || resp.Message != "upload not found" || resp.Code != "upload_not_found" || len(resp.Data) != 3 {
+		t.Errorf("unexpected response %s", rr.Body.String())
+	}
+
+	// Items that cannot be encoded end the stream the same way
+	rr = httptest.NewRecorder()
+	err = WriteJSONSeq(&tools, rr, http.StatusOK, func(yield func(float64) bool) {
+		_ = yield(1) && yield(math.Inf(1)) && yield(2)
+	})
+	if err == nil || !json.Valid(rr.Body.Bytes()) {
+		t.Errorf("expected an error and valid JSON, got %v, %s", err, rr.Body.String())
+	}
+}
@@ -0,0 +1,468 @@
+package toolbox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"strings"
+)
+
+// NDJSONContentType is the media type of newline delimited JSON, also known as JSON Lines
+const NDJSONContentType = "application/x-ndjson"
+
+// JSONStreamOptions controls how JSONStream and ReadJSONStream read a request body
+type JSONStreamOptions struct {
+	MaxRecords    int   // Most records accepted; zero means unlimited
+	MaxRecordSize int   // Largest record in bytes; defaults to MaxJSONSize, or 1MB
+	MaxSize       int64 // Largest body in bytes; zero means unlimited
+
+	// SkipInvalid makes ReadJSONStream carry on after records that cannot be decoded or are
+	// invalid, and return them all as RecordErrors once the stream is read
+	SkipInvalid bool
+}
+
+// RecordError is a record of a JSON stream that could not be decoded or failed validation
+type RecordError struct {
+	Index int   // Position of the record in the stream, starting at 0
+	Line  int   // Line of the record in NDJSON, starting at 1; zero in a JSON array
+	Err   error // Why the record was rejected, e.g. a *JSONError or ValidationErrors
+}
+
+// Error implements the error interface
+func (re *RecordError) Error() string {
+	if re.Line > 0 {
+		return fmt.Sprintf("record %d (line %d): %v", re.Index, re.Line, re.Err)
+	}
+	return fmt.Sprintf("record %d: %v", re.Index, re.Err)
+}
+
+// Unwrap returns the error of the record
+func (re *RecordError) Unwrap() error {
+	return re.Err
+}
+
+// RecordErrors are the records ReadJSONStream skipped
+type RecordErrors []*RecordError
+
+// Error implements the error interface
+func (re RecordErrors) Error() string {
+	parts := make([]string, len(re))
+	for i, recordErr := range re {
+		parts[i] = recordErr.Error()
+	}
+	return fmt.Sprintf("%d invalid records: %s", len(re), strings.Join(parts, "; "))
+}
+
+// Unwrap returns the errors of the records
+func (re RecordErrors) Unwrap() []error {
+	errs := make([]error, len(re))
+	for i, recordErr := range re {
+		errs[i] = recordErr
+	}
+	return errs
+}
+
+// recordErrorDetails returns the data field sent by ErrorJSON for rejected records
+func recordErrorDetails(errs ...*RecordError) map[string]interface{} {
+	records := make([]map[string]interface{}, len(errs))
+	for i, recordErr := range errs {
+		record := map[string]interface{}{
+			"index":   recordErr.Index,
+			"message": recordErr.Err.Error(),
+		}
+		if recordErr.Line > 0 {
+			record["line"] = recordErr.Line
+		}
+		records[i] = record
+	}
+
+	return map[string]interface{}{
+		"error_type": "record_error",
+		"records":    records,
+	}
+}
+
+// JSONStream returns the records of the body of r, which holds either newline delimited JSON or a
+// JSON array, one at a time, so bulk requests are never held in memory at once. Each record is
+// decoded into a T and validated like ReadJSON does. A record that cannot be decoded or is invalid
+// is yielded as a *RecordError, and reading carries on with the next one. Other errors, such as
+// malformed arrays, exceeding the limits of opts or failing to read the body, end the sequence;
+// so does an element of an array far over MaxRecordSize, which is not read to its end.
+// Blank lines in NDJSON are ignored.
+func JSONStream[T any](t *Tools, w http.ResponseWriter, r *http.Request, opts ...JSONStreamOptions) iter.Seq2[T, error] {
+	var options JSONStreamOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+
+	return func(yield func(T, error) bool) {
+		var zero T
+		err := t.scanJSONStream(w, r, options, func(index, line int, raw []byte, err error) bool {
+			if err == nil {
+				var record T
+				if err = t.decodeRecord(raw, &record); err == nil {
+					return yield(record, nil)
+				}
+			}
+			return yield(zero, &RecordError{Index: index, Line: line, Err: err})
+		})
+		if err != nil {
+			yield(zero, err)
+		}
+	}
+}
+
+// ReadJSONStream calls fn with each record of the body of r, see JSONStream, and stops at the first
+// error fn returns. Records that cannot be decoded or are invalid stop the stream with a
+// *RecordError, unless options.SkipInvalid is set, in which case they are returned as RecordErrors
+// after the other records are read.
+func ReadJSONStream[T any](t *Tools, w http.ResponseWriter, r *http.Request, fn func(record T) error, opts ...JSONStreamOptions) error {
+	var options JSONStreamOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+
+	var skipped RecordErrors
+	for record, err := range JSONStream[T](t, w, r, options) {
+		if recordErr, ok := err.(*RecordError); ok && options.SkipInvalid {
+			skipped = append(skipped, recordErr)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+
+	if len(skipped) > 0 {
+		return skipped
+	}
+	return nil
+}
+
+// decodeRecord decodes and validates a single record of a JSON stream
+func (t *Tools) decodeRecord(raw []byte, record interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if !t.AllowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+
+	if err := dec.Decode(record); err != nil {
+		return decodeError(err, raw, dec, len(raw))
+	}
+
+	offset := dec.InputOffset()
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		for offset < int64(len(raw)) && strings.ContainsRune(" \t\r\n", rune(raw[offset])) {
+			offset++
+		}
+		return newJSONError(JSONErrorTrailingData, raw, offset, err, "record must contain only one JSON value")
+	}
+
+	return t.Validate(record)
+}
+
+// scanJSONStream splits the body of r into records and passes each to fn, with an error if the
+// record is too large, until fn returns false. It returns the error that ended the stream early.
+func (t *Tools) scanJSONStream(w http.ResponseWriter, r *http.Request, options JSONStreamOptions, fn func(index, line int, raw []byte, err error) bool) error {
+	maxRecordSize := options.MaxRecordSize
+	if maxRecordSize <= 0 {
+		maxRecordSize = 1024 * 1024
+		if t.MaxJSONSize != 0 {
+			maxRecordSize = t.MaxJSONSize
+		}
+	}
+
+	if options.MaxSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, options.MaxSize)
+	}
+	br := bufio.NewReader(r.Body)
+
+	index := 0
+	emit := func(line int, raw []byte, err error) (bool, error) {
+		if options.MaxRecords > 0 && index >= options.MaxRecords {
+			return false, &ErrorResponse{
+				Err:     ErrBatchSizeExceeded,
+				Message: fmt.Sprintf("stream exceeds the maximum of %d records", options.MaxRecords),
+			}
+		}
+		if err == nil && len(raw) > maxRecordSize {
+			err = recordTooLarge(maxRecordSize)
+		}
+
+		index++
+		return fn(index-1, line, raw, err), nil
+	}
+
+	first, err := peekNonSpace(br)
+	if err != nil {
+		return streamReadError(err, options.MaxSize)
+	}
+	if first == '[' {
+		return readJSONArray(br, maxRecordSize, options.MaxSize, emit)
+	}
+	return readNDJSON(br, maxRecordSize, options.MaxSize, emit)
+}
+
+// readNDJSON passes each non-blank line of br to emit. Lines longer than maxRecordSize are skipped
+// without being held in memory, and passed on with an error instead.
+func readNDJSON(br *bufio.Reader, maxRecordSize int, maxSize int64, emit func(line int, raw []byte, err error) (bool, error)) error {
+	for line := 1; ; line++ {
+		raw, tooLarge, err := readLine(br, maxRecordSize)
+		if err != nil && err != io.EOF {
+			return streamReadError(err, maxSize)
+		}
+
+		var recordErr error
+		if tooLarge {
+			recordErr = recordTooLarge(maxRecordSize)
+		}
+		if tooLarge || len(bytes.TrimSpace(raw)) > 0 {
+			more, emitErr := emit(line, raw, recordErr)
+			if emitErr != nil || !more {
+				return emitErr
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// readLine reads a line from br without its line ending. If the line is longer than limit, the
+// rest of it is discarded and tooLarge is set.
+func readLine(br *bufio.Reader, limit int) (line []byte, tooLarge bool, err error) {
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if !tooLarge {
+			if len(line)+len(chunk) > limit+2 {
+				tooLarge, line = true, nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+
+		switch err {
+		case bufio.ErrBufferFull:
+			continue
+		case nil:
+			return bytes.TrimRight(line, "\r\n"), tooLarge, nil
+		default:
+			return bytes.TrimRight(line, "\r\n"), tooLarge, err
+		}
+	}
+}
+
+// jsonArraySlack is how far past the size limit of an element readJSONArray reads, for the white
+// space and comma before it and the byte that ends a number
+const jsonArraySlack = 512
+
+// errElementTooLarge is returned by elementLimitReader once an element is over its limit
+var errElementTooLarge = errors.New("JSON array element too large")
+
+// elementLimitReader lets a json.Decoder read at most limit bytes past start, the offset of the
+// element it decodes, so a single huge element cannot be buffered
+type elementLimitReader struct {
+	r     io.Reader
+	read  int64
+	start int64
+	limit int64
+}
+
+// Read implements io.Reader
+func (lr *elementLimitReader) Read(p []byte) (int, error) {
+	remaining := lr.start + lr.limit - lr.read
+	if remaining <= 0 {
+		return 0, errElementTooLarge
+	}
+	if int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := lr.r.Read(p)
+	lr.read += int64(n)
+	return n, err
+}
+
+// readJSONArray passes each element of the JSON array in br to emit. Elements are read into memory
+// one at a time. An element somewhat longer than maxRecordSize is passed on with an error; one far
+// longer is not read to its end, so it ends the stream with a *JSONError.
+func readJSONArray(br *bufio.Reader, maxRecordSize int, maxSize int64, emit func(line int, raw []byte, err error) (bool, error)) error {
+	lr := &elementLimitReader{r: br, limit: int64(maxRecordSize) + jsonArraySlack}
+	dec := json.NewDecoder(lr)
+	if _, err := dec.Token(); err != nil {
+		return streamReadError(err, maxSize)
+	}
+
+	for index := 0; ; index++ {
+		lr.start = dec.InputOffset()
+		if !dec.More() {
+			break
+		}
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			if errors.Is(err, errElementTooLarge) {
+				return &JSONError{
+					Kind:    JSONErrorTooLarge,
+					Offset:  lr.start,
+					Message: fmt.Sprintf("element %d of the JSON array exceeds maximum size of %d bytes", index, maxRecordSize),
+					Err:     err,
+				}
+			}
+			return streamSyntaxError(dec, err, maxSize)
+		}
+
+		more, err := emit(0, raw, nil)
+		if err != nil || !more {
+			return err
+		}
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return streamSyntaxError(dec, err, maxSize)
+	}
+
+	offset := dec.InputOffset()
+	if _, err := dec.Token(); err != io.EOF {
+		if err == nil {
+			return &JSONError{
+				Kind:    JSONErrorTrailingData,
+				Offset:  offset,
+				Message: "request body must contain only one JSON array",
+			}
+		}
+		return streamSyntaxError(dec, err, maxSize)
+	}
+
+	return nil
+}
+
+// peekNonSpace returns the first byte of br that is not white space, without consuming it
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(b)) {
+			return b, br.UnreadByte()
+		}
+	}
+}
+
+// streamReadError describes an error reading a JSON stream. The end of the body is not an error;
+// an empty stream has no records.
+func streamReadError(err error, maxSize int64) error {
+	var maxBytesError *http.MaxBytesError
+	switch {
+	case err == io.EOF:
+		return nil
+	case errors.As(err, &maxBytesError):
+		return &JSONError{
+			Kind:    JSONErrorTooLarge,
+			Offset:  maxBytesError.Limit,
+			Message: fmt.Sprintf("JSON stream exceeds maximum size of %d bytes", maxSize),
+			Err:     err,
+		}
+	}
+	return fmt.Errorf("error reading JSON stream: %w", err)
+}
+
+// streamSyntaxError describes an error decoding a JSON array read by dec. As the stream is not kept,
+// the error has an offset but no line and column.
+func streamSyntaxError(dec *json.Decoder, err error, maxSize int64) error {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		return streamReadError(err, maxSize)
+	}
+
+	offset := dec.InputOffset()
+	var syntaxError *json.SyntaxError
+	if errors.As(err, &syntaxError) {
+		offset = syntaxError.Offset
+	}
+
+	message := fmt.Sprintf("syntax error in JSON array at position %d", offset)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		message = "JSON array is incomplete"
+	}
+
+	return &JSONError{Kind: JSONErrorSyntax, Offset: offset, Message: message, Err: err}
+}
+
+// recordTooLarge is the error of a record of a JSON stream over the size limit
+func recordTooLarge(limit int) error {
+	return &JSONError{
+		Kind:    JSONErrorTooLarge,
+		Message: fmt.Sprintf("record exceeds maximum size of %d bytes", limit),
+	}
+}
+
+// JSONStreamWriter sends a response as newline delimited JSON, one record at a time
+type JSONStreamWriter struct {
+	w       http.ResponseWriter
+	status  int
+	started bool
+}
+
+// NewJSONStreamWriter returns a writer that sends records to w as NDJSON. The status and headers are
+// sent with the first record, so an error that occurs before it can still be sent with ErrorJSON.
+func (t *Tools) NewJSONStreamWriter(w http.ResponseWriter, status int, headers ...http.Header) *JSONStreamWriter {
+	if len(headers) > 0 {
+		for key, value := range headers[0] {
+			w.Header()[key] = value
+		}
+	}
+
+	return &JSONStreamWriter{w: w, status: status}
+}
+
+// Write sends record as a line of JSON and flushes it to the client. A record that cannot be
+// encoded is not sent at all.
+func (sw *JSONStreamWriter) Write(record interface{}) error {
+	out, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	sw.start()
+	if _, err := sw.w.Write(append(out, '\n')); err != nil {
+		return err
+	}
+	return sw.Flush()
+}
+
+// Flush sends the status and headers if no record was written yet, and anything buffered
+func (sw *JSONStreamWriter) Flush() error {
+	sw.start()
+	if err := http.NewResponseController(sw.w).Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// Started reports whether the status and headers have been sent
+func (sw *JSONStreamWriter) Started() bool {
+	return sw.started
+}
+
+// start sends the status and headers once
+func (sw *JSONStreamWriter) start() {
+	if sw.started {
+		return
+	}
+	sw.started = true
+
+	sw.w.Header().Set("Content-Type", NDJSONContentType)
+	sw.w.WriteHeader(sw.status)
+}
@@ -0,0 +1,330 @@
+package toolbox
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testStreamItem struct {
+	SKU      string `json:"sku" validate:"required"`
+	Quantity int    `json:"quantity"`
+}
+
+// streamResult is what JSONStream yielded for a record
+type streamResult struct {
+	item  testStreamItem
+	index int
+	line  int
+	kind  JSONErrorKind
+	err   error
+}
+
+// collectStream reads body with JSONStream
+func collectStream(t *testing.T, tools *Tools, body string, opts ...JSONStreamOptions) []streamResult {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/import", strings.NewReader(body))
+	var results []streamResult
+	for item, err := range JSONStream[testStreamItem](tools, httptest.NewRecorder(), req, opts...) {
+		result := streamResult{item: item, index: -1, err: err}
+
+		var recordErr *RecordError
+		if errors.As(err, &recordErr) {
+			result.index, result.line = recordErr.Index, recordErr.Line
+		}
+		var jsonErr *JSONError
+		if errors.As(err, &jsonErr) {
+			result.kind = jsonErr.Kind
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// TestJSONStream tests reading NDJSON and JSON arrays record by record
+func TestJSONStream(t *testing.T) {
+	var tools Tools
+
+	bodies := map[string]string{
+		"ndjson": "{\"sku\": \"a\", \"quantity\": 1}\r\n\n{\"sku\": \"b\", \"quantity\": \"two\"}\n{\"quantity\": 3}\n{\"sku\": \"d\", \"quantity\": 4}",
+		"array":  `  [{"sku": "a", "quantity": 1}, {"sku": "b", "quantity": "two"}, {"quantity": 3}, {"sku": "d", "quantity": 4}]`,
+	}
+
+	for name, body := range bodies {
+		t.Run(name, func(t *testing.T) {
+			results := collectStream(t, &tools, body)
+			if len(results) != 4 {
+				t.Fatalf("expected 4 results, got %d", len(results))
+			}
+
+			if results[0].err != nil || results[0].item != (testStreamItem{"a", 1}) {
+				t.Errorf("unexpected first record %+v", results[0])
+			}
+			if results[1].index != 1 || results[1].kind != JSONErrorTypeMismatch {
+				t.Errorf("expected a type mismatch in record 1, got %+v", results[1])
+			}
+			var validationErrs ValidationErrors
+			if results[2].index != 2 || !errors.As(results[2].err, &validationErrs) {
+				t.Errorf("expected a validation error in record 2, got %+v", results[2])
+			}
+			if results[3].err != nil || results[3].item != (testStreamItem{"d", 4}) {
+				t.Errorf("unexpected last record %+v", results[3])
+			}
+
+			// Lines are counted in NDJSON only, blank lines included
+			if name == "ndjson" && (results[1].line != 3 || results[2].line != 4) {
+				t.Errorf("expected lines 3 and 4, got %d and %d", results[1].line, results[2].line)
+			}
+		})
+	}
+
+	if results := collectStream(t, &tools, " \n "); len(results) != 0 {
+		t.Errorf("expected no records in an empty stream, got %+v", results)
+	}
+}
+
+// TestJSONStream_Limits tests the limits and the errors that end a stream
+func TestJSONStream_Limits(t *testing.T) {
+	var tools Tools
+
+	tests := []struct {
+		name    string
+		body    string
+		options JSONStreamOptions
+		records int // Records read before the error
+		check   func(err error) bool
+	}{
+		{
+			name:    "too many records",
+			body:    "{\"sku\": \"a\"}\n{\"sku\": \"b\"}\n{\"sku\": \"c\"}",
+			options: JSONStreamOptions{MaxRecords: 2},
+			records: 2,
+			check:   func(err error) bool { return errors.Is(err, ErrBatchSizeExceeded) },
+		},
+		{
+			name:    "body too large",
+			body:    "{\"sku\": \"a\"}\n{\"sku\": \"b\"}\n{\"sku\": \"c\"}",
+			options: JSONStreamOptions{MaxSize: 20},
+			records: 1,
+			check: func(err error) bool {
+				var jsonErr *JSONError
+				return errors.As(err, &jsonErr) && jsonErr.Kind == JSONErrorTooLarge
+			},
+		},
+		{
+			name:    "malformed array",
+			body:    `[{"sku": "a"}, {"sku": ]`,
+			records: 1,
+			check: func(err error) bool {
+				var jsonErr *JSONError
+				return errors.As(err, &jsonErr) && jsonErr.Kind == JSONErrorSyntax && jsonErr.Offset == 24
+			},
+		},
+		{
+			name:    "incomplete array",
+			body:    `[{"sku": "a"}`,
+			records: 1,
+			check: func(err error) bool {
+				var jsonErr *JSONError
+				return errors.As(err, &jsonErr) && jsonErr.Kind == JSONErrorSyntax
+			},
+		},
+		{
+			name:    "data after array",
+			body:    `[{"sku": "a"}] {}`,
+			records: 1,
+			check: func(err error) bool {
+				var jsonErr *JSONError
+				return errors.As(err, &jsonErr) && jsonErr.Kind == JSONErrorTrailingData
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := collectStream(t, &tools, tt.body, tt.options)
+			if len(results) != tt.records+1 {
+				t.Fatalf("expected %d records and an error, got %+v", tt.records, results)
+			}
+
+			last := results[len(results)-1]
+			var recordErr *RecordError
+			if errors.As(last.err, &recordErr) || !tt.check(last.err) {
+				t.Errorf("unexpected error %v", last.err)
+			}
+		})
+	}
+
+	// Records over the size limit are rejected without ending the stream
+	long := `{"sku": "` + strings.Repeat("x", 5000) + `"}`
+	results := collectStream(t, &tools, "{\"sku\": \"a\"}\n"+long+"\n{\"sku\": \"b\"}", JSONStreamOptions{MaxRecordSize: 100})
+	if len(results) != 3 || results[1].kind != JSONErrorTooLarge || results[1].line != 2 || results[2].item.SKU != "b" {
+		t.Errorf("expected the long record to be rejected, got %+v", results)
+	}
+
+	// In an array, an element far over the limit ends the stream as it is not read to its end
+	results = collectStream(t, &tools, `[{"sku": "a"}, `+long+`, {"sku": "b"}]`, JSONStreamOptions{MaxRecordSize: 100})
+	if len(results) != 2 || results[1].kind != JSONErrorTooLarge || results[1].index != -1 {
+		t.Errorf("expected the long element to end the stream, got %+v", results)
+	}
+
+	slightlyLong := `{"sku": "` + strings.Repeat("x", 150) + `"}`
+	results = collectStream(t, &tools, `[{"sku": "a"}, `+slightlyLong+`, {"sku": "b"}]`, JSONStreamOptions{MaxRecordSize: 100})
+	if len(results) != 3 || results[1].kind != JSONErrorTooLarge || results[1].index != 1 || results[2].item.SKU != "b" {
+		t.Errorf("expected the slightly long element to be skipped, got %+v", results)
+	}
+}
+
+// countingReader counts the bytes read from it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// TestJSONStream_OversizedElement tests that a huge array element is not read into memory
+func TestJSONStream_OversizedElement(t *testing.T) {
+	var tools Tools
+
+	huge := strings.Repeat("x", 16<<20)
+	body := &countingReader{r: strings.NewReader(`[{"sku": "a"}, {"sku": "` + huge + `"}]`)}
+	req := httptest.NewRequest(http.MethodPost, "/import", body)
+
+	var records int
+	var streamErr error
+	for _, err := range JSONStream[testStreamItem](&tools, httptest.NewRecorder(), req, JSONStreamOptions{MaxRecordSize: 1024}) {
+		if err != nil {
+			streamErr = err
+			break
+		}
+		records++
+	}
+
+	var recordErr *RecordError
+	var jsonErr *JSONError
+	if records != 1 || errors.As(streamErr, &recordErr) || !errors.As(streamErr, &jsonErr) || jsonErr.Kind != JSONErrorTooLarge {
+		t.Fatalf("expected one record and a too large element, got %d records and %v", records, streamErr)
+	}
+	if body.n > 64*1024 {
+		t.Errorf("expected reading to stop near the limit, read %d bytes", body.n)
+	}
+
+	rr := httptest.NewRecorder()
+	tools.ErrorJSON(rr, streamErr)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d", rr.Code)
+	}
+}
+
+// TestReadJSONStream tests reading a stream with a callback
+func TestReadJSONStream(t *testing.T) {
+	var tools Tools
+	body := "{\"sku\": \"a\"}\n{\"sku\": 1}\n{\"sku\": \"c\"}\n{}\n"
+
+	read := func(options JSONStreamOptions) ([]string, error) {
+		var skus []string
+		req := httptest.NewRequest(http.MethodPost, "/import", strings.NewReader(body))
+		err := ReadJSONStream(&tools, httptest.NewRecorder(), req, func(item testStreamItem) error {
+			skus = append(skus, item.SKU)
+			return nil
+		}, options)
+		return skus, err
+	}
+
+	// Invalid records stop the stream by default
+	skus, err := read(JSONStreamOptions{})
+	var recordErr *RecordError
+	if len(skus) != 1 || !errors.As(err, &recordErr) || recordErr.Line != 2 {
+		t.Errorf("expected to stop at line 2, got %v, %v", skus, err)
+	}
+
+	// Or are collected
+	skus, err = read(JSONStreamOptions{SkipInvalid: true})
+	var recordErrs RecordErrors
+	if len(skus) != 2 || !errors.As(err, &recordErrs) || len(recordErrs) != 2 {
+		t.Fatalf("expected 2 records and 2 errors, got %v, %v", skus, err)
+	}
+
+	// ErrorJSON lists the rejected records
+	rr := httptest.NewRecorder()
+	tools.ErrorJSON(rr, err)
+
+	var payload struct {
+		Data struct {
+			Records []struct {
+				Index int `json:"index"`
+				Line  int `json:"line"`
+			} `json:"records"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusUnprocessableEntity || len(payload.Data.Records) != 2 || payload.Data.Records[1].Line != 4 {
+		t.Errorf("unexpected response %d %+v", rr.Code, payload)
+	}
+
+	// Errors of the callback end the stream
+	errStop := errors.New("stop")
+	req := httptest.NewRequest(http.MethodPost, "/import", strings.NewReader(body))
+	err = ReadJSONStream(&tools, httptest.NewRecorder(), req, func(item testStreamItem) error { return errStop })
+	if !errors.Is(err, errStop) {
+		t.Errorf("expected the callback error, got %v", err)
+	}
+}
+
+// TestJSONStreamWriter tests sending NDJSON
+func TestJSONStreamWriter(t *testing.T) {
+	var tools Tools
+
+	rr := httptest.NewRecorder()
+	sw := tools.NewJSONStreamWriter(rr, http.StatusAccepted, http.Header{"X-Export": {"1"}})
+	if sw.Started() {
+		t.Error("expected nothing to be sent before the first record")
+	}
+
+	if err := sw.Write(testStreamItem{SKU: "a", Quantity: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if !rr.Flushed {
+		t.Error("expected the record to be flushed")
+	}
+	if err := sw.Write(math.Inf(1)); err == nil {
+		t.Error("expected an error for a value that cannot be encoded")
+	}
+	if err := sw.Write(map[string]int{"b": 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Code != http.StatusAccepted || rr.Header().Get("Content-Type") != NDJSONContentType || rr.Header().Get("X-Export") != "1" {
+		t.Errorf("unexpected response %d %v", rr.Code, rr.Header())
+	}
+	if expected := "{\"sku\":\"a\",\"quantity\":1}\n{\"b\":2}\n"; rr.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, rr.Body.String())
+	}
+
+	// The writer reads its own output back
+	req := httptest.NewRequest(http.MethodPost, "/import", strings.NewReader(rr.Body.String()))
+	count := 0
+	for _, err := range JSONStream[map[string]interface{}](&Tools{AllowUnknownFields: true}, httptest.NewRecorder(), req) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != 2 {
+		t.Errorf("expected 2 records, got %d", count)
+	}
+}
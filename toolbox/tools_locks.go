@@ -0,0 +1,56 @@
+package toolbox
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// keyedMutex hands out one mutex per key and forgets it once nobody holds or waits for it
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// uploadLocks serialises work on a single chunked upload. It is shared by every Tools value, so
+// two instances pointing at the same ChunksDirectory still exclude each other.
+var uploadLocks = &keyedMutex{locks: make(map[string]*keyedLock)}
+
+// Lock blocks until the lock for key is held and returns the function that releases it
+func (km *keyedMutex) Lock(key string) func() {
+	km.mu.Lock()
+	l, ok := km.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		km.locks[key] = l
+	}
+	l.refs++
+	km.mu.Unlock()
+
+	l.mu.Lock()
+
+	return func() {
+		l.mu.Unlock()
+
+		km.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(km.locks, key)
+		}
+		km.mu.Unlock()
+	}
+}
+
+// lockUpload takes the lock of a chunked upload and returns the function that releases it
+func (t *Tools) lockUpload(uploadID string) func() {
+	dir, err := filepath.Abs(t.ChunksDirectory)
+	if err != nil {
+		dir = filepath.Clean(t.ChunksDirectory)
+	}
+
+	return uploadLocks.Lock(filepath.Join(dir, uploadID))
+}
@@ -0,0 +1,396 @@
+package toolbox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// maxMessagePackDepth limits the nesting of decoded MessagePack values
+const maxMessagePackDepth = 1000
+
+// MessagePackEncoder encodes application/msgpack. Values are encoded as they would be in JSON, so
+// json struct tags and MarshalJSON methods apply: structs become maps, integers are sent as
+// integers and other numbers as 64-bit floats. Decoding accepts any MessagePack value but
+// extension types; binary data is decoded like a base64 string in JSON.
+type MessagePackEncoder struct{}
+
+// ContentType implements Encoder
+func (MessagePackEncoder) ContentType() string {
+	return "application/msgpack"
+}
+
+// Encode implements Encoder
+func (MessagePackEncoder) Encode(w io.Writer, data interface{}) error {
+	out, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(out))
+	dec.UseNumber()
+
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := writeMessagePack(bw, value); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Decode implements Encoder
+func (MessagePackEncoder) Decode(r io.Reader, data interface{}) error {
+	br := bufio.NewReader(r)
+	value, err := readMessagePack(br, 0)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return errors.New("msgpack: data after the top-level value")
+	}
+
+	out, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(out, data)
+}
+
+// writeMessagePack writes a value decoded from JSON as MessagePack
+func writeMessagePack(w *bufio.Writer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		return w.WriteByte(0xc0)
+
+	case bool:
+		if v {
+			return w.WriteByte(0xc3)
+		}
+		return w.WriteByte(0xc2)
+
+	case json.Number:
+		return writeMessagePackNumber(w, v)
+
+	case string:
+		n := len(v)
+		switch {
+		case n < 32:
+			w.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			w.Write([]byte{0xd9, byte(n)})
+		case n <= math.MaxUint16:
+			w.WriteByte(0xda)
+			binary.Write(w, binary.BigEndian, uint16(n))
+		default:
+			w.WriteByte(0xdb)
+			binary.Write(w, binary.BigEndian, uint32(n))
+		}
+		_, err := w.WriteString(v)
+		return err
+
+	case []interface{}:
+		writeMessagePackHeader(w, len(v), 0x90, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := writeMessagePack(w, item); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		writeMessagePackHeader(w, len(v), 0x80, 0xde, 0xdf)
+		for _, key := range keys {
+			if err := writeMessagePack(w, key); err != nil {
+				return err
+			}
+			if err := writeMessagePack(w, v[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("msgpack: cannot encode %T", value)
+}
+
+// writeMessagePackHeader writes the length of an array or map, with fix as the fixed format for
+// fewer than 16 elements
+func writeMessagePackHeader(w *bufio.Writer, n int, fix, format16, format32 byte) {
+	switch {
+	case n < 16:
+		w.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		w.WriteByte(format16)
+		binary.Write(w, binary.BigEndian, uint16(n))
+	default:
+		w.WriteByte(format32)
+		binary.Write(w, binary.BigEndian, uint32(n))
+	}
+}
+
+// writeMessagePackNumber writes n in the smallest integer format that holds it, or as a float64
+func writeMessagePackNumber(w *bufio.Writer, n json.Number) error {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		switch {
+		case i >= 0:
+			return writeMessagePackUint(w, uint64(i))
+		case i >= -32:
+			return w.WriteByte(byte(int8(i)))
+		case i >= math.MinInt8:
+			_, err := w.Write([]byte{0xd0, byte(int8(i))})
+			return err
+		case i >= math.MinInt16:
+			w.WriteByte(0xd1)
+			return binary.Write(w, binary.BigEndian, int16(i))
+		case i >= math.MinInt32:
+			w.WriteByte(0xd2)
+			return binary.Write(w, binary.BigEndian, int32(i))
+		default:
+			w.WriteByte(0xd3)
+			return binary.Write(w, binary.BigEndian, i)
+		}
+	}
+
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		return writeMessagePackUint(w, u)
+	}
+
+	f, err := n.Float64()
+	if err != nil {
+		return err
+	}
+	w.WriteByte(0xcb)
+	return binary.Write(w, binary.BigEndian, f)
+}
+
+// writeMessagePackUint writes u in the smallest unsigned format that holds it
+func writeMessagePackUint(w *bufio.Writer, u uint64) error {
+	switch {
+	case u <= 0x7f:
+		return w.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		_, err := w.Write([]byte{0xcc, byte(u)})
+		return err
+	case u <= math.MaxUint16:
+		w.WriteByte(0xcd)
+		return binary.Write(w, binary.BigEndian, uint16(u))
+	case u <= math.MaxUint32:
+		w.WriteByte(0xce)
+		return binary.Write(w, binary.BigEndian, uint32(u))
+	default:
+		w.WriteByte(0xcf)
+		return binary.Write(w, binary.BigEndian, u)
+	}
+}
+
+// readMessagePack reads a MessagePack value as the types encoding/json would decode it into:
+// maps, slices, strings, numbers, bools and nil. Binary data is returned as []byte.
+func readMessagePack(r *bufio.Reader, depth int) (interface{}, error) {
+	if depth > maxMessagePackDepth {
+		return nil, errors.New("msgpack: value nested too deeply")
+	}
+
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xf0 == 0x80:
+		return readMessagePackMap(r, int(b&0x0f), depth)
+	case b&0xf0 == 0x90:
+		return readMessagePackArray(r, int(b&0x0f), depth)
+	case b&0xe0 == 0xa0:
+		return readMessagePackString(r, uint64(b&0x1f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+
+	case 0xc4, 0xc5, 0xc6:
+		n, err := readMessagePackLength(r, b-0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return readMessagePackBytes(r, n)
+
+	case 0xca:
+		var f float32
+		err := binary.Read(r, binary.BigEndian, &f)
+		return float64(f), err
+	case 0xcb:
+		var f float64
+		err := binary.Read(r, binary.BigEndian, &f)
+		return f, err
+
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		var u uint64
+		switch b {
+		case 0xcc:
+			var v uint8
+			err = binary.Read(r, binary.BigEndian, &v)
+			u = uint64(v)
+		case 0xcd:
+			var v uint16
+			err = binary.Read(r, binary.BigEndian, &v)
+			u = uint64(v)
+		case 0xce:
+			var v uint32
+			err = binary.Read(r, binary.BigEndian, &v)
+			u = uint64(v)
+		default:
+			err = binary.Read(r, binary.BigEndian, &u)
+		}
+		return u, err
+
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		var i int64
+		switch b {
+		case 0xd0:
+			var v int8
+			err = binary.Read(r, binary.BigEndian, &v)
+			i = int64(v)
+		case 0xd1:
+			var v int16
+			err = binary.Read(r, binary.BigEndian, &v)
+			i = int64(v)
+		case 0xd2:
+			var v int32
+			err = binary.Read(r, binary.BigEndian, &v)
+			i = int64(v)
+		default:
+			err = binary.Read(r, binary.BigEndian, &i)
+		}
+		return i, err
+
+	case 0xd9, 0xda, 0xdb:
+		n, err := readMessagePackLength(r, b-0xd9)
+		if err != nil {
+			return nil, err
+		}
+		return readMessagePackString(r, n)
+
+	case 0xdc, 0xdd:
+		n, err := readMessagePackLength(r, b-0xdc+1)
+		if err != nil {
+			return nil, err
+		}
+		return readMessagePackArray(r, int(n), depth)
+
+	case 0xde, 0xdf:
+		n, err := readMessagePackLength(r, b-0xde+1)
+		if err != nil {
+			return nil, err
+		}
+		return readMessagePackMap(r, int(n), depth)
+	}
+
+	return nil, fmt.Errorf("msgpack: unsupported format 0x%02x", b)
+}
+
+// readMessagePackLength reads a length of 1, 2 or 4 bytes, for size 0, 1 or 2
+func readMessagePackLength(r *bufio.Reader, size byte) (uint64, error) {
+	switch size {
+	case 0:
+		var n uint8
+		err := binary.Read(r, binary.BigEndian, &n)
+		return uint64(n), err
+	case 1:
+		var n uint16
+		err := binary.Read(r, binary.BigEndian, &n)
+		return uint64(n), err
+	default:
+		var n uint32
+		err := binary.Read(r, binary.BigEndian, &n)
+		return uint64(n), err
+	}
+}
+
+// readMessagePackBytes reads n bytes. The buffer grows as data arrives, so a bogus length cannot
+// allocate more memory than the body holds.
+func readMessagePackBytes(r *bufio.Reader, n uint64) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readMessagePackString reads a string of n bytes
+func readMessagePackString(r *bufio.Reader, n uint64) (interface{}, error) {
+	b, err := readMessagePackBytes(r, n)
+	return string(b), err
+}
+
+// readMessagePackArray reads the n elements of an array
+func readMessagePackArray(r *bufio.Reader, n int, depth int) (interface{}, error) {
+	items := make([]interface{}, 0, min(n, 1024))
+	for i := 0; i < n; i++ {
+		item, err := readMessagePack(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// readMessagePackMap reads the n entries of a map. Keys that are not strings are converted to their
+// text, as JSON objects only have string keys.
+func readMessagePackMap(r *bufio.Reader, n int, depth int) (interface{}, error) {
+	entries := make(map[string]interface{}, min(n, 1024))
+	for i := 0; i < n; i++ {
+		key, err := readMessagePack(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readMessagePack(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+
+		switch k := key.(type) {
+		case string:
+			entries[k] = value
+		case []byte:
+			entries[string(k)] = value
+		case map[string]interface{}, []interface{}, nil:
+			return nil, fmt.Errorf("msgpack: unsupported map key %v", key)
+		default:
+			entries[fmt.Sprint(k)] = value
+		}
+	}
+	return entries, nil
+}
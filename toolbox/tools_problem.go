@@ -0,0 +1,219 @@
+package toolbox
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ProblemContentType is the media type of problem details, see RFC 9457
+const ProblemContentType = "application/problem+json"
+
+// ProblemDetails is an error response as described in RFC 9457. WriteJSON sends it with the
+// application/problem+json content type, and it can be returned as an error to ErrorJSON to send it
+// as it is.
+type ProblemDetails struct {
+	Type     string // URI reference identifying the kind of problem; "about:blank" if empty
+	Title    string // Short summary of the kind of problem; the status text if empty
+	Status   int    // HTTP status code
+	Detail   string // Explanation of this occurrence of the problem
+	Instance string // URI reference identifying this occurrence of the problem
+
+	// Extensions are sent as additional members of the problem object, e.g. "errors" with the
+	// problems of each field of ValidationErrors
+	Extensions map[string]interface{}
+}
+
+// Error implements the error interface
+func (pd *ProblemDetails) Error() string {
+	if pd.Detail != "" {
+		return pd.Detail
+	}
+	return pd.Title
+}
+
+// MarshalJSON sends the extension members next to the standard ones
+func (pd ProblemDetails) MarshalJSON() ([]byte, error) {
+	members := make(map[string]interface{}, len(pd.Extensions)+5)
+	for name, value := range pd.Extensions {
+		members[name] = value
+	}
+
+	members["type"] = pd.Type
+	if pd.Type == "" {
+		members["type"] = "about:blank"
+	}
+	members["title"] = pd.Title
+	if pd.Title == "" {
+		members["title"] = http.StatusText(pd.Status)
+	}
+	if pd.Status != 0 {
+		members["status"] = pd.Status
+	} else {
+		delete(members, "status")
+	}
+	if pd.Detail != "" {
+		members["detail"] = pd.Detail
+	} else {
+		delete(members, "detail")
+	}
+	if pd.Instance != "" {
+		members["instance"] = pd.Instance
+	} else {
+		delete(members, "instance")
+	}
+
+	return json.Marshal(members)
+}
+
+// UnmarshalJSON reads the standard members and keeps the others as extensions
+func (pd *ProblemDetails) UnmarshalJSON(data []byte) error {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(data, &members); err != nil {
+		return err
+	}
+
+	*pd = ProblemDetails{}
+	fields := map[string]interface{}{
+		"type":     &pd.Type,
+		"title":    &pd.Title,
+		"status":   &pd.Status,
+		"detail":   &pd.Detail,
+		"instance": &pd.Instance,
+	}
+
+	for name, raw := range members {
+		if field, ok := fields[name]; ok {
+			// Members of the wrong type are ignored, as RFC 9457 asks
+			json.Unmarshal(raw, field)
+			continue
+		}
+
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return err
+		}
+		if pd.Extensions == nil {
+			pd.Extensions = make(map[string]interface{})
+		}
+		pd.Extensions[name] = value
+	}
+
+	return nil
+}
+
+// newProblemDetails describes err as problem details with the given status and the JSONResponse
+// ErrorJSON would have sent otherwise. status comes from errorPayload, so it is the Status of a
+// *ProblemDetails err unless the caller passed one explicitly.
+func newProblemDetails(err error, status int, payload JSONResponse) *ProblemDetails {
+	var problem *ProblemDetails
+	if errors.As(err, &problem) {
+		copied := *problem
+		copied.Status = status
+		return &copied
+	}
+
+	problem = &ProblemDetails{
+		Status: status,
+		Title:  http.StatusText(status),
+		Detail: payload.Message,
+	}
+
+	details, _ := payload.Data.(map[string]interface{})
+	if len(details) > 0 || payload.Code != "" {
+		problem.Extensions = make(map[string]interface{}, len(details)+1)
+		for name, value := range details {
+			if name == "fields" {
+				name = "errors"
+			}
+			problem.Extensions[name] = value
+		}
+		if payload.Code != "" {
+			problem.Extensions["code"] = payload.Code
+		}
+	}
+
+	return problem
+}
+
+// ErrorJSONFor sends err like ErrorJSON, in the format the client of r asks for: problem details if
+// t.ProblemDetails is set or the Accept header prefers application/problem+json to
+// application/json, and JSONResponse otherwise. Problem details carry the path of r as instance.
+func (t *Tools) ErrorJSONFor(w http.ResponseWriter, r *http.Request, err error, status ...int) error {
+	if !t.ProblemDetails && !prefersProblemDetails(r.Header.Get("Accept")) {
+		return t.writeErrorEnvelope(w, err, status...)
+	}
+
+	statusCode, payload := t.errorPayload(err, status...)
+	problem := newProblemDetails(err, statusCode, payload)
+	if problem.Instance == "" {
+		problem.Instance = r.URL.RequestURI()
+	}
+
+	return t.WriteJSON(w, problem.Status, problem)
+}
+
+// prefersProblemDetails reports whether an Accept header asks for problem details by name, at least
+// as much as for plain JSON
+func prefersProblemDetails(accept string) bool {
+	q, specificity := acceptQuality(accept, ProblemContentType)
+	if specificity < mediaRangeExact || q <= 0 {
+		return false
+	}
+
+	jsonQ, _ := acceptQuality(accept, "application/json")
+	return q >= jsonQ
+}
+
+// How closely a media range in an Accept header matches a media type
+const (
+	mediaRangeNone     = iota // Not matched, or no Accept header
+	mediaRangeAll             // */*
+	mediaRangeSubtypes        // e.g. application/*
+	mediaRangeExact           // e.g. application/json
+)
+
+// acceptQuality returns the q-value the most specific matching media range in an Accept header
+// gives mediaType, and how specific that range was. Without an Accept header, anything is accepted.
+func acceptQuality(accept, mediaType string) (float64, int) {
+	if strings.TrimSpace(accept) == "" {
+		return 1, mediaRangeNone
+	}
+
+	mainType, _, _ := strings.Cut(mediaType, "/")
+
+	bestQ, best := 0.0, mediaRangeNone
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, _ := strings.Cut(part, ";")
+		mediaRange = strings.ToLower(strings.TrimSpace(mediaRange))
+
+		specificity := mediaRangeNone
+		switch {
+		case mediaRange == mediaType:
+			specificity = mediaRangeExact
+		case mediaRange == mainType+"/*":
+			specificity = mediaRangeSubtypes
+		case mediaRange == "*/*":
+			specificity = mediaRangeAll
+		}
+		if specificity <= best {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(param, "=")
+			if ok && strings.TrimSpace(key) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		bestQ, best = q, specificity
+	}
+
+	return bestQ, best
+}
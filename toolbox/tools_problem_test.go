@@ -0,0 +1,136 @@
+package toolbox
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// decodeProblem reads the problem details of a response as a plain map
+func decodeProblem(t *testing.T, rr *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+
+	if ct := rr.Header().Get("Content-Type"); ct != ProblemContentType {
+		t.Fatalf("expected %s, got %q", ProblemContentType, ct)
+	}
+
+	var members map[string]interface{}
+	if err := json.NewDecoder(rr.Body).Decode(&members); err != nil {
+		t.Fatal(err)
+	}
+	return members
+}
+
+// TestTools_ErrorJSON_ProblemDetails tests sending errors as RFC 9457 problem details
+func TestTools_ErrorJSON_ProblemDetails(t *testing.T) {
+	tools := Tools{ProblemDetails: true}
+
+	rr := httptest.NewRecorder()
+	tools.ErrorJSON(rr, errors.New("the widget is broken"), http.StatusServiceUnavailable)
+
+	expected := map[string]interface{}{
+		"type":   "about:blank",
+		"title":  "Service Unavailable",
+		"status": float64(503),
+		"detail": "the widget is broken",
+	}
+	if members := decodeProblem(t, rr); !reflect.DeepEqual(members, expected) {
+		t.Errorf("unexpected problem %v", members)
+	}
+
+	// Validation errors become an extension member
+	rr = httptest.NewRecorder()
+	tools.ErrorJSON(rr, ValidationErrors{"email": {"is required"}})
+	members := decodeProblem(t, rr)
+	if rr.Code != http.StatusUnprocessableEntity || members["status"] != float64(422) {
+		t.Errorf("expected 422, got %d %v", rr.Code, members["status"])
+	}
+	if !reflect.DeepEqual(members["errors"], map[string]interface{}{"email": []interface{}{"is required"}}) {
+		t.Errorf("unexpected errors member %v", members["errors"])
+	}
+
+	// Problems returned as errors are sent as they are
+	rr = httptest.NewRecorder()
+	tools.ErrorJSON(rr, &ProblemDetails{
+		Type:       "https://example.com/probs/out-of-credit",
+		Title:      "You do not have enough credit.",
+		Status:     http.StatusForbidden,
+		Detail:     "Your current balance is 30, but that costs 50.",
+		Extensions: map[string]interface{}{"balance": 30, "status": "ignored"},
+	})
+	members = decodeProblem(t, rr)
+	if rr.Code != http.StatusForbidden || members["type"] != "https://example.com/probs/out-of-credit" || members["balance"] != float64(30) || members["status"] != float64(403) {
+		t.Errorf("unexpected problem %d %v", rr.Code, members)
+	}
+
+	// An explicit status wins over the status of the problem
+	rr = httptest.NewRecorder()
+	tools.ErrorJSON(rr, &ProblemDetails{Title: "Try again later.", Status: http.StatusForbidden}, http.StatusServiceUnavailable)
+	members = decodeProblem(t, rr)
+	if rr.Code != http.StatusServiceUnavailable || members["status"] != float64(503) {
+		t.Errorf("expected 503, got %d %v", rr.Code, members["status"])
+	}
+
+	// The default format is unchanged
+	rr = httptest.NewRecorder()
+	(&Tools{}).ErrorJSON(rr, errors.New("plain"))
+	if rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected a JSONResponse by default, got %q", rr.Header().Get("Content-Type"))
+	}
+}
+
+// TestTools_ErrorJSONFor tests choosing the error format from the Accept header
+func TestTools_ErrorJSONFor(t *testing.T) {
+	var tools Tools
+
+	tests := []struct {
+		accept  string
+		problem bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", false},
+		{"application/problem+json", true},
+		{"application/json, application/problem+json", true},
+		{"application/json, application/problem+json;q=0.5", false},
+		{"application/*;q=0.9, application/problem+json", true},
+		{"application/problem+json;q=0", false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/orders/42?draft=1", nil)
+		req.Header.Set("Accept", tt.accept)
+		rr := httptest.NewRecorder()
+		tools.ErrorJSONFor(rr, req, errors.New("not today"), http.StatusConflict)
+
+		isProblem := rr.Header().Get("Content-Type") == ProblemContentType
+		if isProblem != tt.problem {
+			t.Errorf("Accept %q: expected problem details %v, got %q", tt.accept, tt.problem, rr.Header().Get("Content-Type"))
+		}
+		if isProblem {
+			if members := decodeProblem(t, rr); members["instance"] != "/orders/42?draft=1" || members["status"] != float64(409) {
+				t.Errorf("unexpected problem %v", members)
+			}
+		}
+	}
+}
+
+// TestProblemDetails_JSON tests reading problem details back
+func TestProblemDetails_JSON(t *testing.T) {
+	data := []byte(`{"type": "https://example.com/probs/x", "status": "oops", "detail": "gone", "trace_id": "abc"}`)
+
+	var problem ProblemDetails
+	if err := json.Unmarshal(data, &problem); err != nil {
+		t.Fatal(err)
+	}
+
+	if problem.Type != "https://example.com/probs/x" || problem.Status != 0 || problem.Detail != "gone" || problem.Extensions["trace_id"] != "abc" {
+		t.Errorf("unexpected problem %+v", problem)
+	}
+	if problem.Error() != "gone" {
+		t.Errorf("unexpected error message %q", problem.Error())
+	}
+}
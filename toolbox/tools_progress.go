@@ -0,0 +1,503 @@
+package toolbox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProgressHeartbeat = 15 * time.Second
+	progressRetention        = 10 * time.Minute // How long the last event of an upload is kept for late subscribers
+	progressBufferSize       = 32
+)
+
+// UploadProgress describes how far a chunked upload has come
+type UploadProgress struct {
+	UploadID       string        `json:"upload_id"`
+	State          UploadState   `json:"state"`
+	BytesReceived  int64         `json:"bytes_received"`
+	TotalBytes     int64         `json:"total_bytes"` // -1 if the size was not declared
+	ChunksReceived int64         `json:"chunks_received"`
+	TotalChunks    int64         `json:"total_chunks"`
+	Percent        float64       `json:"percent"`
+	BytesPerSecond float64       `json:"bytes_per_second"` // Average since the first chunk arrived
+	ETA            time.Duration `json:"eta"`              // 0 if it cannot be estimated
+	StartedAt      time.Time     `json:"started_at"`
+	UpdatedAt      time.Time     `json:"updated_at"`
+}
+
+// newUploadProgress computes the progress of session at now
+func newUploadProgress(session *UploadSession, now time.Time) *UploadProgress {
+	progress := &UploadProgress{
+		UploadID:       session.ID,
+		State:          session.State,
+		BytesReceived:  session.ReceivedBytes,
+		TotalBytes:     session.DeclaredSize,
+		ChunksReceived: session.ReceivedChunks,
+		TotalChunks:    session.TotalChunks,
+		StartedAt:      session.StartedAt,
+		UpdatedAt:      session.UpdatedAt,
+	}
+
+	if session.State == UploadStateCompleted {
+		if session.Result != nil {
+			progress.BytesReceived = session.Result.FileSize
+		}
+		progress.ChunksReceived = session.TotalChunks
+		progress.Percent = 100
+
+		// The rate of a finished upload is measured up to its last chunk
+		now = session.UpdatedAt
+	} else if session.DeclaredSize > 0 {
+		progress.Percent = float64(session.ReceivedBytes) / float64(session.DeclaredSize) * 100
+	} else if session.TotalChunks > 0 {
+		progress.Percent = float64(session.ReceivedChunks) / float64(session.TotalChunks) * 100
+	}
+
+	if elapsed := now.Sub(session.StartedAt); !session.StartedAt.IsZero() && elapsed > 0 {
+		progress.BytesPerSecond = float64(progress.BytesReceived) / elapsed.Seconds()
+	}
+
+	remaining := session.DeclaredSize - progress.BytesReceived
+	if progress.BytesPerSecond > 0 && session.DeclaredSize > 0 && remaining > 0 && session.State != UploadStateCompleted {
+		progress.ETA = time.Duration(float64(remaining) / progress.BytesPerSecond * float64(time.Second))
+	}
+
+	return progress
+}
+
+// UploadIDHeader names the upload a multipart request to UploadFiles belongs to, so its progress
+// can be followed with UploadProgressHandler. The upload_id query parameter works as well. The ID
+// must come from ProgressHub.NewUploadID.
+const UploadIDHeader = "X-Upload-ID"
+
+// Types of UploadEvent
+const (
+	UploadEventProgress  = "progress"  // More data was received
+	UploadEventState     = "state"     // The upload moved to another state
+	UploadEventCompleted = "completed" // The upload finished, Files holds the result
+	UploadEventFailed    = "failed"    // The upload failed, Error holds the reason
+)
+
+// UploadEvent reports the progress of an upload to subscribers of a ProgressHub
+type UploadEvent struct {
+	UploadID       string          `json:"upload_id"`
+	Type           string          `json:"type"`
+	State          UploadState     `json:"state,omitempty"`
+	BytesReceived  int64           `json:"bytes_received"`
+	TotalBytes     int64           `json:"total_bytes"` // -1 if not known
+	ChunksReceived int64           `json:"chunks_received,omitempty"`
+	TotalChunks    int64           `json:"total_chunks,omitempty"`
+	Files          []*UploadedFile `json:"files,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	Final          bool            `json:"final"` // No further events follow for this upload
+	Time           time.Time       `json:"time"`
+	Sequence       int64           `json:"-"`
+}
+
+// ProgressHub passes upload events from the upload methods of Tools to the clients following
+// them. Set Tools.ProgressHub to enable events.
+type ProgressHub struct {
+	Heartbeat time.Duration // Interval of keep-alive comments on idle streams (default 15s)
+
+	mu          sync.Mutex
+	sequence    int64
+	subscribers map[string]map[chan UploadEvent]struct{}
+	latest      map[string]UploadEvent
+	reserved    map[string]time.Time // IDs from NewUploadID that UploadFiles has not used yet
+	lastPrune   time.Time
+}
+
+// NewProgressHub returns an empty ProgressHub
+func NewProgressHub() *ProgressHub {
+	return &ProgressHub{
+		subscribers: make(map[string]map[chan UploadEvent]struct{}),
+		latest:      make(map[string]UploadEvent),
+	}
+}
+
+// Publish sends event to every subscriber of its upload. Publish never blocks: a subscriber that
+// falls behind loses its oldest unread events rather than holding up the upload.
+func (h *ProgressHub) Publish(event UploadEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subscribers == nil {
+		h.subscribers = make(map[string]map[chan UploadEvent]struct{})
+		h.latest = make(map[string]UploadEvent)
+	}
+
+	h.sequence++
+	event.Sequence = h.sequence
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	h.latest[event.UploadID] = event
+	h.prune(event.Time)
+
+	for events := range h.subscribers[event.UploadID] {
+		for {
+			select {
+			case events <- event:
+			default:
+				// Drop the oldest event to make room
+				select {
+				case <-events:
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+// prune forgets the last event of uploads that have been quiet for a while, and upload IDs that
+// were reserved but never used
+func (h *ProgressHub) prune(now time.Time) {
+	if now.Sub(h.lastPrune) < time.Minute {
+		return
+	}
+	h.lastPrune = now
+
+	for uploadID, event := range h.latest {
+		if now.Sub(event.Time) > progressRetention {
+			delete(h.latest, uploadID)
+		}
+	}
+
+	for uploadID, reservedAt := range h.reserved {
+		if now.Sub(reservedAt) > progressRetention {
+			delete(h.reserved, uploadID)
+		}
+	}
+}
+
+// NewUploadID reserves a random ID for a multipart request to UploadFiles. The server hands it to
+// the client, which follows its events and sends it in the X-Upload-ID header. UploadFiles only
+// publishes events for IDs reserved here, and only for the first request that uses one, so a
+// request cannot write into the events of another upload. Unused IDs expire after 10 minutes.
+func (h *ProgressHub) NewUploadID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	uploadID := "multipart-" + hex.EncodeToString(id)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.reserved == nil {
+		h.reserved = make(map[string]time.Time)
+	}
+	now := time.Now()
+	h.reserved[uploadID] = now
+	h.prune(now)
+
+	return uploadID, nil
+}
+
+// claim reports whether uploadID was reserved with NewUploadID and not used yet, and marks it used
+func (h *ProgressHub) claim(uploadID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	reservedAt, ok := h.reserved[uploadID]
+	delete(h.reserved, uploadID)
+	return ok && time.Since(reservedAt) <= progressRetention
+}
+
+// Subscribe returns a channel that receives the events of uploadID, and a function that ends the
+// subscription
+func (h *ProgressHub) Subscribe(uploadID string) (<-chan UploadEvent, func()) {
+	events := make(chan UploadEvent, progressBufferSize)
+
+	h.mu.Lock()
+	if h.subscribers == nil {
+		h.subscribers = make(map[string]map[chan UploadEvent]struct{})
+		h.latest = make(map[string]UploadEvent)
+	}
+	if h.subscribers[uploadID] == nil {
+		h.subscribers[uploadID] = make(map[chan UploadEvent]struct{})
+	}
+	h.subscribers[uploadID][events] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+
+			delete(h.subscribers[uploadID], events)
+			if len(h.subscribers[uploadID]) == 0 {
+				delete(h.subscribers, uploadID)
+			}
+		})
+	}
+}
+
+// Latest returns the last event published for uploadID, if it was recent
+func (h *ProgressHub) Latest(uploadID string) (UploadEvent, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	event, ok := h.latest[uploadID]
+	return event, ok
+}
+
+// heartbeat returns the interval of keep-alive comments
+func (h *ProgressHub) heartbeat() time.Duration {
+	if h.Heartbeat > 0 {
+		return h.Heartbeat
+	}
+	return defaultProgressHeartbeat
+}
+
+// publishEvent sends event to the ProgressHub, if one is set
+func (t *Tools) publishEvent(event UploadEvent) {
+	if t.ProgressHub == nil {
+		return
+	}
+
+	// Do not reveal where files are stored on the server
+	files := make([]*UploadedFile, len(event.Files))
+	for i, file := range event.Files {
+		files[i] = withoutPath(file)
+	}
+	event.Files = files
+
+	t.ProgressHub.Publish(event)
+}
+
+// publishChunkProgress publishes the progress of a chunked upload. It must be called with the
+// upload locked.
+func (t *Tools) publishChunkProgress(session *UploadSession) {
+	if t.ProgressHub == nil {
+		return
+	}
+
+	t.publishEvent(UploadEvent{
+		UploadID:       session.ID,
+		Type:           UploadEventProgress,
+		State:          session.State,
+		BytesReceived:  session.ReceivedBytes,
+		TotalBytes:     session.DeclaredSize,
+		ChunksReceived: session.ReceivedChunks,
+		TotalChunks:    session.TotalChunks,
+	})
+}
+
+// publishStateChange publishes the new state of a chunked upload
+func (t *Tools) publishStateChange(session *UploadSession) {
+	t.publishEvent(UploadEvent{
+		UploadID:    session.ID,
+		Type:        UploadEventState,
+		State:       session.State,
+		TotalBytes:  session.DeclaredSize,
+		TotalChunks: session.TotalChunks,
+		Final:       session.State.Terminal(),
+	})
+}
+
+// currentUploadEvent describes the current state of a chunked upload from its session
+func (t *Tools) currentUploadEvent(uploadID string) (UploadEvent, bool) {
+	session, err := t.GetUploadSession(uploadID)
+	if err != nil {
+		return UploadEvent{}, false
+	}
+
+	event := UploadEvent{
+		UploadID:       uploadID,
+		Type:           UploadEventProgress,
+		State:          session.State,
+		BytesReceived:  session.ReceivedBytes,
+		TotalBytes:     session.DeclaredSize,
+		ChunksReceived: session.ReceivedChunks,
+		TotalChunks:    session.TotalChunks,
+		Time:           session.UpdatedAt,
+	}
+
+	switch session.State {
+	case UploadStateCompleted:
+		event.Type = UploadEventCompleted
+		event.Final = true
+		if session.Result != nil {
+			event.BytesReceived = session.Result.FileSize
+			event.Files = []*UploadedFile{withoutPath(session.Result)}
+		}
+	case UploadStateCancelled, UploadStateExpired:
+		event.Type = UploadEventFailed
+		event.Error = fmt.Sprintf("upload %s is %s", uploadID, session.State)
+		event.Final = true
+	}
+
+	return event, true
+}
+
+// UploadProgressHandler returns an http.Handler that streams the events of one upload as
+// Server-Sent Events. The upload is taken from the {id} path wildcard if the handler is registered
+// with one, or else from the upload_id query parameter. Every event is a JSON encoded UploadEvent
+// whose SSE event name is its Type.
+//
+// The stream starts with the current state of the upload and ends after the final event or when
+// the client goes away. Idle streams get a comment every ProgressHub.Heartbeat so proxies keep the
+// connection open.
+func (t *Tools) UploadProgressHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploadID := r.PathValue("id")
+		if uploadID == "" {
+			uploadID = r.URL.Query().Get("upload_id")
+		}
+
+		if err := validateUploadID(uploadID); err != nil {
+			t.ErrorJSON(w, err)
+			return
+		}
+
+		hub := t.ProgressHub
+		if hub == nil {
+			t.ErrorJSON(w, errors.New("upload progress events are not enabled"), http.StatusNotImplemented)
+			return
+		}
+
+		// Subscribe before reading the current state so no event falls in between
+		events, unsubscribe := hub.Subscribe(uploadID)
+		defer unsubscribe()
+
+		current, ok := hub.Latest(uploadID)
+		if !ok {
+			current, ok = t.currentUploadEvent(uploadID)
+		}
+		if !ok {
+			// The upload may not have started yet; wait for its first event
+			current = UploadEvent{UploadID: uploadID, Type: UploadEventProgress, TotalBytes: -1, Time: time.Now()}
+		}
+
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		if err := writeUploadEvent(w, rc, current); err != nil || current.Final {
+			return
+		}
+
+		heartbeat := time.NewTicker(hub.heartbeat())
+		defer heartbeat.Stop()
+
+		lastSequence := current.Sequence
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+				if err := rc.Flush(); err != nil {
+					return
+				}
+			case event := <-events:
+				if event.Sequence <= lastSequence {
+					continue
+				}
+				lastSequence = event.Sequence
+
+				if err := writeUploadEvent(w, rc, event); err != nil || event.Final {
+					return
+				}
+			}
+		}
+	})
+}
+
+// writeUploadEvent writes event in the Server-Sent Events format and flushes it to the client
+func writeUploadEvent(w io.Writer, rc *http.ResponseController, event UploadEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if event.Sequence > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", event.Sequence); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+		return err
+	}
+
+	return rc.Flush()
+}
+
+// progressReader publishes progress events for a request body as it is read
+type progressReader struct {
+	io.ReadCloser
+	tools     *Tools
+	uploadID  string
+	total     int64
+	read      int64
+	published int64
+	step      int64
+}
+
+// newProgressReader wraps body so reading it publishes progress events for uploadID. Events are
+// published for every 1% of total, but no more often than every 64KB.
+func (t *Tools) newProgressReader(uploadID string, body io.ReadCloser, total int64) *progressReader {
+	step := total / 100
+	if step < 64*1024 {
+		step = 64 * 1024
+	}
+
+	return &progressReader{ReadCloser: body, tools: t, uploadID: uploadID, total: total, step: step}
+}
+
+// Read implements io.Reader
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.ReadCloser.Read(p)
+	pr.read += int64(n)
+
+	// The multipart reader may stop before EOF, so the end of the body counts as well
+	finished := err == io.EOF || pr.read == pr.total
+	if pr.read-pr.published >= pr.step || (finished && pr.read > pr.published) {
+		pr.published = pr.read
+		pr.tools.publishEvent(UploadEvent{
+			UploadID:      pr.uploadID,
+			Type:          UploadEventProgress,
+			State:         UploadStateUploading,
+			BytesReceived: pr.read,
+			TotalBytes:    pr.total,
+		})
+	}
+
+	return n, err
+}
+
+// progressUploadID returns the upload ID a multipart request declared, if it was reserved with
+// ProgressHub.NewUploadID and does not belong to a chunked upload
+func (t *Tools) progressUploadID(r *http.Request) string {
+	uploadID := r.Header.Get(UploadIDHeader)
+	if uploadID == "" {
+		uploadID = r.URL.Query().Get("upload_id")
+	}
+
+	if validateUploadID(uploadID) != nil || !t.ProgressHub.claim(uploadID) {
+		return ""
+	}
+
+	if _, err := t.sessionStore().Get(uploadID); !errors.Is(err, ErrUploadNotFound) {
+		return ""
+	}
+	return uploadID
+}
@@ -0,0 +1,399 @@
+package toolbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readUploadEvents parses the Server-Sent Events in body and sends them to events until the
+// stream ends. Heartbeat comments are sent as events of type "heartbeat".
+func readUploadEvents(body *bufio.Scanner, events chan<- UploadEvent) {
+	defer close(events)
+
+	var eventType string
+	for body.Scan() {
+		line := body.Text()
+		switch {
+		case line == ": heartbeat":
+			events <- UploadEvent{Type: "heartbeat"}
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			var event UploadEvent
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+			if event.Type != eventType {
+				event.Type = "mismatched event name " + eventType
+			}
+			events <- event
+		}
+	}
+}
+
+// nextEvent returns the next event, failing the test if none arrives in time
+func nextEvent(t *testing.T, events <-chan UploadEvent) UploadEvent {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("event stream ended")
+		}
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return UploadEvent{}
+}
+
+// TestTools_UploadProgressHandler tests the event stream of a chunked upload
+func TestTools_UploadProgressHandler(t *testing.T) {
+	setupTestDir(t, "./testdata/uploads/")
+	defer cleanupTestDir(t, "./testdata/uploads/")
+
+	tools := Tools{
+		ChunksDirectory:   "./testdata/chunks/",
+		UploadPath:        "./testdata/uploads/",
+		AllowUnknownTypes: true,
+		SessionStore:      NewMemorySessionStore(),
+		ProgressHub:       NewProgressHub(),
+	}
+	defer cleanupTestDir(t, tools.ChunksDirectory)
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /progress/{id}", tools.UploadProgressHandler())
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	if err := tools.InitChunkedUpload("sse", "sse.txt", 2, ChunkedUploadOptions{DeclaredSize: 11}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(server.URL + "/progress/sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %s", ct)
+	}
+
+	events := make(chan UploadEvent, 20)
+	go readUploadEvents(bufio.NewScanner(resp.Body), events)
+
+	// The stream starts with the current state
+	if event := nextEvent(t, events); event.State != UploadStateCreated || event.TotalBytes != 11 {
+		t.Errorf("expected the created state first, got %+v", event)
+	}
+
+	tools.UploadChunk("sse", "sse.txt", 0, 2, []byte("hello "))
+	if event := nextEvent(t, events); event.Type != UploadEventProgress || event.BytesReceived != 6 || event.ChunksReceived != 1 {
+		t.Errorf("expected progress for the first chunk, got %+v", event)
+	}
+
+	// A failed completion is reported but keeps the stream open
+	tools.CompleteChunkedUpload("sse", "sse.txt")
+	if event := nextEvent(t, events); event.State != UploadStateCompleting {
+		t.Errorf("expected the completing state, got %+v", event)
+	}
+	if event := nextEvent(t, events); event.Type != UploadEventFailed || event.Error == "" || event.Final {
+		t.Errorf("expected a failure that is not final, got %+v", event)
+	}
+
+	tools.UploadChunk("sse", "sse.txt", 1, 2, []byte("world"))
+	if event := nextEvent(t, events); event.BytesReceived != 11 || event.ChunksReceived != 2 {
+		t.Errorf("expected progress for both chunks, got %+v", event)
+	}
+
+	if _, err := tools.CompleteChunkedUpload("sse", "sse.txt"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(t, events) // completing
+
+	event := nextEvent(t, events)
+	if event.Type != UploadEventCompleted || !event.Final || len(event.Files) != 1 || event.Files[0].FileSize != 11 {
+		t.Errorf("expected a final completed event with the file, got %+v", event)
+	}
+	if len(event.Files) == 1 && event.Files[0].FilePath != "" {
+		t.Error("event reveals the server path of the file")
+	}
+
+	// The server ends the stream after the final event
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("expected the stream to end")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("stream was not closed")
+	}
+
+	// Late subscribers get the final event and nothing else
+	late, err := http.Get(server.URL + "/progress/sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := new(bytes.Buffer)
+	body.ReadFrom(late.Body)
+	late.Body.Close()
+	if strings.Count(body.String(), "event: ") != 1 || !strings.Contains(body.String(), "event: completed") {
+		t.Errorf("expected only the completed event, got %q", body)
+	}
+}
+
+// TestTools_UploadProgressHandler_Disconnect tests heartbeats and that subscriptions end with the request
+func TestTools_UploadProgressHandler_Disconnect(t *testing.T) {
+	hub := NewProgressHub()
+	hub.Heartbeat = 10 * time.Millisecond
+	tools := Tools{ChunksDirectory: "./testdata/chunks/", SessionStore: NewMemorySessionStore(), ProgressHub: hub}
+
+	server := httptest.NewServer(tools.UploadProgressHandler())
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"?upload_id=pending", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	events := make(chan UploadEvent, 20)
+	go readUploadEvents(bufio.NewScanner(resp.Body), events)
+
+	nextEvent(t, events) // The upload is not known yet
+	if event := nextEvent(t, events); event.Type != "heartbeat" {
+		t.Errorf("expected a heartbeat on an idle stream, got %+v", event)
+	}
+
+	cancel()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		hub.mu.Lock()
+		subscribers := len(hub.subscribers)
+		hub.mu.Unlock()
+
+		if subscribers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("subscription was not removed after the client disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if resp, err := http.Get(server.URL + "?upload_id=../x"); err == nil {
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected 400 for an invalid upload ID, got %d", resp.StatusCode)
+		}
+		resp.Body.Close()
+	}
+}
+
+// TestTools_UploadFilesProgress tests the events published while UploadFiles reads a request
+func TestTools_UploadFilesProgress(t *testing.T) {
+	setupTestDir(t, "./testdata/uploads/")
+	defer cleanupTestDir(t, "./testdata/uploads/")
+
+	tools := Tools{
+		MaxFileSize:       10 * 1024 * 1024,
+		AllowUnknownTypes: true,
+		ProgressHub:       NewProgressHub(),
+	}
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "big.txt")
+	part.Write(bytes.Repeat([]byte("a"), 300*1024))
+	writer.Close()
+
+	uploadID, err := tools.ProgressHub.NewUploadID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set(UploadIDHeader, uploadID)
+
+	events, unsubscribe := tools.ProgressHub.Subscribe(uploadID)
+	defer unsubscribe()
+
+	files, err := tools.UploadFiles(req, "./testdata/uploads/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var progress, last UploadEvent
+	for done := false; !done; {
+		select {
+		case event := <-events:
+			if event.Type == UploadEventProgress {
+				progress = event
+			}
+			last = event
+		default:
+			done = true
+		}
+	}
+
+	if progress.BytesReceived != req.ContentLength || progress.TotalBytes != req.ContentLength {
+		t.Errorf("expected progress up to %d bytes, got %+v", req.ContentLength, progress)
+	}
+	if last.Type != UploadEventCompleted || !last.Final || len(last.Files) != 1 || last.Files[0].FilePath != "" {
+		t.Errorf("expected a final completed event without server paths, got %+v", last)
+	}
+	if last.BytesReceived != req.ContentLength || last.Files[0].FileSize != files[0].FileSize {
+		t.Errorf("expected the completed event to report the whole request, got %+v", last)
+	}
+}
+
+// TestTools_UploadFilesProgressIDs tests that UploadFiles only publishes events for IDs reserved
+// with NewUploadID, once each, and never into the events of a chunked upload
+func TestTools_UploadFilesProgressIDs(t *testing.T) {
+	setupTestDir(t, "./testdata/uploads/")
+	defer cleanupTestDir(t, "./testdata/uploads/")
+
+	tools := Tools{
+		ChunksDirectory:   "./testdata/chunks/",
+		MaxFileSize:       1024,
+		AllowUnknownTypes: true,
+		ProgressHub:       NewProgressHub(),
+		SessionStore:      NewMemorySessionStore(),
+	}
+	defer cleanupTestDir(t, tools.ChunksDirectory)
+
+	used, _ := tools.ProgressHub.NewUploadID()
+	reserved, _ := tools.ProgressHub.NewUploadID()
+	if used == reserved {
+		t.Fatal("expected different upload IDs")
+	}
+
+	// A chunked upload that happens to have a reserved ID
+	if err := tools.InitChunkedUpload(reserved, "chunked.txt", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(uploadID string) {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", "small.txt")
+		part.Write([]byte("hello"))
+		writer.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/upload", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set(UploadIDHeader, uploadID)
+		if _, err := tools.UploadFiles(req, "./testdata/uploads/", true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	upload(used)
+	if _, ok := tools.ProgressHub.Latest(used); !ok {
+		t.Fatal("expected events for a reserved upload ID")
+	}
+
+	tests := []struct {
+		name     string
+		uploadID string
+	}{
+		{name: "not reserved", uploadID: "multipart-chosen-by-client"},
+		{name: "used before", uploadID: used},
+		{name: "chunked upload", uploadID: reserved},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			before, _ := tools.ProgressHub.Latest(tc.uploadID)
+			upload(tc.uploadID)
+			if after, _ := tools.ProgressHub.Latest(tc.uploadID); after.Sequence != before.Sequence {
+				t.Errorf("expected no events for %s, got %+v", tc.uploadID, after)
+			}
+		})
+	}
+}
+
+// TestTools_GetUploadProgress tests byte-based progress, rate and ETA
+func TestTools_GetUploadProgress(t *testing.T) {
+	setupTestDir(t, "./testdata/uploads/")
+	defer cleanupTestDir(t, "./testdata/uploads/")
+
+	tools := Tools{
+		ChunksDirectory:   "./testdata/chunks/",
+		UploadPath:        "./testdata/uploads/",
+		AllowUnknownTypes: true,
+		SessionStore:      NewMemorySessionStore(),
+	}
+	defer cleanupTestDir(t, tools.ChunksDirectory)
+
+	if err := tools.InitChunkedUpload("bytes", "bytes.txt", 3, ChunkedUploadOptions{DeclaredSize: 10, ChunkSize: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	progress, err := tools.GetUploadProgress("bytes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.BytesReceived != 0 || progress.TotalBytes != 10 || progress.Percent != 0 || progress.ETA != 0 {
+		t.Errorf("unexpected progress before the first chunk: %+v", progress)
+	}
+
+	tools.UploadChunk("bytes", "bytes.txt", 0, 3, []byte("abcd"))
+	time.Sleep(10 * time.Millisecond)
+
+	// Sending a chunk again replaces its bytes instead of adding to them
+	tools.UploadChunk("bytes", "bytes.txt", 0, 3, []byte("abcd"))
+	tools.UploadChunk("bytes", "bytes.txt", 2, 3, []byte("ij"))
+
+	progress, _ = tools.GetUploadProgress("bytes")
+	if progress.BytesReceived != 6 || progress.ChunksReceived != 2 || progress.Percent != 60 {
+		t.Errorf("expected 6 bytes in 2 chunks at 60%%, got %+v", progress)
+	}
+	if progress.BytesPerSecond <= 0 || progress.ETA <= 0 {
+		t.Errorf("expected a transfer rate and an ETA, got %+v", progress)
+	}
+
+	// A chunk that fails verification on completion no longer counts
+	sum, _ := ComputeChecksum(ChecksumSHA256, []byte("efgh"))
+	tools.UploadChunk("bytes", "bytes.txt", 1, 3, []byte("efgh"), sum)
+	os.WriteFile("./testdata/chunks/bytes/1", []byte("xxxx"), 0644)
+	if _, err := tools.CompleteChunkedUpload("bytes", "bytes.txt"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected a checksum error, got %v", err)
+	}
+	if progress, _ := tools.GetUploadProgress("bytes"); progress.BytesReceived != 6 || progress.ChunksReceived != 2 {
+		t.Errorf("expected the corrupt chunk to be discounted, got %+v", progress)
+	}
+
+	tools.UploadChunk("bytes", "bytes.txt", 1, 3, []byte("efgh"), sum)
+	if _, err := tools.CompleteChunkedUpload("bytes", "bytes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	progress, _ = tools.GetUploadProgress("bytes")
+	if progress.Percent != 100 || progress.BytesReceived != 10 || progress.ETA != 0 {
+		t.Errorf("expected a finished upload, got %+v", progress)
+	}
+
+	// Without a declared size, progress is counted in chunks
+	tools.UploadChunk("unsized", "unsized.txt", 0, 4, []byte("data"))
+	progress, _ = tools.GetUploadProgress("unsized")
+	if progress.TotalBytes != -1 || progress.Percent != 25 || progress.ETA != 0 {
+		t.Errorf("expected chunk-based progress without an ETA, got %+v", progress)
+	}
+
+	tools.CancelChunkedUpload("unsized")
+	if _, err := tools.GetUploadProgress("unsized"); !errors.Is(err, ErrInvalidUploadState) {
+		t.Errorf("expected ErrInvalidUploadState for a cancelled upload, got %v", err)
+	}
+}
@@ -291,8 +291,8 @@ func TestTools_UploadProgress(t *testing.T) {
 		expectedProgress := float64(i+1) / float64(totalChunks) * 100.0
 		
 		// Allow for small floating point differences
-		if progress < expectedProgress-0.1 || progress > expectedProgress+0.1 {
-			t.Errorf("Expected progress around %.2f%%, got %.2f%%", expectedProgress, progress)
+		if progress.Percent < expectedProgress-0.1 || progress.Percent > expectedProgress+0.1 {
+			t.Errorf("Expected progress around %.2f%%, got %.2f%%", expectedProgress, progress.Percent)
 		}
 	}
 	
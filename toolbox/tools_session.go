@@ -0,0 +1,455 @@
+package toolbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadState is the lifecycle state of a chunked upload session
+type UploadState string
+
+// States of a chunked upload session
+const (
+	UploadStateCreated    UploadState = "created"    // Registered, no chunk received yet
+	UploadStateUploading  UploadState = "uploading"  // At least one chunk received
+	UploadStateCompleting UploadState = "completing" // Chunks are being assembled
+	UploadStateCompleted  UploadState = "completed"  // The file was assembled and accepted
+	UploadStateCancelled  UploadState = "cancelled"  // The upload was cancelled by the client
+	UploadStateExpired    UploadState = "expired"    // The upload was purged by the janitor
+)
+
+// uploadTransitions lists the states each state may move to. Assembly holds the upload lock, so a
+// session found completing under the lock was left behind by an interrupted assembly; it can be
+// completed again, cancelled or expired.
+var uploadTransitions = map[UploadState][]UploadState{
+	UploadStateCreated:    {UploadStateUploading, UploadStateCompleting, UploadStateCancelled, UploadStateExpired},
+	UploadStateUploading:  {UploadStateUploading, UploadStateCompleting, UploadStateCancelled, UploadStateExpired},
+	UploadStateCompleting: {UploadStateUploading, UploadStateCompleting, UploadStateCompleted, UploadStateCancelled, UploadStateExpired},
+}
+
+// Terminal reports whether no further transition is possible from the state
+func (s UploadState) Terminal() bool {
+	return len(uploadTransitions[s]) == 0
+}
+
+// UploadSession is the persisted state of a chunked upload
+type UploadSession struct {
+	ID           string            `json:"id"`
+	FileName     string            `json:"file_name"`
+	Owner        string            `json:"owner,omitempty"`
+	DeclaredSize int64             `json:"declared_size"` // -1 when the client did not declare a size
+	ContentType  string            `json:"content_type,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	TotalChunks  int64             `json:"total_chunks"`
+	ChunkSize    int64             `json:"chunk_size,omitempty"` // Size of every chunk but the last, if known
+	Checksum     *Checksum         `json:"checksum,omitempty"`
+	State        UploadState       `json:"state"`
+	CreatedAt    time.Time         `json:"created_at"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+	Result       *UploadedFile     `json:"result,omitempty"` // Set once the upload is completed
+
+	// Progress, updated under the upload lock as chunks are stored
+	ReceivedBytes  int64     `json:"received_bytes"`
+	ReceivedChunks int64     `json:"received_chunks"`
+	StartedAt      time.Time `json:"started_at"` // When the first chunk arrived
+}
+
+// ChunkedUploadOptions holds the optional settings for InitChunkedUpload
+type ChunkedUploadOptions struct {
+	Owner        string            // Who the upload belongs to, e.g. a user ID
+	DeclaredSize int64             // Total size of the file in bytes, or -1 if unknown
+	ContentType  string            // Content type claimed by the client
+	Metadata     map[string]string // Custom metadata kept with the session
+	ChunkSize    int64             // Size of every chunk but the last; defaults to Tools.ChunkSize
+
+	// Checksum of the whole file, verified when the upload is completed
+	Checksum *Checksum
+}
+
+// Transition moves the session to a new state, returning an error wrapping
+// ErrInvalidUploadState if the lifecycle does not allow it
+func (s *UploadSession) Transition(to UploadState) error {
+	for _, allowed := range uploadTransitions[s.State] {
+		if allowed == to {
+			s.State = to
+			s.UpdatedAt = time.Now()
+			return nil
+		}
+	}
+
+	return &ErrorResponse{
+		Err:     ErrInvalidUploadState,
+		Message: fmt.Sprintf("upload %s cannot move from %s to %s", s.ID, s.State, to),
+	}
+}
+
+// clone returns a deep copy of the session so stores never share state with callers
+func (s *UploadSession) clone() *UploadSession {
+	c := *s
+	if s.Metadata != nil {
+		c.Metadata = make(map[string]string, len(s.Metadata))
+		for k, v := range s.Metadata {
+			c.Metadata[k] = v
+		}
+	}
+	if s.Checksum != nil {
+		checksum := *s.Checksum
+		c.Checksum = &checksum
+	}
+	if s.Result != nil {
+		result := *s.Result
+		c.Result = &result
+	}
+	return &c
+}
+
+// UploadSessionFilter narrows the sessions returned by UploadSessionStore.List. Empty fields match
+// every session.
+type UploadSessionFilter struct {
+	Owner  string
+	States []UploadState
+}
+
+// matches reports whether the session passes the filter
+func (f UploadSessionFilter) matches(s *UploadSession) bool {
+	if f.Owner != "" && f.Owner != s.Owner {
+		return false
+	}
+
+	if len(f.States) == 0 {
+		return true
+	}
+
+	for _, state := range f.States {
+		if s.State == state {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UploadSessionStore persists upload sessions. Get returns an error wrapping ErrUploadNotFound for
+// unknown IDs, and Create one wrapping ErrUploadExists if the ID is taken. Implementations must be
+// safe for concurrent use.
+type UploadSessionStore interface {
+	Create(session *UploadSession) error
+	Get(id string) (*UploadSession, error)
+	Save(session *UploadSession) error
+	Delete(id string) error
+	List(filter UploadSessionFilter) ([]*UploadSession, error)
+}
+
+// uploadIDPattern restricts upload IDs to names that are safe to use as a single path element
+var uploadIDPattern = regexp.MustCompile(`^[A-Za-z0-9_+=-][A-Za-z0-9._+=-]{0,127}$`)
+
+// validateUploadID rejects IDs that could escape the chunks directory
+func validateUploadID(uploadID string) error {
+	if !uploadIDPattern.MatchString(uploadID) {
+		return &ErrorResponse{
+			Err:     ErrInvalidUploadID,
+			Message: fmt.Sprintf("invalid upload ID %q", uploadID),
+		}
+	}
+	return nil
+}
+
+// errUploadNotFound builds the error returned for unknown upload IDs
+func errUploadNotFound(uploadID string) error {
+	return &ErrorResponse{
+		Err:     ErrUploadNotFound,
+		Message: fmt.Sprintf("upload ID %s not found", uploadID),
+	}
+}
+
+// FileSessionStore keeps each session in a JSON file named after the upload ID, so sessions
+// survive restarts
+type FileSessionStore struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+// NewFileSessionStore returns a store that keeps its sessions in dir
+func NewFileSessionStore(dir string) *FileSessionStore {
+	return &FileSessionStore{Dir: dir}
+}
+
+// sessionPath returns the file holding the session with the given ID
+func (fs *FileSessionStore) sessionPath(id string) string {
+	return filepath.Join(fs.Dir, id+".json")
+}
+
+// Create stores a new session
+func (fs *FileSessionStore) Create(session *UploadSession) error {
+	if err := validateUploadID(session.ID); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, err := os.Stat(fs.sessionPath(session.ID)); err == nil {
+		return &ErrorResponse{
+			Err:     ErrUploadExists,
+			Message: fmt.Sprintf("upload ID %s already exists", session.ID),
+		}
+	}
+
+	return fs.write(session)
+}
+
+// Get loads the session with the given ID
+func (fs *FileSessionStore) Get(id string) (*UploadSession, error) {
+	if err := validateUploadID(id); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(fs.sessionPath(id))
+	if os.IsNotExist(err) {
+		return nil, errUploadNotFound(id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload session: %w", err)
+	}
+
+	var session UploadSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("failed to parse upload session: %w", err)
+	}
+
+	return &session, nil
+}
+
+// Save overwrites an existing session
+func (fs *FileSessionStore) Save(session *UploadSession) error {
+	if err := validateUploadID(session.ID); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, err := os.Stat(fs.sessionPath(session.ID)); os.IsNotExist(err) {
+		return errUploadNotFound(session.ID)
+	}
+
+	return fs.write(session)
+}
+
+// write atomically replaces the session file
+func (fs *FileSessionStore) write(session *UploadSession) error {
+	if err := os.MkdirAll(fs.Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create session directory: %w", err)
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to encode upload session: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(fs.Dir, "temp_session_*")
+	if err != nil {
+		return fmt.Errorf("failed to save upload session: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save upload session: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save upload session: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), fs.sessionPath(session.ID)); err != nil {
+		return fmt.Errorf("failed to save upload session: %w", err)
+	}
+
+	return nil
+}
+
+// Delete removes a session. Deleting an unknown session is not an error.
+func (fs *FileSessionStore) Delete(id string) error {
+	if err := validateUploadID(id); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := os.Remove(fs.sessionPath(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete upload session: %w", err)
+	}
+
+	return nil
+}
+
+// List returns the sessions matching filter, oldest first
+func (fs *FileSessionStore) List(filter UploadSessionFilter) ([]*UploadSession, error) {
+	entries, err := os.ReadDir(fs.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session directory: %w", err)
+	}
+
+	var sessions []*UploadSession
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+
+		session, err := fs.Get(id)
+		if errors.Is(err, ErrUploadNotFound) {
+			continue // Deleted while listing
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if filter.matches(session) {
+			sessions = append(sessions, session)
+		}
+	}
+
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+// MemorySessionStore keeps sessions in memory. Sessions are lost when the process exits, which
+// makes it mostly useful for tests and single-instance deployments that do not need to resume
+// after a restart.
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*UploadSession
+}
+
+// NewMemorySessionStore returns an empty in-memory store
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]*UploadSession)}
+}
+
+// Create stores a new session
+func (ms *MemorySessionStore) Create(session *UploadSession) error {
+	if err := validateUploadID(session.ID); err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, exists := ms.sessions[session.ID]; exists {
+		return &ErrorResponse{
+			Err:     ErrUploadExists,
+			Message: fmt.Sprintf("upload ID %s already exists", session.ID),
+		}
+	}
+
+	ms.sessions[session.ID] = session.clone()
+	return nil
+}
+
+// Get returns the session with the given ID
+func (ms *MemorySessionStore) Get(id string) (*UploadSession, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	session, exists := ms.sessions[id]
+	if !exists {
+		return nil, errUploadNotFound(id)
+	}
+
+	return session.clone(), nil
+}
+
+// Save overwrites an existing session
+func (ms *MemorySessionStore) Save(session *UploadSession) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, exists := ms.sessions[session.ID]; !exists {
+		return errUploadNotFound(session.ID)
+	}
+
+	ms.sessions[session.ID] = session.clone()
+	return nil
+}
+
+// Delete removes a session. Deleting an unknown session is not an error.
+func (ms *MemorySessionStore) Delete(id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.sessions, id)
+	return nil
+}
+
+// List returns the sessions matching filter, oldest first
+func (ms *MemorySessionStore) List(filter UploadSessionFilter) ([]*UploadSession, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var sessions []*UploadSession
+	for _, session := range ms.sessions {
+		if filter.matches(session) {
+			sessions = append(sessions, session.clone())
+		}
+	}
+
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+// sortSessions orders sessions by creation time, then ID
+func sortSessions(sessions []*UploadSession) {
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].CreatedAt.Equal(sessions[j].CreatedAt) {
+			return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+}
+
+// defaultSessionStores holds the file store of each .sessions directory. Like uploadLocks it is
+// shared by every Tools value, so the store's mutex serialises all access to the same directory.
+var defaultSessionStores sync.Map
+
+// sessionStore returns the configured store, or a file store kept in the .sessions directory
+// inside ChunksDirectory
+func (t *Tools) sessionStore() UploadSessionStore {
+	if t.SessionStore != nil {
+		return t.SessionStore
+	}
+
+	dir := filepath.Join(t.ChunksDirectory, ".sessions")
+	key, err := filepath.Abs(dir)
+	if err != nil {
+		key = dir
+	}
+
+	store, _ := defaultSessionStores.LoadOrStore(key, NewFileSessionStore(dir))
+	return store.(*FileSessionStore)
+}
+
+// GetUploadSession returns the session of a chunked upload
+func (t *Tools) GetUploadSession(uploadID string) (*UploadSession, error) {
+	if err := validateUploadID(uploadID); err != nil {
+		return nil, err
+	}
+	return t.sessionStore().Get(uploadID)
+}
+
+// ListUploadSessions returns the sessions matching filter
+func (t *Tools) ListUploadSessions(filter UploadSessionFilter) ([]*UploadSession, error) {
+	return t.sessionStore().List(filter)
+}
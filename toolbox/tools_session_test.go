@@ -0,0 +1,297 @@
+package toolbox
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestUploadSessionStores runs the same checks against every session store
+func TestUploadSessionStores(t *testing.T) {
+	setupTestDir(t, "./testdata/sessions/")
+	defer cleanupTestDir(t, "./testdata/sessions/")
+
+	stores := []struct {
+		name  string
+		store UploadSessionStore
+	}{
+		{name: "file", store: NewFileSessionStore("./testdata/sessions/")},
+		{name: "memory", store: NewMemorySessionStore()},
+	}
+
+	for _, tc := range stores {
+		t.Run(tc.name, func(t *testing.T) {
+			store := tc.store
+			now := time.Now()
+
+			first := newUploadSession("first", "a.txt", 2, ChunkedUploadOptions{Owner: "alice", DeclaredSize: -5, Metadata: map[string]string{"album": "holiday"}})
+			first.CreatedAt = now.Add(-time.Minute)
+			second := newUploadSession("second", "b.txt", 3, ChunkedUploadOptions{Owner: "bob", DeclaredSize: 300})
+			second.CreatedAt = now
+
+			for _, s := range []*UploadSession{first, second} {
+				if err := store.Create(s); err != nil {
+					t.Fatalf("failed to create session: %v", err)
+				}
+			}
+
+			if err := store.Create(first); !errors.Is(err, ErrUploadExists) {
+				t.Errorf("expected ErrUploadExists, got %v", err)
+			}
+
+			got, err := store.Get("first")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Owner != "alice" || got.Metadata["album"] != "holiday" || got.DeclaredSize != -1 {
+				t.Errorf("session not stored correctly: %+v", got)
+			}
+
+			// Changing the returned copy must not change the store until it is saved
+			got.Metadata["album"] = "work"
+			if again, _ := store.Get("first"); again.Metadata["album"] != "holiday" {
+				t.Error("store shares state with the caller")
+			}
+
+			if err := got.Transition(UploadStateUploading); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Save(got); err != nil {
+				t.Fatal(err)
+			}
+
+			uploading, err := store.List(UploadSessionFilter{States: []UploadState{UploadStateUploading}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(uploading) != 1 || uploading[0].ID != "first" {
+				t.Errorf("expected only the first session to be uploading, got %d sessions", len(uploading))
+			}
+
+			all, _ := store.List(UploadSessionFilter{})
+			if len(all) != 2 || all[0].ID != "first" || all[1].ID != "second" {
+				t.Errorf("expected both sessions oldest first, got %d sessions", len(all))
+			}
+
+			owned, _ := store.List(UploadSessionFilter{Owner: "bob"})
+			if len(owned) != 1 || owned[0].ID != "second" {
+				t.Errorf("expected bob's session only, got %d sessions", len(owned))
+			}
+
+			if err := store.Delete("second"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Get("second"); !errors.Is(err, ErrUploadNotFound) {
+				t.Errorf("expected ErrUploadNotFound, got %v", err)
+			}
+			if err := store.Save(second); !errors.Is(err, ErrUploadNotFound) {
+				t.Errorf("expected ErrUploadNotFound when saving a deleted session, got %v", err)
+			}
+		})
+	}
+
+	// Sessions written by one file store are visible to a new one, as after a restart
+	restarted := NewFileSessionStore("./testdata/sessions/")
+	if session, err := restarted.Get("first"); err != nil || session.State != UploadStateUploading {
+		t.Errorf("session did not survive a restart: %v", err)
+	}
+}
+
+// TestUploadSession_Transition tests the allowed and forbidden state transitions
+func TestUploadSession_Transition(t *testing.T) {
+	tests := []struct {
+		from    UploadState
+		to      UploadState
+		allowed bool
+	}{
+		{UploadStateCreated, UploadStateUploading, true},
+		{UploadStateUploading, UploadStateCompleting, true},
+		{UploadStateCompleting, UploadStateCompleted, true},
+		{UploadStateCompleting, UploadStateUploading, true},
+		{UploadStateCompleting, UploadStateCompleting, true},
+		{UploadStateCompleting, UploadStateCancelled, true},
+		{UploadStateCompleting, UploadStateExpired, true},
+		{UploadStateUploading, UploadStateCancelled, true},
+		{UploadStateUploading, UploadStateExpired, true},
+		{UploadStateCreated, UploadStateCompleted, false},
+		{UploadStateCompleted, UploadStateUploading, false},
+		{UploadStateCancelled, UploadStateUploading, false},
+		{UploadStateExpired, UploadStateCancelled, false},
+	}
+
+	for _, tc := range tests {
+		session := &UploadSession{ID: "id", State: tc.from}
+		err := session.Transition(tc.to)
+
+		if tc.allowed && err != nil {
+			t.Errorf("%s -> %s should be allowed: %v", tc.from, tc.to, err)
+		}
+		if !tc.allowed && !errors.Is(err, ErrInvalidUploadState) {
+			t.Errorf("%s -> %s should fail with ErrInvalidUploadState, got %v", tc.from, tc.to, err)
+		}
+	}
+}
+
+// TestTools_UploadSessionLifecycle tests the states a chunked upload goes through
+func TestTools_UploadSessionLifecycle(t *testing.T) {
+	setupTestDir(t, "./testdata/uploads/")
+	defer cleanupTestDir(t, "./testdata/uploads/")
+
+	tools := Tools{
+		ChunksDirectory: "./testdata/chunks/",
+		UploadPath:      "./testdata/uploads/",
+		SessionStore:    NewMemorySessionStore(),
+	}
+	defer cleanupTestDir(t, tools.ChunksDirectory)
+
+	expectState := func(uploadID string, state UploadState) {
+		t.Helper()
+		session, err := tools.GetUploadSession(uploadID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.State != state {
+			t.Errorf("expected state %s, got %s", state, session.State)
+		}
+	}
+
+	err := tools.InitChunkedUpload("lifecycle", "life.txt", 2, ChunkedUploadOptions{
+		Owner:       "alice",
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"folder": "docs"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectState("lifecycle", UploadStateCreated)
+
+	if err := tools.InitChunkedUpload("lifecycle", "life.txt", 2); !errors.Is(err, ErrUploadExists) {
+		t.Errorf("expected ErrUploadExists, got %v", err)
+	}
+
+	if err := tools.UploadChunk("lifecycle", "life.txt", 0, 2, []byte("hello ")); err != nil {
+		t.Fatal(err)
+	}
+	expectState("lifecycle", UploadStateUploading)
+
+	if err := tools.UploadChunk("lifecycle", "life.txt", 5, 2, []byte("x")); !errors.Is(err, ErrInvalidChunkNumber) {
+		t.Errorf("expected ErrInvalidChunkNumber, got %v", err)
+	}
+
+	// Completing with a chunk missing goes back to uploading
+	if _, err := tools.CompleteChunkedUpload("lifecycle", "life.txt"); err == nil {
+		t.Fatal("expected error for missing chunk")
+	}
+	expectState("lifecycle", UploadStateUploading)
+
+	if err := tools.UploadChunk("lifecycle", "life.txt", 1, 2, []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+
+	// An assembly interrupted by a crash leaves the session completing; it can be completed again
+	interrupted, _ := tools.GetUploadSession("lifecycle")
+	interrupted.State = UploadStateCompleting
+	tools.sessionStore().Save(interrupted)
+
+	file, err := tools.CompleteChunkedUpload("lifecycle", "life.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.FilePath)
+
+	session, _ := tools.GetUploadSession("lifecycle")
+	if session.State != UploadStateCompleted || session.Result == nil || session.Result.FileSize != 11 {
+		t.Errorf("completed session not recorded correctly: %+v", session)
+	}
+	if session.Owner != "alice" || session.Metadata["folder"] != "docs" {
+		t.Errorf("session lost its owner or metadata: %+v", session)
+	}
+
+	if err := tools.UploadChunk("lifecycle", "life.txt", 0, 2, []byte("again")); !errors.Is(err, ErrInvalidUploadState) {
+		t.Errorf("expected ErrInvalidUploadState after completion, got %v", err)
+	}
+
+	// Cancelled uploads are kept as cancelled sessions and drop out of the active list
+	if err := tools.UploadChunk("cancelled", "c.txt", 0, 2, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tools.CancelChunkedUpload("cancelled"); err != nil {
+		t.Fatal(err)
+	}
+	expectState("cancelled", UploadStateCancelled)
+
+	active, err := tools.ListActiveUploads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 0 {
+		t.Errorf("expected no active uploads, got %v", active)
+	}
+
+	if err := tools.UploadChunk("../escape", "x.txt", 0, 1, []byte("x")); !errors.Is(err, ErrInvalidUploadID) {
+		t.Errorf("expected ErrInvalidUploadID, got %v", err)
+	}
+
+	// An empty file declares a size of 0; only a missing size is unknown
+	sizes := map[string]int64{"empty": 0, "unknown": -1}
+	tools.InitChunkedUpload("empty", "empty.txt", 1, ChunkedUploadOptions{DeclaredSize: 0})
+	tools.InitChunkedUpload("unknown", "unknown.txt", 1)
+	for uploadID, size := range sizes {
+		if session, err := tools.GetUploadSession(uploadID); err != nil || session.DeclaredSize != size {
+			t.Errorf("expected %s to declare %d bytes, got %+v (%v)", uploadID, size, session, err)
+		}
+	}
+}
+
+// TestTools_DefaultSessionStoreShared tests that Tools values using the same ChunksDirectory share
+// one file store, so its mutex covers all of them
+func TestTools_DefaultSessionStoreShared(t *testing.T) {
+	first := &Tools{ChunksDirectory: "./testdata/chunks/"}
+	second := &Tools{ChunksDirectory: "testdata/chunks"}
+	other := &Tools{ChunksDirectory: "./testdata/other/"}
+
+	if first.sessionStore() != first.sessionStore() || first.sessionStore() != second.sessionStore() {
+		t.Error("expected the same file store for the same directory")
+	}
+	if first.sessionStore() == other.sessionStore() {
+		t.Error("expected a separate file store for another directory")
+	}
+}
+
+// failingSaveStore is a session store that cannot save sessions in a given state
+type failingSaveStore struct {
+	UploadSessionStore
+	state UploadState
+}
+
+func (fs failingSaveStore) Save(session *UploadSession) error {
+	if session.State == fs.state {
+		return errors.New("store unavailable")
+	}
+	return fs.UploadSessionStore.Save(session)
+}
+
+// TestTools_CompleteChunkedUploadRollbackError tests that failing to reopen an upload is reported
+func TestTools_CompleteChunkedUploadRollbackError(t *testing.T) {
+	setupTestDir(t, "./testdata/uploads/")
+	defer cleanupTestDir(t, "./testdata/uploads/")
+
+	tools := Tools{
+		ChunksDirectory: "./testdata/chunks/",
+		UploadPath:      "./testdata/uploads/",
+		SessionStore:    NewMemorySessionStore(),
+	}
+	defer cleanupTestDir(t, tools.ChunksDirectory)
+
+	if err := tools.UploadChunk("rollback", "r.txt", 0, 2, []byte("half")); err != nil {
+		t.Fatal(err)
+	}
+	tools.SessionStore = failingSaveStore{UploadSessionStore: tools.SessionStore, state: UploadStateUploading}
+
+	_, err := tools.CompleteChunkedUpload("rollback", "r.txt")
+	if !errors.Is(err, ErrFileCreation) || !strings.Contains(err.Error(), "store unavailable") {
+		t.Errorf("expected the missing chunk and the failed rollback, got %v", err)
+	}
+}
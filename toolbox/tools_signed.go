@@ -0,0 +1,361 @@
+package toolbox
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSignedURLTTL is how long a signed download link is valid if no TTL is given
+const defaultSignedURLTTL = time.Hour
+
+// Errors returned by VerifySignedDownload
+var (
+	ErrInvalidSignature     = errors.New("invalid download signature")
+	ErrLinkExpired          = errors.New("download link expired")
+	ErrDownloadLimitReached = errors.New("download limit reached")
+)
+
+// Query parameters of a signed download link
+const (
+	signedParamPath    = "path"
+	signedParamExpires = "expires"
+	signedParamMax     = "max"
+	signedParamBind    = "bind"
+	signedParamID      = "id"
+	signedParamKey     = "kid"
+	signedParamSig     = "sig"
+
+	// signedParamClient is part of the signed message but never of the link, so the address a
+	// link is bound to is not disclosed
+	signedParamClient = "client"
+)
+
+// SigningKey is a secret used to sign download links
+type SigningKey struct {
+	ID     string // Sent with each link so the key can be found again; must be unique
+	Secret []byte // At least 32 random bytes
+}
+
+// SignedURLOptions holds the optional settings for SignDownloadURL
+type SignedURLOptions struct {
+	TTL          time.Duration // How long the link is valid (default 1 hour)
+	ClientIP     string        // If set, the link only works for requests from this address
+	MaxDownloads int           // If positive, how many times the file may be downloaded
+}
+
+// SignedDownload is a verified download link
+type SignedDownload struct {
+	ID           string    // Random identifier of the link, used to count downloads
+	Path         string    // Path of the file, relative to the download root
+	ExpiresAt    time.Time // When the link stops working
+	MaxDownloads int       // Zero if the number of downloads is not limited
+}
+
+// clientIP returns the address of the client that sent r
+func (t *Tools) clientIP(r *http.Request) string {
+	if t.ClientIP != nil {
+		return t.ClientIP(r)
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// SignDownloadURL returns baseURL with the query parameters of a signed link to the file at
+// filePath, relative to the root served by SignedDownloadHandler. The link is signed with the
+// first of t.SigningKeys.
+func (t *Tools) SignDownloadURL(baseURL, filePath string, opts ...SignedURLOptions) (string, error) {
+	var options SignedURLOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+
+	if len(t.SigningKeys) == 0 {
+		return "", errors.New("no signing key configured")
+	}
+	key := t.SigningKeys[0]
+
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid base URL: %w", err)
+	}
+
+	ttl := options.TTL
+	if ttl <= 0 {
+		ttl = defaultSignedURLTTL
+	}
+
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set(signedParamPath, cleanSignedPath(filePath))
+	params.Set(signedParamExpires, strconv.FormatInt(time.Now().Add(ttl).Unix(), 10))
+	params.Set(signedParamID, hex.EncodeToString(id))
+	params.Set(signedParamKey, key.ID)
+	if options.MaxDownloads > 0 {
+		params.Set(signedParamMax, strconv.Itoa(options.MaxDownloads))
+	}
+	if options.ClientIP != "" {
+		params.Set(signedParamBind, "ip")
+	}
+
+	params.Set(signedParamSig, signDownload(key.Secret, params, options.ClientIP))
+
+	query := u.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// VerifySignedDownload checks the signature, expiry and client binding of the signed link r was
+// sent to. Any of t.SigningKeys is accepted, so keys can be rotated by adding a new key in front
+// and removing the old one once its links have expired. Download limits are enforced by
+// SignedDownloadHandler.
+func (t *Tools) VerifySignedDownload(r *http.Request) (*SignedDownload, error) {
+	query := r.URL.Query()
+
+	params := url.Values{}
+	for _, name := range []string{signedParamPath, signedParamExpires, signedParamMax, signedParamBind, signedParamID, signedParamKey} {
+		if values, ok := query[name]; ok {
+			if len(values) != 1 {
+				return nil, &ErrorResponse{Err: ErrInvalidSignature, Message: fmt.Sprintf("repeated %s parameter", name)}
+			}
+			params[name] = values
+		}
+	}
+
+	signature := query.Get(signedParamSig)
+	if signature == "" || params.Get(signedParamPath) == "" {
+		return nil, &ErrorResponse{Err: ErrInvalidSignature, Message: "missing signature"}
+	}
+
+	var clientIP string
+	switch params.Get(signedParamBind) {
+	case "":
+	case "ip":
+		clientIP = t.clientIP(r)
+	default:
+		return nil, &ErrorResponse{Err: ErrInvalidSignature, Message: "unknown link binding"}
+	}
+
+	// Check every key with the ID of the link, comparing in constant time
+	kid := params.Get(signedParamKey)
+	valid := false
+	for _, key := range t.SigningKeys {
+		if key.ID != kid {
+			continue
+		}
+		if hmac.Equal([]byte(signature), []byte(signDownload(key.Secret, params, clientIP))) {
+			valid = true
+		}
+	}
+	if !valid {
+		return nil, &ErrorResponse{Err: ErrInvalidSignature, Message: "invalid download signature"}
+	}
+
+	expires, err := strconv.ParseInt(params.Get(signedParamExpires), 10, 64)
+	if err != nil {
+		return nil, &ErrorResponse{Err: ErrInvalidSignature, Message: "invalid expiry"}
+	}
+	download := &SignedDownload{
+		ID:        params.Get(signedParamID),
+		Path:      params.Get(signedParamPath),
+		ExpiresAt: time.Unix(expires, 0),
+	}
+	if !time.Now().Before(download.ExpiresAt) {
+		return nil, &ErrorResponse{Err: ErrLinkExpired, Message: "download link expired"}
+	}
+
+	if max := params.Get(signedParamMax); max != "" {
+		if download.MaxDownloads, err = strconv.Atoi(max); err != nil || download.MaxDownloads <= 0 {
+			return nil, &ErrorResponse{Err: ErrInvalidSignature, Message: "invalid download limit"}
+		}
+	}
+
+	return download, nil
+}
+
+// signDownload computes the signature of the link parameters, bound to clientIP if it is set
+func signDownload(secret []byte, params url.Values, clientIP string) string {
+	message := url.Values{}
+	for name, values := range params {
+		if name != signedParamSig {
+			message[name] = values
+		}
+	}
+	if clientIP != "" {
+		message.Set(signedParamClient, clientIP)
+	}
+
+	// Encode sorts the parameters and escapes their values, so the message is unambiguous
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(message.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// cleanSignedPath returns filePath as a relative slash-separated path that cannot leave its root
+func cleanSignedPath(filePath string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(filePath, "\\", "/")), "/")
+}
+
+// downloadCounter counts the downloads of signed links until they expire
+type downloadCounter struct {
+	mu     sync.Mutex
+	counts map[string]*downloadCount
+}
+
+type downloadCount struct {
+	n         int
+	expiresAt time.Time
+}
+
+// take records a download of link and reports whether it is still within its limit
+func (dc *downloadCounter) take(link *SignedDownload) bool {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	now := time.Now()
+	for id, count := range dc.counts {
+		if !now.Before(count.expiresAt) {
+			delete(dc.counts, id)
+		}
+	}
+
+	count, ok := dc.counts[link.ID]
+	if !ok {
+		count = &downloadCount{expiresAt: link.ExpiresAt}
+		dc.counts[link.ID] = count
+	}
+	if count.n >= link.MaxDownloads {
+		return false
+	}
+
+	count.n++
+	return true
+}
+
+// exhausted reports whether link has used up its downloads
+func (dc *downloadCounter) exhausted(link *SignedDownload) bool {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	count, ok := dc.counts[link.ID]
+	return ok && count.n >= link.MaxDownloads && time.Now().Before(count.expiresAt)
+}
+
+// release gives back a download of link taken by take, for a response that did not send the file
+func (dc *downloadCounter) release(link *SignedDownload) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if count, ok := dc.counts[link.ID]; ok && count.n > 0 {
+		count.n--
+	}
+}
+
+// downloadStatusWriter records the status of a response
+type downloadStatusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter
+func (sw *downloadStatusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements io.Writer
+func (sw *downloadStatusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (sw *downloadStatusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// SignedDownloadHandler returns an http.Handler that serves files below root to requests with a
+// valid signed link from SignDownloadURL, using ServeDownloadFile. Invalid links are rejected with
+// 403, expired links and links that reached their download limit with 410.
+//
+// Downloads are counted in memory by the handler, so every handler keeps its own counts. Every GET
+// request that is sent any part of the file counts, including range requests that resume a
+// download. HEAD requests and responses that send no content, such as 304 Not Modified or 416
+// Range Not Satisfiable, do not count, but once the limit is reached every request is refused.
+func (t *Tools) SignedDownloadHandler(root string) http.Handler {
+	counter := &downloadCounter{counts: make(map[string]*downloadCount)}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		link, err := t.VerifySignedDownload(r)
+		if err != nil {
+			t.logger().Debug("rejected signed download", "error", err)
+			status := http.StatusForbidden
+			if errors.Is(err, ErrLinkExpired) {
+				status = http.StatusGone
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		filePath := filepath.Join(root, filepath.FromSlash(cleanSignedPath(link.Path)))
+		if link.MaxDownloads == 0 {
+			t.ServeDownloadFile(w, r, filePath)
+			return
+		}
+
+		if r.Method == http.MethodHead {
+			if counter.exhausted(link) {
+				http.Error(w, ErrDownloadLimitReached.Error(), http.StatusGone)
+				return
+			}
+			t.ServeDownloadFile(w, r, filePath)
+			return
+		}
+
+		if !counter.take(link) {
+			http.Error(w, ErrDownloadLimitReached.Error(), http.StatusGone)
+			return
+		}
+
+		sw := &downloadStatusWriter{ResponseWriter: w}
+		t.ServeDownloadFile(sw, r, filePath)
+		if sw.status != http.StatusOK && sw.status != http.StatusPartialContent {
+			counter.release(link)
+		}
+	})
+}
@@ -0,0 +1,234 @@
+package toolbox
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSigningKey = SigningKey{ID: "k1", Secret: []byte("0123456789abcdef0123456789abcdef")}
+
+// TestTools_SignedDownload tests signing and serving download links
+func TestTools_SignedDownload(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "reports"), 0755)
+	os.WriteFile(filepath.Join(root, "reports", "q1.txt"), []byte("quarterly report"), 0644)
+
+	tools := Tools{SigningKeys: []SigningKey{testSigningKey}}
+	handler := tools.SignedDownloadHandler(root)
+
+	get := func(link string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, link, nil)
+		if len(header) == 2 {
+			req.Header.Set(header[0], header[1])
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	link, err := tools.SignDownloadURL("/download?lang=en", "reports/q1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(link, "lang=en") {
+		t.Errorf("existing query parameters should be kept: %s", link)
+	}
+
+	rr := get(link)
+	if rr.Code != http.StatusOK || rr.Body.String() != "quarterly report" {
+		t.Fatalf("expected the file, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	// Any change to the link breaks the signature
+	tampered := strings.Replace(link, "q1.txt", "q2.txt", 1)
+	if rr := get(tampered); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a tampered link, got %d", rr.Code)
+	}
+	if rr := get(strings.Replace(link, "expires=", "expires=9", 1)); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a changed expiry, got %d", rr.Code)
+	}
+	if rr := get("/download?path=reports/q1.txt"); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without a signature, got %d", rr.Code)
+	}
+
+	// Expired links
+	params := url.Values{}
+	params.Set(signedParamPath, "reports/q1.txt")
+	params.Set(signedParamExpires, strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10))
+	params.Set(signedParamKey, testSigningKey.ID)
+	params.Set(signedParamSig, signDownload(testSigningKey.Secret, params, ""))
+	if rr := get("/download?" + params.Encode()); rr.Code != http.StatusGone {
+		t.Errorf("expected 410 for an expired link, got %d", rr.Code)
+	}
+
+	// Links cannot leave the root
+	escape, _ := tools.SignDownloadURL("/download", "../../etc/passwd")
+	if rr := get(escape); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a path outside the root, got %d", rr.Code)
+	}
+}
+
+// TestTools_SignedDownload_KeyRotation tests that links signed with an older key stay valid
+// while that key is configured
+func TestTools_SignedDownload_KeyRotation(t *testing.T) {
+	old := Tools{SigningKeys: []SigningKey{testSigningKey}}
+	link, _ := old.SignDownloadURL("/download", "file.txt")
+
+	newKey := SigningKey{ID: "k2", Secret: []byte("fedcba9876543210fedcba9876543210")}
+	rotated := Tools{SigningKeys: []SigningKey{newKey, testSigningKey}}
+	if _, err := rotated.VerifySignedDownload(httptest.NewRequest(http.MethodGet, link, nil)); err != nil {
+		t.Errorf("link signed with the old key should still be valid: %v", err)
+	}
+
+	newLink, _ := rotated.SignDownloadURL("/download", "file.txt")
+	if !strings.Contains(newLink, "kid=k2") {
+		t.Errorf("new links should be signed with the first key: %s", newLink)
+	}
+
+	retired := Tools{SigningKeys: []SigningKey{newKey}}
+	if _, err := retired.VerifySignedDownload(httptest.NewRequest(http.MethodGet, link, nil)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected ErrInvalidSignature once the old key is removed, got %v", err)
+	}
+
+	if _, err := (&Tools{}).SignDownloadURL("/download", "file.txt"); err == nil {
+		t.Error("expected an error without signing keys")
+	}
+}
+
+// TestTools_SignedDownload_Limits tests client binding and download limits
+func TestTools_SignedDownload_Limits(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "file.txt"), []byte("0123456789"), 0644)
+
+	tools := Tools{SigningKeys: []SigningKey{testSigningKey}}
+	handler := tools.SignedDownloadHandler(root)
+
+	serve := func(link, remoteAddr, rangeHeader string) int {
+		req := httptest.NewRequest(http.MethodGet, link, nil)
+		req.RemoteAddr = remoteAddr
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Bound to a client address, which is not part of the link
+	link, _ := tools.SignDownloadURL("/download", "file.txt", SignedURLOptions{ClientIP: "203.0.113.7", MaxDownloads: 2})
+	if strings.Contains(link, "203.0.113.7") {
+		t.Errorf("the client address should not be disclosed: %s", link)
+	}
+	if code := serve(link, "198.51.100.1:4000", ""); code != http.StatusForbidden {
+		t.Errorf("expected 403 from another address, got %d", code)
+	}
+
+	if code := serve(link, "203.0.113.7:4000", ""); code != http.StatusOK {
+		t.Fatalf("expected the first download to succeed, got %d", code)
+	}
+
+	// Resuming a download counts as well
+	if code := serve(link, "203.0.113.7:4000", "bytes=5-"); code != http.StatusPartialContent {
+		t.Errorf("expected a partial download, got %d", code)
+	}
+
+	// Once the limit is reached, no request is served
+	for _, rangeHeader := range []string{"", "bytes=5-", "bytes=9-9"} {
+		if code := serve(link, "203.0.113.7:4000", rangeHeader); code != http.StatusGone {
+			t.Errorf("expected 410 for range %q once the limit is reached, got %d", rangeHeader, code)
+		}
+	}
+	head := httptest.NewRequest(http.MethodHead, link, nil)
+	head.RemoteAddr = "203.0.113.7:4000"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, head)
+	if rr.Code != http.StatusGone {
+		t.Errorf("expected 410 for HEAD once the limit is reached, got %d", rr.Code)
+	}
+
+	// Behind a proxy the address comes from ClientIP
+	tools.ClientIP = func(r *http.Request) string { return r.Header.Get("X-Real-IP") }
+	req := httptest.NewRequest(http.MethodGet, link, nil)
+	req.Header.Set("X-Real-IP", "203.0.113.7")
+	if _, err := tools.VerifySignedDownload(req); err != nil {
+		t.Errorf("expected the proxied request to be accepted: %v", err)
+	}
+}
+
+// TestTools_SignedDownload_CountedRanges tests that range requests count as downloads and responses
+// without content do not
+func TestTools_SignedDownload_CountedRanges(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "file.txt"), []byte("0123456789"), 0644)
+
+	tools := Tools{SigningKeys: []SigningKey{testSigningKey}}
+	handler := tools.SignedDownloadHandler(root)
+
+	serve := func(link string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, link, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name        string
+		rangeHeader string
+		status      int
+	}{
+		{name: "suffix range", rangeHeader: "bytes=-1000000", status: http.StatusPartialContent},
+		{name: "several ranges", rangeHeader: "bytes=1-,0-0", status: http.StatusPartialContent},
+		{name: "first byte", rangeHeader: "bytes=0-0", status: http.StatusPartialContent},
+		{name: "spaced ranges", rangeHeader: "bytes= 5-6 , 0-1", status: http.StatusPartialContent},
+		{name: "range after the start", rangeHeader: "bytes=1-", status: http.StatusPartialContent},
+		{name: "last byte", rangeHeader: "bytes=9-9", status: http.StatusPartialContent},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			link, _ := tools.SignDownloadURL("/download", "file.txt", SignedURLOptions{MaxDownloads: 1})
+
+			if rr := serve(link, map[string]string{"Range": tc.rangeHeader}); rr.Code != tc.status {
+				t.Fatalf("expected %d, got %d", tc.status, rr.Code)
+			}
+			if rr := serve(link, map[string]string{"Range": tc.rangeHeader}); rr.Code != http.StatusGone {
+				t.Errorf("expected the range request to count as a download, got %d", rr.Code)
+			}
+		})
+	}
+
+	t.Run("not modified", func(t *testing.T) {
+		link, _ := tools.SignDownloadURL("/download", "file.txt", SignedURLOptions{MaxDownloads: 2})
+
+		etag := serve(link, map[string]string{"Range": "bytes=5-"}).Header().Get("ETag")
+		if etag == "" {
+			t.Fatal("expected an ETag")
+		}
+
+		for range 3 {
+			if rr := serve(link, map[string]string{"If-None-Match": etag}); rr.Code != http.StatusNotModified {
+				t.Fatalf("expected 304, got %d", rr.Code)
+			}
+		}
+		if rr := serve(link, map[string]string{"Range": "bytes=20-30,40-50"}); rr.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("expected 416, got %d", rr.Code)
+		}
+		if rr := serve(link, nil); rr.Code != http.StatusOK {
+			t.Errorf("304 and 416 responses should not count, got %d", rr.Code)
+		}
+		if rr := serve(link, nil); rr.Code != http.StatusGone {
+			t.Errorf("expected 410 once the limit is reached, got %d", rr.Code)
+		}
+	})
+}
@@ -0,0 +1,324 @@
+package toolbox
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxThrottleWrite is the largest piece of data passed on at once, so throttled transfers flow
+// steadily instead of in bursts
+const maxThrottleWrite = 32 * 1024
+
+// throttleIdleTimeout is how long the bucket of an idle client is kept
+const throttleIdleTimeout = time.Minute
+
+// RateLimit is a bandwidth limit
+type RateLimit struct {
+	BytesPerSecond int64 // Zero means unlimited
+	Burst          int64 // Bytes that may be transferred at once after a pause; defaults to BytesPerSecond
+}
+
+// Throttle limits the bandwidth of transfers with token buckets. A transfer is held to the global
+// limit, the limit of its client and the limit of its request, whichever is the slowest, so a
+// single client cannot take the whole global bandwidth if PerClient is lower.
+type Throttle struct {
+	Global    RateLimit // Shared by all transfers
+	PerClient RateLimit // Shared by the transfers of each client
+
+	// ClientKey identifies the client of a request, e.g. by user ID or API key. If nil, the
+	// address returned by Tools.ClientIP is used.
+	ClientKey func(r *http.Request) string
+
+	mu        sync.Mutex
+	global    *tokenBucket
+	clients   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// rateLimitKey is the context key of the limit set by WithRateLimit
+type rateLimitKey struct{}
+
+// WithRateLimit returns a copy of ctx that limits the bandwidth of the request it is attached to,
+// on top of the limits of the Throttle. Attach it to a request before it reaches a throttled
+// handler or Tools method.
+func WithRateLimit(ctx context.Context, limit RateLimit) context.Context {
+	return context.WithValue(ctx, rateLimitKey{}, limit)
+}
+
+// buckets returns the token buckets that apply to r
+func (th *Throttle) buckets(t *Tools, r *http.Request) []*tokenBucket {
+	var buckets []*tokenBucket
+
+	th.mu.Lock()
+	if th.Global.BytesPerSecond > 0 {
+		if th.global == nil {
+			th.global = newTokenBucket(th.Global)
+		}
+		buckets = append(buckets, th.global)
+	}
+
+	if th.PerClient.BytesPerSecond > 0 {
+		key := ""
+		if th.ClientKey != nil {
+			key = th.ClientKey(r)
+		} else {
+			key = t.clientIP(r)
+		}
+
+		th.sweep(time.Now())
+		bucket, ok := th.clients[key]
+		if !ok {
+			if th.clients == nil {
+				th.clients = make(map[string]*tokenBucket)
+			}
+			bucket = newTokenBucket(th.PerClient)
+			th.clients[key] = bucket
+		}
+		buckets = append(buckets, bucket)
+	}
+	th.mu.Unlock()
+
+	if limit, ok := r.Context().Value(rateLimitKey{}).(RateLimit); ok && limit.BytesPerSecond > 0 {
+		buckets = append(buckets, newTokenBucket(limit))
+	}
+
+	return buckets
+}
+
+// sweep forgets the buckets of clients that have been idle for a while. The caller holds th.mu.
+func (th *Throttle) sweep(now time.Time) {
+	if now.Sub(th.lastSweep) < throttleIdleTimeout {
+		return
+	}
+	th.lastSweep = now
+
+	for key, bucket := range th.clients {
+		if bucket.idleSince(now) >= throttleIdleTimeout {
+			delete(th.clients, key)
+		}
+	}
+}
+
+// tokenBucket holds up to burst tokens, one per byte, refilled at rate per second. Tokens can be
+// borrowed, in which case the borrower waits until the bucket is back at zero, so concurrent
+// transfers are served in turn.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = limit.BytesPerSecond
+	}
+
+	return &tokenBucket{
+		rate:   float64(limit.BytesPerSecond),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens and returns how long to wait before they may be used
+func (b *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// idleSince returns how long the bucket has been full
+func (b *tokenBucket) idleSince(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	full := b.last.Add(time.Duration((b.burst - b.tokens) / b.rate * float64(time.Second)))
+	return now.Sub(full)
+}
+
+// throttler paces a single transfer through a set of token buckets
+type throttler struct {
+	ctx     context.Context
+	buckets []*tokenBucket
+	step    int
+}
+
+func newThrottler(ctx context.Context, buckets []*tokenBucket) *throttler {
+	step := maxThrottleWrite
+	for _, b := range buckets {
+		step = min(step, max(1, int(b.burst)))
+	}
+
+	return &throttler{ctx: ctx, buckets: buckets, step: step}
+}
+
+// wait blocks until n bytes may be transferred
+func (th *throttler) wait(n int) error {
+	now := time.Now()
+
+	var delay time.Duration
+	for _, b := range th.buckets {
+		delay = max(delay, b.reserve(n, now))
+	}
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-th.ctx.Done():
+		return th.ctx.Err()
+	}
+}
+
+// throttledWriter is an http.ResponseWriter that writes at the pace of a throttler
+type throttledWriter struct {
+	http.ResponseWriter
+	throttler *throttler
+}
+
+// Write implements io.Writer
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), tw.throttler.step)
+		if err := tw.throttler.wait(n); err != nil {
+			return written, err
+		}
+
+		n, err := tw.ResponseWriter.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Unwrap returns the original ResponseWriter, for http.ResponseController
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// Flush implements http.Flusher
+func (tw *throttledWriter) Flush() {
+	http.NewResponseController(tw.ResponseWriter).Flush()
+}
+
+// throttledReader is a request body that is read at the pace of a throttler
+type throttledReader struct {
+	io.ReadCloser
+	throttler *throttler
+}
+
+// Read implements io.Reader
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > tr.throttler.step {
+		p = p[:tr.throttler.step]
+	}
+
+	n, err := tr.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := tr.throttler.wait(n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+
+	return n, err
+}
+
+// isThrottled reports whether w or any writer it wraps, as found through Unwrap, is throttled
+func isThrottled(w http.ResponseWriter) bool {
+	for w != nil {
+		if _, ok := w.(*throttledWriter); ok {
+			return true
+		}
+
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false
+		}
+		w = unwrapper.Unwrap()
+	}
+	return false
+}
+
+// throttleResponse returns w limited by t.DownloadThrottle and the rate limit of r, or w itself if
+// there is no limit or it is already throttled, possibly below other wrapping writers
+func (t *Tools) throttleResponse(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if isThrottled(w) {
+		return w
+	}
+
+	buckets := t.throttleBuckets(t.DownloadThrottle, r)
+	if len(buckets) == 0 {
+		return w
+	}
+
+	return &throttledWriter{ResponseWriter: w, throttler: newThrottler(r.Context(), buckets)}
+}
+
+// throttleRequest limits reading the body of r by t.UploadThrottle and the rate limit of r, unless
+// there is no limit or the body is already throttled
+func (t *Tools) throttleRequest(r *http.Request) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	if _, ok := r.Body.(*throttledReader); ok {
+		return
+	}
+
+	buckets := t.throttleBuckets(t.UploadThrottle, r)
+	if len(buckets) == 0 {
+		return
+	}
+
+	r.Body = &throttledReader{ReadCloser: r.Body, throttler: newThrottler(r.Context(), buckets)}
+}
+
+// throttleBuckets returns the buckets of th that apply to r, plus one for the rate limit of r
+func (t *Tools) throttleBuckets(th *Throttle, r *http.Request) []*tokenBucket {
+	if th != nil {
+		return th.buckets(t, r)
+	}
+
+	if limit, ok := r.Context().Value(rateLimitKey{}).(RateLimit); ok && limit.BytesPerSecond > 0 {
+		return []*tokenBucket{newTokenBucket(limit)}
+	}
+	return nil
+}
+
+// ThrottleHandler returns a handler that runs next with its request body limited by
+// t.UploadThrottle and its response by t.DownloadThrottle, plus the limit set with WithRateLimit.
+// ServeDownloadFile, ServeDownload, ServeBundle, UploadFiles and ChunkUploadHandler apply these
+// limits by themselves; ThrottleHandler is for other handlers, and transfers are never throttled
+// twice.
+func (t *Tools) ThrottleHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.throttleRequest(r)
+		next.ServeHTTP(t.throttleResponse(w, r), r)
+	})
+}
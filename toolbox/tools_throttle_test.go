@@ -0,0 +1,166 @@
+package toolbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTokenBucket tests the refill and borrowing of a token bucket
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(RateLimit{BytesPerSecond: 1000, Burst: 500})
+	now := b.last
+
+	if wait := b.reserve(500, now); wait != 0 {
+		t.Errorf("expected the burst to be available at once, got %v", wait)
+	}
+	if wait := b.reserve(250, now); wait != 250*time.Millisecond {
+		t.Errorf("expected to wait 250ms for borrowed tokens, got %v", wait)
+	}
+
+	// The next transfer queues up behind the borrowed tokens
+	if wait := b.reserve(250, now.Add(100*time.Millisecond)); wait != 400*time.Millisecond {
+		t.Errorf("expected to wait 400ms, got %v", wait)
+	}
+
+	// The bucket never holds more than the burst
+	if wait := b.reserve(600, now.Add(time.Hour)); wait != 100*time.Millisecond {
+		t.Errorf("expected to wait 100ms beyond the burst, got %v", wait)
+	}
+	if idle := b.idleSince(now.Add(time.Hour)); idle >= 0 {
+		t.Errorf("a bucket in debt should not be idle, got %v", idle)
+	}
+}
+
+// TestTools_DownloadThrottle tests that downloads are paced by the global, client and request limits
+func TestTools_DownloadThrottle(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 40*1024)
+	tools := Tools{DownloadThrottle: &Throttle{
+		Global:    RateLimit{BytesPerSecond: 1 << 30},
+		PerClient: RateLimit{BytesPerSecond: 80 * 1024, Burst: 8 * 1024},
+		ClientKey: func(r *http.Request) string { return r.Header.Get("X-User") },
+	}}
+
+	download := func(user string, ctx context.Context) (time.Duration, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		req.Header.Set("X-User", user)
+		rr := httptest.NewRecorder()
+
+		start := time.Now()
+		tools.ServeDownload(rr, req, "file.bin", bytes.NewReader(content), DownloadOptions{ETag: `"x"`})
+		return time.Since(start), rr
+	}
+
+	// 40KB at 80KB/s, of which the 8KB burst is free
+	elapsed, rr := download("alice", context.Background())
+	if rr.Body.Len() != len(content) {
+		t.Fatalf("expected %d bytes, got %d", len(content), rr.Body.Len())
+	}
+	if elapsed < 350*time.Millisecond {
+		t.Errorf("download took %v, expected at least 400ms", elapsed)
+	}
+
+	// Another client has its own bucket, but a slower limit on the request applies too
+	elapsed, _ = download("bob", WithRateLimit(context.Background(), RateLimit{BytesPerSecond: 40 * 1024, Burst: 8 * 1024}))
+	if elapsed < 750*time.Millisecond {
+		t.Errorf("download took %v, expected at least 800ms", elapsed)
+	}
+	if len(tools.DownloadThrottle.clients) != 2 {
+		t.Errorf("expected a bucket per client, got %d", len(tools.DownloadThrottle.clients))
+	}
+
+	// A cancelled request stops waiting
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	elapsed, rr = download("carol", WithRateLimit(ctx, RateLimit{BytesPerSecond: 1024, Burst: 1024}))
+	if elapsed > time.Second || rr.Body.Len() >= len(content) {
+		t.Errorf("expected the download to stop early, got %d bytes after %v", rr.Body.Len(), elapsed)
+	}
+}
+
+// TestTools_ThrottleHandler tests throttling request bodies in other handlers
+func TestTools_ThrottleHandler(t *testing.T) {
+	tools := Tools{UploadThrottle: &Throttle{Global: RateLimit{BytesPerSecond: 64 * 1024, Burst: 4 * 1024}}}
+
+	var read int
+	var readErr error
+	handler := tools.ThrottleHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The tools methods do not throttle the body a second time
+		tools.throttleRequest(r)
+		if _, ok := r.Body.(*throttledReader); !ok {
+			readErr = errors.New("body is not throttled")
+			return
+		}
+
+		var data []byte
+		data, readErr = io.ReadAll(r.Body)
+		read = len(data)
+	}))
+
+	start := time.Now()
+	req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(strings.Repeat("y", 36*1024)))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	elapsed := time.Since(start)
+
+	if readErr != nil || read != 36*1024 {
+		t.Fatalf("expected the whole body, got %d bytes and %v", read, readErr)
+	}
+	if elapsed < 450*time.Millisecond {
+		t.Errorf("upload took %v, expected at least 500ms", elapsed)
+	}
+
+	// Without any limit nothing is wrapped
+	plain := Tools{}
+	w := httptest.NewRecorder()
+	if plain.throttleResponse(w, req) != http.ResponseWriter(w) {
+		t.Error("expected the response to be left alone without limits")
+	}
+}
+
+// wrappingWriter stands for a response writer added by middleware
+type wrappingWriter struct {
+	http.ResponseWriter
+}
+
+func (ww *wrappingWriter) Unwrap() http.ResponseWriter {
+	return ww.ResponseWriter
+}
+
+// TestTools_ThrottleResponseWrapped tests that a throttled writer below other writers is not
+// throttled a second time
+func TestTools_ThrottleResponseWrapped(t *testing.T) {
+	tools := Tools{DownloadThrottle: &Throttle{Global: RateLimit{BytesPerSecond: 1024}}}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	throttled := tools.throttleResponse(httptest.NewRecorder(), req)
+	if _, ok := throttled.(*throttledWriter); !ok {
+		t.Fatalf("expected a throttled writer, got %T", throttled)
+	}
+
+	tests := []struct {
+		name string
+		w    http.ResponseWriter
+	}{
+		{name: "throttled", w: throttled},
+		{name: "status writer", w: &downloadStatusWriter{ResponseWriter: throttled}},
+		{name: "middleware", w: &wrappingWriter{&downloadStatusWriter{ResponseWriter: throttled}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tools.throttleResponse(tc.w, req); got != tc.w {
+				t.Errorf("expected the writer to be left alone, got %T", got)
+			}
+		})
+	}
+
+	if _, ok := tools.throttleResponse(&wrappingWriter{httptest.NewRecorder()}, req).(*throttledWriter); !ok {
+		t.Error("expected a wrapped writer without throttling to be throttled")
+	}
+}
@@ -0,0 +1,79 @@
+package toolbox
+
+import (
+	"context"
+	"net/http"
+)
+
+// Response is a JSONResponse with data of a known type, for handlers and clients that send or read
+// the same envelope without casts
+type Response[T any] struct {
+	Error   bool   `json:"error"`
+	Message string `json:"message"`
+	Code    string `json:"code,omitempty"`
+	Data    T      `json:"data,omitempty"`
+}
+
+// DecodeJSON reads the JSON body of r into a new T with t.ReadJSON, and validates it. It returns
+// the errors of ReadJSON, e.g. a *JSONError or ValidationErrors.
+func DecodeJSON[T any](t *Tools, w http.ResponseWriter, r *http.Request) (T, error) {
+	var data T
+	err := t.ReadJSON(w, r, &data)
+	return data, err
+}
+
+// HandleJSONOptions controls the responses of HandleJSON
+type HandleJSONOptions struct {
+	Status  int    // Status of successful responses; defaults to 200
+	Message string // Message of successful responses
+}
+
+// requestKey is the context key of the request passed to the function of HandleJSON
+type requestKey struct{}
+
+// RequestFromContext returns the request a HandleJSON function is called for, e.g. to read path
+// values or headers, or nil outside of HandleJSON
+func RequestFromContext(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(requestKey{}).(*http.Request)
+	return r
+}
+
+// HandleJSON returns a handler that decodes the JSON body of each request into a Req with
+// DecodeJSON, calls fn with it, and sends the result as the data of a Response. Errors of decoding,
+// validation and fn are sent with ErrorJSONFor, so their status comes from the ErrorCatalog unless
+// fn returns a *ProblemDetails. Requests without a body, such as most GET requests, are not
+// decoded; fn gets the zero Req, which is still validated.
+func HandleJSON[Req, Resp any](t *Tools, fn func(ctx context.Context, req Req) (Resp, error), opts ...HandleJSONOptions) http.Handler {
+	var options HandleJSONOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+	if options.Status == 0 {
+		options.Status = http.StatusOK
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Req
+		var err error
+		if r.Body == nil || r.Body == http.NoBody {
+			err = t.Validate(&req)
+		} else {
+			req, err = DecodeJSON[Req](t, w, r)
+		}
+		if err != nil {
+			t.ErrorJSONFor(w, r, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), requestKey{}, r)
+		resp, err := fn(ctx, req)
+		if err != nil {
+			t.ErrorJSONFor(w, r, err)
+			return
+		}
+
+		if err := t.WriteJSON(w, options.Status, Response[Resp]{Message: options.Message, Data: resp}); err != nil {
+			t.logger().Error("failed to write JSON response", "error", err)
+		}
+	})
+}
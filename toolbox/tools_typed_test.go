@@ -0,0 +1,101 @@
+package toolbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testPurchase struct {
+	SKU      string `json:"sku" validate:"required"`
+	Quantity int    `json:"quantity" validate:"min=1"`
+}
+
+type testReceipt struct {
+	ID    int    `json:"id"`
+	SKU   string `json:"sku"`
+	Total int    `json:"total"`
+}
+
+// TestDecodeJSON tests decoding a body into a typed value
+func TestDecodeJSON(t *testing.T) {
+	var tools Tools
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"sku": "A-1", "quantity": 2}`))
+	order, err := DecodeJSON[testPurchase](&tools, httptest.NewRecorder(), req)
+	if err != nil || order != (testPurchase{"A-1", 2}) {
+		t.Errorf("unexpected result %+v, %v", order, err)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"sku": "A-1"}`))
+	_, err = DecodeJSON[testPurchase](&tools, httptest.NewRecorder(), req)
+	var validationErrs ValidationErrors
+	if !errors.As(err, &validationErrs) || validationErrs["quantity"] == nil {
+		t.Errorf("expected a validation error for quantity, got %v", err)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`[1, 2, 3]`))
+	numbers, err := DecodeJSON[[]int](&tools, httptest.NewRecorder(), req)
+	if err != nil || len(numbers) != 3 {
+		t.Errorf("unexpected result %v, %v", numbers, err)
+	}
+}
+
+// TestHandleJSON tests the typed handler adapter
+func TestHandleJSON(t *testing.T) {
+	var tools Tools
+	errOutOfStock := errors.New("out of stock")
+
+	handler := HandleJSON(&tools, func(ctx context.Context, order testPurchase) (testReceipt, error) {
+		if order.SKU == "sold-out" {
+			return testReceipt{}, &ErrorResponse{Err: ErrUploadNotFound, Message: errOutOfStock.Error()}
+		}
+		if r := RequestFromContext(ctx); r == nil || r.Header.Get("X-Test") != "yes" {
+			return testReceipt{}, errors.New("request missing from context")
+		}
+		return testReceipt{ID: 7, SKU: order.SKU, Total: order.Quantity * 5}, nil
+	}, HandleJSONOptions{Status: http.StatusCreated, Message: "order placed"})
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		status int
+	}{
+		{name: "valid", method: http.MethodPost, body: `{"sku": "A-1", "quantity": 3}`, status: http.StatusCreated},
+		{name: "invalid", method: http.MethodPost, body: `{"sku": "A-1", "quantity": 0}`, status: http.StatusUnprocessableEntity},
+		{name: "malformed", method: http.MethodPost, body: `{"sku": `, status: http.StatusBadRequest},
+		{name: "handler error", method: http.MethodPost, body: `{"sku": "sold-out", "quantity": 1}`, status: http.StatusNotFound},
+		{name: "no body", method: http.MethodGet, status: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/orders", nil)
+			if tt.body != "" {
+				req = httptest.NewRequest(tt.method, "/orders", strings.NewReader(tt.body))
+			}
+			req.Header.Set("X-Test", "yes")
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, rr.Code, rr.Body)
+			}
+
+			if tt.status == http.StatusCreated {
+				var resp Response[testReceipt]
+				if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Error || resp.Message != "order placed" || resp.Data != (testReceipt{7, "A-1", 15}) {
+					t.Errorf("unexpected response %+v", resp)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,396 @@
+package toolbox
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// ValidationErrors maps the JSON path of each invalid field, e.g. "items[0].name", to what is
+// wrong with it
+type ValidationErrors map[string][]string
+
+// Error implements the error interface
+func (ve ValidationErrors) Error() string {
+	fields := make([]string, 0, len(ve))
+	for field := range ve {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	parts := make([]string, 0, len(fields))
+	for _, field := range fields {
+		parts = append(parts, field+": "+strings.Join(ve[field], ", "))
+	}
+
+	return "validation failed: " + strings.Join(parts, "; ")
+}
+
+// add records a problem with field
+func (ve ValidationErrors) add(field, message string) {
+	ve[field] = append(ve[field], message)
+}
+
+// validationPatterns caches the compiled regexp rules
+var validationPatterns sync.Map
+
+// foreignValidationRules are rules of go-playground/validator that Validate accepts in a tag but
+// does not check
+var foreignValidationRules = map[string]bool{
+	"eq": true, "ne": true, "gt": true, "gte": true, "lt": true, "lte": true,
+	"eqfield": true, "nefield": true, "gtfield": true, "gtefield": true, "ltfield": true, "ltefield": true,
+	"required_if": true, "required_unless": true, "required_with": true, "required_with_all": true,
+	"required_without": true, "required_without_all": true,
+	"excluded_if": true, "excluded_unless": true, "excluded_with": true, "excluded_with_all": true,
+	"excluded_without": true, "excluded_without_all": true,
+	"alpha": true, "alphanum": true, "alphaunicode": true, "alphanumunicode": true, "ascii": true,
+	"printascii": true, "numeric": true, "number": true, "hexadecimal": true, "boolean": true,
+	"lowercase": true, "uppercase": true, "contains": true, "containsany": true, "excludes": true,
+	"excludesall": true, "startswith": true, "endswith": true, "unique": true, "isdefault": true,
+	"uri": true, "http_url": true, "hostname": true, "fqdn": true, "ip": true, "ipv4": true, "ipv6": true,
+	"cidr": true, "mac": true, "uuid": true, "uuid4": true, "datetime": true, "timezone": true,
+	"json": true, "base64": true, "e164": true, "iso3166_1_alpha2": true, "bcp47_language_tag": true,
+	"structonly": true, "nostructlevel": true,
+}
+
+// Validate checks data, a struct or a pointer to one, against the rules in the validate tags of its
+// fields, and returns all problems at once as ValidationErrors. Rules are separated by commas:
+//
+//	required      the value must not be empty (zero, "", nil, or no elements)
+//	min=n, max=n  bounds of a number, or of the length of a string (in characters), slice or map
+//	len=n         exact length of a string, slice or map
+//	oneof=a b c   the value must be one of the space separated options
+//	email         a plain email address, e.g. "jane@example.com"
+//	url           an absolute URL with a scheme and a host
+//	regexp=expr   the value must match expr; must be the last rule, as expr may contain commas
+//
+// Rules other than required are not checked on nil pointers, and email, url, regexp and oneof are
+// not checked on empty strings. Nested structs, and structs in slices, arrays and maps, are
+// validated as well. Fields are named after their JSON names.
+//
+// As in go-playground/validator, omitempty skips the remaining rules of an empty field, and the
+// rules after dive apply to each element of a slice, array or map instead of the field itself.
+// Other rules of go-playground/validator, such as gte or required_with, are accepted but not
+// checked, so structs tagged for it can still be read; any other rule is reported as a mistake in
+// the tag.
+func (t *Tools) Validate(data interface{}) error {
+	errs := ValidationErrors{}
+	if err := validateValue(reflect.ValueOf(data), "", errs); err != nil {
+		return err
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateValue validates the fields of v if it is a struct, or the structs it holds
+func validateValue(v reflect.Value, path string, errs ValidationErrors) error {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		return validateStruct(v, path, errs)
+
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := validateValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), errs); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			if err := validateValue(v.MapIndex(key), fmt.Sprintf("%s[%v]", path, key), errs); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateStruct checks the rules of each field of v and descends into the fields
+func validateStruct(v reflect.Value, path string, errs ValidationErrors) error {
+	typ := v.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, skip := jsonFieldName(field)
+		if skip {
+			continue
+		}
+
+		// Embedded structs without a JSON name share the path of their parent, as in the JSON
+		fieldPath := path
+		if !field.Anonymous || field.Tag.Get("json") != "" {
+			fieldPath = joinFieldPath(path, name)
+		}
+
+		value := v.Field(i)
+		if tag := field.Tag.Get("validate"); tag != "" && tag != "-" {
+			if err := validateField(value, tag, fieldPath, errs); err != nil {
+				return fmt.Errorf("invalid validate tag on %s.%s: %w", typ.Name(), field.Name, err)
+			}
+		}
+
+		if err := validateValue(value, fieldPath, errs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// jsonFieldName returns the name of field in JSON, and whether it is left out of JSON
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", true
+	}
+
+	name, _, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = field.Name
+	}
+	return name, false
+}
+
+// joinFieldPath appends name to the path of its parent
+func joinFieldPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// validateField checks the rules in tag against value
+func validateField(value reflect.Value, tag, path string, errs ValidationErrors) error {
+	rules := splitRules(tag)
+	for _, rule := range rules {
+		name, _, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required", "omitempty", "dive", "min", "max", "len", "oneof", "email", "url", "regexp":
+		default:
+			if !foreignValidationRules[name] {
+				return fmt.Errorf("unknown rule %q", name)
+			}
+		}
+	}
+
+	return checkRules(value, rules, path, errs)
+}
+
+// splitRules splits tag into its rules. A regexp rule takes the rest of the tag.
+func splitRules(tag string) []string {
+	var rules []string
+	for tag != "" {
+		var rule string
+		if strings.HasPrefix(strings.TrimSpace(tag), "regexp=") {
+			rule, tag = tag, ""
+		} else {
+			rule, tag, _ = strings.Cut(tag, ",")
+		}
+		rules = append(rules, strings.TrimSpace(rule))
+	}
+	return rules
+}
+
+// checkRules checks rules, whose names are known to be valid, against value
+func checkRules(value reflect.Value, rules []string, path string, errs ValidationErrors) error {
+	for i, rule := range rules {
+		name, param, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			if isEmptyValue(value) {
+				errs.add(path, "is required")
+			}
+			continue
+		case "omitempty":
+			if isEmptyValue(value) {
+				return nil
+			}
+			continue
+		}
+
+		if foreignValidationRules[name] {
+			continue
+		}
+
+		v := value
+		for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return nil
+			}
+			v = v.Elem()
+		}
+
+		if name == "dive" {
+			return checkElements(v, rules[i+1:], path, errs)
+		}
+
+		message, err := checkRule(v, name, param)
+		if err != nil {
+			return err
+		}
+		if message != "" {
+			errs.add(path, message)
+		}
+	}
+
+	return nil
+}
+
+// checkElements checks rules against each element of v, a slice, array or map
+func checkElements(v reflect.Value, rules []string, path string, errs ValidationErrors) error {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := checkRules(v.Index(i), rules, fmt.Sprintf("%s[%d]", path, i), errs); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			if err := checkRules(v.MapIndex(key), rules, fmt.Sprintf("%s[%v]", path, key), errs); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("dive does not apply to %s", v.Kind())
+	}
+
+	return nil
+}
+
+// isEmptyValue reports whether v is the zero value or has no elements
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String, reflect.Array:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+// checkRule checks a single rule against v and returns what is wrong, or an empty string
+func checkRule(v reflect.Value, name, param string) (string, error) {
+	switch name {
+	case "min", "max", "len":
+		return checkBound(v, name, param)
+
+	case "oneof", "email", "url", "regexp":
+		if v.Kind() != reflect.String {
+			if name == "oneof" {
+				return checkOneOf(fmt.Sprint(v.Interface()), param), nil
+			}
+			return "", fmt.Errorf("%s applies to strings only", name)
+		}
+		if v.Len() == 0 {
+			return "", nil
+		}
+
+		s := v.String()
+		switch name {
+		case "oneof":
+			return checkOneOf(s, param), nil
+		case "email":
+			if address, err := mail.ParseAddress(s); err != nil || address.Address != s {
+				return "must be a valid email address", nil
+			}
+		case "url":
+			if u, err := url.Parse(s); err != nil || u.Scheme == "" || u.Host == "" {
+				return "must be a valid URL", nil
+			}
+		case "regexp":
+			pattern, err := compileValidationPattern(param)
+			if err != nil {
+				return "", err
+			}
+			if !pattern.MatchString(s) {
+				return "has an invalid format", nil
+			}
+		}
+		return "", nil
+	}
+
+	return "", fmt.Errorf("unknown rule %q", name)
+}
+
+// checkBound checks a min, max or len rule against a number or the length of v
+func checkBound(v reflect.Value, name, param string) (string, error) {
+	limit, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return "", fmt.Errorf("%s needs a number, got %q", name, param)
+	}
+
+	var actual float64
+	var unit string
+	switch v.Kind() {
+	case reflect.String:
+		actual, unit = float64(utf8.RuneCountInString(v.String())), " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		actual, unit = float64(v.Len()), " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		actual = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		actual = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		actual = v.Float()
+	default:
+		return "", fmt.Errorf("%s does not apply to %s", name, v.Kind())
+	}
+
+	switch {
+	case name == "min" && actual < limit:
+		return "must be at least " + param + unit, nil
+	case name == "max" && actual > limit:
+		return "must be at most " + param + unit, nil
+	case name == "len" && actual != limit:
+		return "must be exactly " + param + unit, nil
+	}
+	return "", nil
+}
+
+// checkOneOf reports if s is not one of the space separated options
+func checkOneOf(s, options string) string {
+	allowed := strings.Fields(options)
+	for _, option := range allowed {
+		if s == option {
+			return ""
+		}
+	}
+	return "must be one of: " + strings.Join(allowed, ", ")
+}
+
+// compileValidationPattern compiles a regexp rule once
+func compileValidationPattern(expr string) (*regexp.Regexp, error) {
+	if cached, ok := validationPatterns.Load(expr); ok {
+		return cached.(*regexp.Regexp), nil
+	}
+
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	validationPatterns.Store(expr, pattern)
+	return pattern, nil
+}
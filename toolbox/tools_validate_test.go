@@ -0,0 +1,208 @@
+package toolbox
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testAddress struct {
+	City    string `json:"city" validate:"required"`
+	Country string `json:"country" validate:"len=2"`
+}
+
+type testOrderItem struct {
+	SKU      string `json:"sku" validate:"required,regexp=^[A-Z]{3}-[0-9]{1,4}$"`
+	Quantity int    `json:"quantity" validate:"min=1,max=100"`
+}
+
+type testOrder struct {
+	Name     string            `json:"name" validate:"required,min=2,max=20"`
+	Email    string            `json:"email" validate:"required,email"`
+	Website  string            `json:"website" validate:"url"`
+	Status   string            `json:"status" validate:"oneof=new paid shipped"`
+	Priority *int              `json:"priority" validate:"min=1,max=5"`
+	Tags     []string          `json:"tags" validate:"max=3"`
+	Address  testAddress       `json:"address"`
+	Billing  *testAddress      `json:"billing"`
+	Items    []testOrderItem   `json:"items" validate:"required"`
+	Notes    map[string]string `json:"-" validate:"required"`
+}
+
+// TestTools_Validate tests the validate tag rules
+func TestTools_Validate(t *testing.T) {
+	var tools Tools
+	priority := 9
+
+	order := testOrder{
+		Name:     "J",
+		Email:    "not-an-email",
+		Website:  "example.com",
+		Status:   "lost",
+		Priority: &priority,
+		Tags:     []string{"a", "b", "c", "d"},
+		Address:  testAddress{Country: "GBR"},
+		Billing:  &testAddress{City: "Leeds", Country: "GB"},
+		Items:    []testOrderItem{{SKU: "ABC-1", Quantity: 1}, {SKU: "abc", Quantity: 0}},
+	}
+
+	err := tools.Validate(&order)
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ValidationErrors, got %v", err)
+	}
+
+	expected := ValidationErrors{
+		"name":              {"must be at least 2 characters"},
+		"email":             {"must be a valid email address"},
+		"website":           {"must be a valid URL"},
+		"status":            {"must be one of: new, paid, shipped"},
+		"priority":          {"must be at most 5"},
+		"tags":              {"must be at most 3 items"},
+		"address.city":      {"is required"},
+		"address.country":   {"must be exactly 2 characters"},
+		"items[1].sku":      {"has an invalid format"},
+		"items[1].quantity": {"must be at least 1"},
+	}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("unexpected errors:\n got %v\nwant %v", errs, expected)
+	}
+
+	// Valid values, and empty optional ones, pass
+	valid := testOrder{
+		Name:    "Jane",
+		Email:   "jane@example.com",
+		Address: testAddress{City: "Paris", Country: "FR"},
+		Items:   []testOrderItem{{SKU: "XYZ-42", Quantity: 3}},
+	}
+	if err := tools.Validate(valid); err != nil {
+		t.Errorf("expected a valid order, got %v", err)
+	}
+
+	// Mistakes in the tags are reported as such
+	var bad struct {
+		Age string `validate:"min=abc"`
+	}
+	if err := tools.Validate(&bad); err == nil || errors.As(err, &errs) {
+		t.Errorf("expected an error about the tag, got %v", err)
+	}
+}
+
+// TestTools_Validate_OtherValidators tests that tags written for go-playground/validator are accepted
+func TestTools_Validate_OtherValidators(t *testing.T) {
+	var tools Tools
+
+	type account struct {
+		Balance  int               `json:"balance" validate:"gte=0"`
+		Nickname string            `json:"nickname" validate:"omitempty,min=3"`
+		Emails   []string          `json:"emails" validate:"required,dive,email"`
+		Role     string            `json:"role" validate:"required,excluded_with=Admin"`
+		Labels   map[string]string `json:"labels" validate:"max=2,dive,required,max=5"`
+	}
+
+	valid := account{Balance: -5, Emails: []string{"a@example.com"}, Role: "user", Labels: map[string]string{"team": "core"}}
+	if err := tools.Validate(&valid); err != nil {
+		t.Errorf("expected rules of go-playground/validator to be accepted, got %v", err)
+	}
+
+	invalid := account{
+		Nickname: "jo",
+		Emails:   []string{"a@example.com", "not-an-email"},
+		Labels:   map[string]string{"team": "", "owner": "somebody"},
+	}
+	err := tools.Validate(&invalid)
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ValidationErrors, got %v", err)
+	}
+
+	expected := ValidationErrors{
+		"nickname":      {"must be at least 3 characters"},
+		"emails[1]":     {"must be a valid email address"},
+		"role":          {"is required"},
+		"labels[team]":  {"is required"},
+		"labels[owner]": {"must be at most 5 characters"},
+	}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("unexpected errors:\n got %v\nwant %v", errs, expected)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"balance": 10, "emails": ["a@example.com"], "role": "admin"}`))
+	if err := tools.ReadJSON(httptest.NewRecorder(), req, &valid); err != nil {
+		t.Errorf("expected ReadJSON to accept the body, got %v", err)
+	}
+}
+
+// TestTools_Validate_TagMistakes tests that rules Validate does not know are reported, even on
+// empty fields
+func TestTools_Validate_TagMistakes(t *testing.T) {
+	var tools Tools
+
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{name: "misspelt rule", value: &struct {
+			Name string `validate:"requird"`
+		}{Name: "Jane"}},
+		{name: "after omitempty", value: &struct {
+			Name string `validate:"omitempty,emial"`
+		}{}},
+		{name: "after dive", value: &struct {
+			Names []string `validate:"dive,mni=2"`
+		}{}},
+		{name: "dive on a string", value: &struct {
+			Name string `validate:"dive,required"`
+		}{Name: "Jane"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tools.Validate(tc.value)
+			var errs ValidationErrors
+			if err == nil || errors.As(err, &errs) {
+				t.Errorf("expected an error about the tag, got %v", err)
+			}
+		})
+	}
+}
+
+// TestTools_ReadJSON_Validation tests that ReadJSON validates what it decoded and ErrorJSON
+// reports the fields
+func TestTools_ReadJSON_Validation(t *testing.T) {
+	var tools Tools
+
+	var payload struct {
+		Name  string `json:"name" validate:"required"`
+		Email string `json:"email" validate:"email"`
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"email": "nope"}`))
+	err := tools.ReadJSON(httptest.NewRecorder(), req, &payload)
+	if err == nil {
+		t.Fatal("expected a validation error")
+	}
+
+	rr := httptest.NewRecorder()
+	tools.ErrorJSON(rr, err)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422, got %d", rr.Code)
+	}
+
+	var response struct {
+		Message string `json:"message"`
+		Data    struct {
+			Fields map[string][]string `json:"fields"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Data.Fields["name"][0] != "is required" || response.Data.Fields["email"][0] != "must be a valid email address" {
+		t.Errorf("unexpected fields %v", response.Data.Fields)
+	}
+}